@@ -0,0 +1,61 @@
+// rpcgen 根据protobuf的service定义生成rpc.Conn的Go客户端存根、服务端注册函数以及TypeScript客户端
+//
+// 在需要生成代码的包中添加:
+//
+//	//go:generate go run github.com/xiwh/hexhub-agent-plugin/cmd/rpcgen -proto=service.proto -go=service_rpc.go -ts=../web/src/service_rpc.ts
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/rpcgen"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	protoFile := flag.String("proto", "", "service definition file")
+	goOut := flag.String("go", "", "output path of the generated go file")
+	goPackage := flag.String("package", os.Getenv("GOPACKAGE"), "go package name, defaults to $GOPACKAGE or the proto package")
+	tsOut := flag.String("ts", "", "output path of the generated typescript file")
+	flag.Parse()
+
+	if *protoFile == "" || (*goOut == "" && *tsOut == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	err := generate(*protoFile, *goOut, *goPackage, *tsOut)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "rpcgen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func generate(protoFile string, goOut string, goPackage string, tsOut string) error {
+	src, err := os.ReadFile(protoFile)
+	if err != nil {
+		return err
+	}
+	file, err := rpcgen.Parse(string(src))
+	if err != nil {
+		return fmt.Errorf("%s: %w", protoFile, err)
+	}
+	source := filepath.Base(protoFile)
+	if goOut != "" {
+		code, err := rpcgen.GenerateGo(file, goPackage, source)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(goOut, code, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if tsOut != "" {
+		err = os.WriteFile(tsOut, rpcgen.GenerateTs(file, source), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dependency 插件依赖的其它插件,Version为对依赖插件版本号的约束
+type Dependency struct {
+	PluginId string `json:"pluginId"`
+	Version  string `json:"version"`
+}
+
+// Satisfied 判断依赖插件的版本号是否满足约束
+func (t Dependency) Satisfied(version int) (bool, error) {
+	return CheckVersionConstraint(t.Version, version)
+}
+
+func (t Dependency) String() string {
+	if t.Version == "" {
+		return t.PluginId
+	}
+	return t.PluginId + " " + t.Version
+}
+
+// CheckVersionConstraint 判断版本号是否满足约束,多个条件用逗号分隔且需要同时满足,
+// 支持>=、>、<=、<、=、!=,没有运算符时表示最低版本,例如">=3,<5";约束为空时不限制版本
+func CheckVersionConstraint(constraint string, version int) (bool, error) {
+	for _, clause := range strings.Split(constraint, ",") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		op := ">="
+		for _, prefix := range []string{">=", "<=", "!=", "==", ">", "<", "="} {
+			if strings.HasPrefix(clause, prefix) {
+				op = prefix
+				clause = strings.TrimSpace(strings.TrimPrefix(clause, prefix))
+				break
+			}
+		}
+		expected, err := strconv.Atoi(clause)
+		if err != nil {
+			return false, fmt.Errorf("invalid version constraint %q", constraint)
+		}
+		var ok bool
+		switch op {
+		case ">=":
+			ok = version >= expected
+		case ">":
+			ok = version > expected
+		case "<=":
+			ok = version <= expected
+		case "<":
+			ok = version < expected
+		case "!=":
+			ok = version != expected
+		default:
+			ok = version == expected
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Platform 某个系统平台的启动配置,在Manifest.Platforms中以"GOOS/GOARCH"或"GOOS"为键
+type Platform struct {
+	ExecEnter string            `json:"execEnter"`
+	Args      []string          `json:"args"`
+	Env       map[string]string `json:"env"`
+}
+
+// LaunchConfig 插件在某个平台上实际使用的启动配置,路径都相对于插件目录
+type LaunchConfig struct {
+	ExecEnter string
+	Args      []string
+	Env       map[string]string
+	Cwd       string
+}
+
+// LaunchConfig 合并manifest和匹配平台的启动配置,优先匹配"GOOS/GOARCH",其次"GOOS";
+// 平台的execEnter覆盖manifest的execEnter,args追加在后面,env同名时覆盖
+func (t Manifest) LaunchConfig(goos string, goarch string) (LaunchConfig, error) {
+	config := LaunchConfig{
+		ExecEnter: t.ExecEnter,
+		Args:      append([]string{}, t.Args...),
+		Env:       make(map[string]string, len(t.Env)),
+		Cwd:       t.Cwd,
+	}
+	for k, v := range t.Env {
+		config.Env[k] = v
+	}
+	platform, ok := t.Platforms[goos+"/"+goarch]
+	if !ok {
+		platform, ok = t.Platforms[goos]
+	}
+	if ok {
+		if platform.ExecEnter != "" {
+			config.ExecEnter = platform.ExecEnter
+		}
+		config.Args = append(config.Args, platform.Args...)
+		for k, v := range platform.Env {
+			config.Env[k] = v
+		}
+	}
+	if config.ExecEnter == "" {
+		return config, fmt.Errorf("plugin %s has no executable for platform %s/%s", t.PluginId, goos, goarch)
+	}
+	return config, nil
+}
+
+// Environ 返回KEY=VALUE形式的环境变量,按名称排序
+func (t LaunchConfig) Environ() []string {
+	env := make([]string, 0, len(t.Env))
+	for k, v := range t.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// Dir 返回工作目录的绝对路径,未设置cwd时返回空字符串,即继承master的工作目录
+func (t LaunchConfig) Dir(pluginDir string) string {
+	if t.Cwd == "" {
+		return ""
+	}
+	return filepath.Join(pluginDir, t.Cwd)
+}
+
+// isLocalPath 路径为相对路径并且不会跳出插件目录
+func isLocalPath(path string) bool {
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\`) {
+		return false
+	}
+	path = filepath.ToSlash(filepath.Clean(path))
+	return path != ".." && !strings.HasPrefix(path, "../")
+}
+
+func validatePlatformKey(key string) bool {
+	goos, goarch, ok := strings.Cut(key, "/")
+	if goos == "" || strings.ContainsAny(goos, `\ `) {
+		return false
+	}
+	return !ok || (goarch != "" && !strings.ContainsAny(goarch, `/\ `))
+}
@@ -0,0 +1,191 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/wonderivan/logger"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// ManifestSchemaVersion 当前的manifest格式版本;
+// 版本2使用严格解析,未知字段视为错误,未设置schemaVersion的旧manifest按版本1宽松解析
+const ManifestSchemaVersion = 2
+
+// pluginIdPattern 插件id同时用作目录名和url路径,只允许字母、数字、点、下划线和中划线
+var pluginIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var restartPolicies = []string{"", "never", "on-failure", "always"}
+
+// ManifestError manifest无效时返回的错误,包含所有不符合要求的地方
+type ManifestError struct {
+	PluginId string
+	Path     string
+	Problems []string
+}
+
+func (t *ManifestError) Error() string {
+	name := t.PluginId
+	if t.Path != "" {
+		name = strings.TrimSpace(name + " " + t.Path)
+	}
+	return fmt.Sprintf("invalid manifest of plugin %s: %s", name, strings.Join(t.Problems, "; "))
+}
+
+func (t *ManifestError) add(format string, args ...any) {
+	t.Problems = append(t.Problems, fmt.Sprintf(format, args...))
+}
+
+// Validate 校验manifest的必填字段和格式,不符合要求时返回*ManifestError
+func (t Manifest) Validate() error {
+	e := &ManifestError{PluginId: t.PluginId}
+	if t.SchemaVersion < 0 || t.SchemaVersion > ManifestSchemaVersion {
+		e.add("unsupported schemaVersion %d, the latest supported version is %d", t.SchemaVersion, ManifestSchemaVersion)
+	}
+	if t.PluginId == "" {
+		e.add("pluginId is required")
+	} else if !pluginIdPattern.MatchString(t.PluginId) {
+		e.add("pluginId %q must start with a letter or digit and contain at most 64 letters, digits, '.', '_' or '-'", t.PluginId)
+	}
+	if t.Name == "" {
+		e.add("name is required")
+	}
+	if t.Version <= 0 {
+		e.add("version must be a positive integer")
+	}
+	if t.ExecEnter == "" && len(t.Platforms) == 0 {
+		e.add("execEnter or platforms is required")
+	}
+	if t.ExecEnter != "" && !isLocalPath(t.ExecEnter) {
+		e.add("execEnter %q must be a path inside the plugin directory", t.ExecEnter)
+	}
+	for key, platform := range t.Platforms {
+		if !validatePlatformKey(key) {
+			e.add("platform %q must be in the form GOOS or GOOS/GOARCH", key)
+		}
+		if platform.ExecEnter != "" && !isLocalPath(platform.ExecEnter) {
+			e.add("execEnter %q of platform %s must be a path inside the plugin directory", platform.ExecEnter, key)
+		}
+		validateEnv(e, platform.Env)
+	}
+	validateEnv(e, t.Env)
+	if t.Cwd != "" && !isLocalPath(t.Cwd) {
+		e.add("cwd %q must be a path inside the plugin directory", t.Cwd)
+	}
+	if t.MinMasterVersion < 0 {
+		e.add("minMasterVersion must not be negative")
+	}
+	if !contains(restartPolicies, t.RestartPolicy) {
+		e.add("restartPolicy %q must be one of never, on-failure, always", t.RestartPolicy)
+	}
+	if t.MaxRestarts < 0 {
+		e.add("maxRestarts must not be negative")
+	}
+	for _, dep := range t.Dependencies {
+		if !pluginIdPattern.MatchString(dep.PluginId) {
+			e.add("dependency pluginId %q is invalid", dep.PluginId)
+		} else if dep.PluginId == t.PluginId {
+			e.add("plugin cannot depend on itself")
+		}
+		if _, err := CheckVersionConstraint(dep.Version, 0); err != nil {
+			e.add("dependency %s: %s", dep.PluginId, err)
+		}
+	}
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
+
+// CheckCompatible 检查插件是否支持当前的master版本和系统平台
+func (t Manifest) CheckCompatible(masterVersion int) error {
+	e := &ManifestError{PluginId: t.PluginId}
+	if t.MinMasterVersion > masterVersion {
+		e.add("requires master version %d or later, current version is %d", t.MinMasterVersion, masterVersion)
+	}
+	if len(t.OS) > 0 && !contains(t.OS, runtime.GOOS) {
+		e.add("supports os %s, current os is %s", strings.Join(t.OS, ", "), runtime.GOOS)
+	}
+	if len(t.Arch) > 0 && !contains(t.Arch, runtime.GOARCH) {
+		e.add("supports arch %s, current arch is %s", strings.Join(t.Arch, ", "), runtime.GOARCH)
+	}
+	if _, err := t.LaunchConfig(runtime.GOOS, runtime.GOARCH); err != nil {
+		e.add("no executable for platform %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
+
+// DecodeManifest 解析并校验manifest,schemaVersion为2时不允许未知字段
+func DecodeManifest(data []byte) (manifest Manifest, err error) {
+	var header struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		return manifest, &ManifestError{Problems: []string{err.Error()}}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if header.SchemaVersion >= 2 {
+		decoder.DisallowUnknownFields()
+	}
+	err = decoder.Decode(&manifest)
+	if err != nil {
+		return manifest, &ManifestError{PluginId: manifest.PluginId, Problems: []string{strings.TrimPrefix(err.Error(), "json: ")}}
+	}
+	return manifest, manifest.Validate()
+}
+
+// LoadManifests 读取插件目录下所有插件的manifest,invalid为manifest无效或没有manifest文件的插件目录及其错误
+func LoadManifests() (manifests map[string]Manifest, invalid map[string]error, err error) {
+	plugins, err := os.ReadDir(PluginsDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifests = make(map[string]Manifest, len(plugins))
+	invalid = make(map[string]error)
+	for _, pluginPath := range plugins {
+		if !pluginPath.IsDir() {
+			continue
+		}
+		manifest, err := GetManifest(pluginPath.Name())
+		if errors.Is(err, os.ErrNotExist) {
+			err = &ManifestError{PluginId: pluginPath.Name(), Problems: []string{"manifest.json not found"}}
+		}
+		if err != nil {
+			invalid[pluginPath.Name()] = err
+			continue
+		}
+		manifests[manifest.PluginId] = manifest
+	}
+	return manifests, invalid, nil
+}
+
+func validateEnv(e *ManifestError, env map[string]string) {
+	for k := range env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			e.add("env name %q is invalid", k)
+		}
+	}
+}
+
+func logInvalidManifests(invalid map[string]error) {
+	for _, err := range invalid {
+		logger.Error(err)
+	}
+}
+
+func contains(arr []string, s string) bool {
+	for _, item := range arr {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
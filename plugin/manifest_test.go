@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDecodeManifest(t *testing.T) {
+	cases := []struct {
+		json    string
+		problem string
+	}{
+		{`{"schemaVersion":2,"pluginId":"test","name":"test","version":1,"execCommand":"aa"}`, `unknown field "execCommand"`},
+		{`{"pluginId":"test","name":"test","version":1,"execCommand":"aa"}`, "execEnter or platforms is required"},
+		{`{"schemaVersion":2,"pluginId":"../test","name":"test","version":1,"execEnter":"aa"}`, `pluginId "../test" must start`},
+		{`{"schemaVersion":3,"pluginId":"test","name":"test","version":1,"execEnter":"aa"}`, "unsupported schemaVersion 3"},
+		{`{"schemaVersion":2,"pluginId":"test","name":"test","version":1,"execEnter":"aa","restartPolicy":"sometimes"}`, "restartPolicy"},
+		{`{"schemaVersion":2,"pluginId":"test","name":"test","version":1,"execEnter":"aa","dependencies":[{"pluginId":"db","version":">=x"}]}`, "invalid version constraint"},
+		{`{"schemaVersion":2,"pluginId":"test","version":"1"}`, "cannot unmarshal string"},
+	}
+	for _, c := range cases {
+		_, err := DecodeManifest([]byte(c.json))
+		var manifestErr *ManifestError
+		if !errors.As(err, &manifestErr) || !strings.Contains(err.Error(), c.problem) {
+			t.Errorf("%s: expected error containing %q, got %v", c.json, c.problem, err)
+		}
+	}
+
+	manifest, err := DecodeManifest([]byte(`{"schemaVersion":2,"pluginId":"test","name":"test","version":1,"execEnter":"aa","minMasterVersion":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = manifest.CheckCompatible(2); err == nil || !strings.Contains(err.Error(), "requires master version 3") {
+		t.Errorf("expected master version error, got %v", err)
+	}
+	if err = manifest.CheckCompatible(3); err != nil {
+		t.Error(err)
+	}
+	manifest.OS = []string{"plan9"}
+	manifest.Arch = []string{runtime.GOARCH}
+	if err = manifest.CheckCompatible(3); err == nil || !strings.Contains(err.Error(), "supports os plan9") {
+		t.Errorf("expected os error, got %v", err)
+	}
+}
+
+func TestLoadManifests(t *testing.T) {
+	PluginsDir = t.TempDir()
+	files := map[string]string{
+		"ok":    `{"schemaVersion":2,"pluginId":"ok","name":"ok","version":1,"execEnter":"ok"}`,
+		"bad":   `{"pluginId":"bad","name":"bad","version":1,"execCommand":"bad"}`,
+		"other": `{"pluginId":"ok","name":"ok","version":1,"execEnter":"ok"}`,
+	}
+	for id, content := range files {
+		err := os.MkdirAll(filepath.Join(PluginsDir, id), 0755)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(PluginsDir, id, "manifest.json"), []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(PluginsDir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, invalid, err := LoadManifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 || manifests["ok"].ExecEnter != "ok" {
+		t.Errorf("unexpected manifests: %+v", manifests)
+	}
+	if len(invalid) != 3 || invalid["bad"] == nil || invalid["other"] == nil || invalid["empty"] == nil {
+		t.Fatalf("unexpected invalid manifests: %v", invalid)
+	}
+	if !strings.Contains(invalid["bad"].Error(), "execEnter or platforms is required") ||
+		!strings.Contains(invalid["bad"].Error(), filepath.Join("bad", "manifest.json")) {
+		t.Errorf("unreadable error: %v", invalid["bad"])
+	}
+}
+
+func TestManifestLaunchConfig(t *testing.T) {
+	manifest, err := DecodeManifest([]byte(`{
+		"schemaVersion": 2, "pluginId": "test", "name": "test", "version": 1,
+		"args": ["-mode=prod"], "env": {"A": "1", "B": "2"}, "cwd": "data",
+		"platforms": {
+			"windows": {"execEnter": "bin/test.exe"},
+			"linux/arm64": {"execEnter": "bin/test-arm64", "args": ["-arm"], "env": {"B": "3"}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := manifest.LaunchConfig("linux", "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ExecEnter != "bin/test-arm64" || strings.Join(config.Args, " ") != "-mode=prod -arm" ||
+		strings.Join(config.Environ(), " ") != "A=1 B=3" || config.Dir("/p") != filepath.Join("/p", "data") {
+		t.Errorf("unexpected linux/arm64 config: %+v", config)
+	}
+	config, err = manifest.LaunchConfig("windows", "amd64")
+	if err != nil || config.ExecEnter != "bin/test.exe" || strings.Join(config.Environ(), " ") != "A=1 B=2" {
+		t.Errorf("unexpected windows config: %+v %v", config, err)
+	}
+	if _, err = manifest.LaunchConfig("darwin", "arm64"); err == nil {
+		t.Error("expected error for platform without executable")
+	}
+
+	_, err = DecodeManifest([]byte(`{"schemaVersion":2,"pluginId":"test","name":"test","version":1,
+		"execEnter":"../test","cwd":"/tmp","env":{"A=B":"1"},"platforms":{"linux/":{}}}`))
+	for _, problem := range []string{`execEnter "../test"`, `cwd "/tmp"`, `env name "A=B"`, `platform "linux/"`} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected error containing %q, got %v", problem, err)
+		}
+	}
+}
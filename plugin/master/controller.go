@@ -39,7 +39,7 @@ func pluginListHandler(writer http.ResponseWriter, req *http.Request) {
 	values := make([]PluginInfo, len(keys))
 	for i := 0; i < len(keys); i++ {
 		info, _ := pluginMap.Get(keys[i])
-		values[i] = *info
+		values[i] = info.snapshot()
 	}
 	_ = httputil2.OutResult(writer, httputil2.Success(values))
 }
@@ -51,7 +51,7 @@ func pluginInfoHandler(writer http.ResponseWriter, req *http.Request) {
 	if pluginInfo == nil {
 		_ = httputil2.OutResult(writer, httputil2.Error(fmt.Errorf("plugin %s does not exist", pluginId)))
 	} else {
-		_ = httputil2.OutResult(writer, httputil2.Success(pluginInfo))
+		_ = httputil2.OutResult(writer, httputil2.Success(pluginInfo.snapshot()))
 	}
 }
 
@@ -100,6 +100,12 @@ func pluginRestartHandler(writer http.ResponseWriter, req *http.Request) {
 func pluginStopHandler(writer http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 	pluginId := req.Form.Get("pluginId")
+	if _, ok := pluginMap.Get(pluginId); ok {
+		//用户主动停止,master重启后也不再启动
+		pluginRegistry.Update(pluginId, func(entry *RegistryEntry) {
+			entry.DesiredState = DesiredStateStopped
+		})
+	}
 	err := StopPlugin(pluginId)
 	if err != nil {
 		_ = httputil2.OutResult(writer, httputil2.Error(err))
@@ -118,6 +124,56 @@ func pluginStopHandler(writer http.ResponseWriter, req *http.Request) {
 	_ = httputil2.OutResult(writer, httputil2.Error(fmt.Errorf("stop plugin %s timeout", pluginId)))
 }
 
+func pluginLogsHandler(writer http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	pluginId := req.Form.Get("pluginId")
+	if _, ok := pluginMap.Get(pluginId); !ok {
+		_ = httputil2.OutResult(writer, httputil2.Error(fmt.Errorf("plugin %s does not exist", pluginId)))
+		return
+	}
+	tail := 200
+	if s := req.Form.Get("tail"); s != "" {
+		var err error
+		tail, err = strconv.Atoi(s)
+		if err != nil {
+			_ = httputil2.OutResult(writer, httputil2.Error(err))
+			return
+		}
+	}
+	//since为毫秒时间戳
+	var since time.Time
+	if s := req.Form.Get("since"); s != "" {
+		ms, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			_ = httputil2.OutResult(writer, httputil2.Error(err))
+			return
+		}
+		since = time.UnixMilli(ms)
+	}
+	lines, err := ReadLogs(pluginId, tail, since)
+	if err != nil {
+		_ = httputil2.OutResult(writer, httputil2.Error(err))
+		return
+	}
+	_ = httputil2.OutResult(writer, httputil2.Success(lines))
+}
+
+func pluginEnableHandler(writer http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	pluginId := req.Form.Get("pluginId")
+	enabled, err := strconv.ParseBool(req.Form.Get("enabled"))
+	if err != nil {
+		_ = httputil2.OutResult(writer, httputil2.Error(err))
+		return
+	}
+	err = SetPluginEnabled(pluginId, enabled)
+	if err != nil {
+		_ = httputil2.OutResult(writer, httputil2.Error(err))
+		return
+	}
+	_ = httputil2.OutResult(writer, httputil2.Success(""))
+}
+
 func pluginUninstallHandler(writer http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 	pluginId := req.Form.Get("pluginId")
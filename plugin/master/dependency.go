@@ -0,0 +1,130 @@
+package master
+
+import (
+	"fmt"
+	"github.com/xiwh/hexhub-agent-plugin/plugin"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dependencyStartTimeout 启动插件前等待依赖插件注册完成的时间
+const dependencyStartTimeout = 10 * time.Second
+
+// resolveStartOrder 按依赖关系返回启动顺序,依赖在前,pluginId在最后;
+// 存在循环依赖、依赖未安装或版本不满足约束时返回错误
+func resolveStartOrder(pluginId string, getManifest func(pluginId string) (plugin.Manifest, error)) ([]string, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var path []string
+	var order []string
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case visited:
+			return nil
+		case visiting:
+			for i, s := range path {
+				if s == id {
+					return fmt.Errorf("dependency cycle detected: %s", strings.Join(append(path[i:], id), " -> "))
+				}
+			}
+		}
+		state[id] = visiting
+		path = append(path, id)
+		manifest, err := getManifest(id)
+		if err != nil {
+			return err
+		}
+		for _, dep := range manifest.Dependencies {
+			depManifest, err := getManifest(dep.PluginId)
+			if err != nil {
+				return fmt.Errorf("plugin %s depends on %s, which is not installed: %w", id, dep, err)
+			}
+			ok, err := dep.Satisfied(depManifest.Version)
+			if err != nil {
+				return fmt.Errorf("plugin %s: %w", id, err)
+			}
+			if !ok {
+				return fmt.Errorf("plugin %s depends on %s, but version %d is installed", id, dep, depManifest.Version)
+			}
+			if err = visit(dep.PluginId); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = visited
+		order = append(order, id)
+		return nil
+	}
+	if err := visit(pluginId); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// waitPluginRunning 等待插件注册到master,依赖插件注册之后才能处理其它插件的请求
+func waitPluginRunning(pluginId string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		pluginInfo, ok := pluginMap.Get(pluginId)
+		if ok && pluginInfo.Status == PluginStatusRunning {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("start plugin %s timeout", pluginId)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// dependents 返回依赖pluginId的已安装插件
+func dependents(pluginId string) []string {
+	var ids []string
+	pluginMap.IterCb(func(k string, info *PluginInfo) {
+		for _, dep := range info.Dependencies {
+			if dep.PluginId == pluginId {
+				ids = append(ids, info.Id)
+				return
+			}
+		}
+	})
+	sort.Strings(ids)
+	return ids
+}
+
+// installDependencies 安装manifest中缺失或版本不满足约束的依赖,chain为正在安装的插件,用于检测循环依赖
+func installDependencies(manifest plugin.Manifest, appVersion int, chain []string) error {
+	chain = append(chain, manifest.PluginId)
+	for _, dep := range manifest.Dependencies {
+		for _, id := range chain {
+			if id == dep.PluginId {
+				return fmt.Errorf("dependency cycle detected: %s -> %s", strings.Join(chain, " -> "), dep.PluginId)
+			}
+		}
+		if dependencySatisfied(dep) {
+			continue
+		}
+		_, err := checkUpdate(dep.PluginId, appVersion, chain)
+		if err != nil {
+			return fmt.Errorf("failed to install dependency %s of plugin %s: %w", dep, manifest.PluginId, err)
+		}
+		if !dependencySatisfied(dep) {
+			return fmt.Errorf("plugin %s depends on %s, but no matching version is available", manifest.PluginId, dep)
+		}
+	}
+	return nil
+}
+
+func dependencySatisfied(dep plugin.Dependency) bool {
+	info, ok := pluginMap.Get(dep.PluginId)
+	if !ok || info.Status == PluginStatusDownloadFailed || info.Status == PluginStatusInstallFailed ||
+		info.Status == PluginStatusVerifyFailed {
+		return false
+	}
+	ok, _ = dep.Satisfied(info.Version)
+	return ok
+}
@@ -0,0 +1,99 @@
+package master
+
+import (
+	"fmt"
+	"github.com/xiwh/hexhub-agent-plugin/plugin"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDependencyStartOrder(t *testing.T) {
+	manifests := map[string]plugin.Manifest{
+		"app":   {PluginId: "app", Dependencies: []plugin.Dependency{{PluginId: "db", Version: ">=2"}, {PluginId: "cache"}}},
+		"db":    {PluginId: "db", Version: 3, Dependencies: []plugin.Dependency{{PluginId: "base"}}},
+		"cache": {PluginId: "cache", Version: 1, Dependencies: []plugin.Dependency{{PluginId: "base"}}},
+		"base":  {PluginId: "base", Version: 1},
+		"old":   {PluginId: "old", Dependencies: []plugin.Dependency{{PluginId: "db", Version: ">=2,<3"}}},
+		"lost":  {PluginId: "lost", Dependencies: []plugin.Dependency{{PluginId: "missing"}}},
+		"a":     {PluginId: "a", Dependencies: []plugin.Dependency{{PluginId: "b"}}},
+		"b":     {PluginId: "b", Dependencies: []plugin.Dependency{{PluginId: "c"}}},
+		"c":     {PluginId: "c", Dependencies: []plugin.Dependency{{PluginId: "b"}}},
+	}
+	getManifest := func(pluginId string) (plugin.Manifest, error) {
+		manifest, ok := manifests[pluginId]
+		if !ok {
+			return manifest, fmt.Errorf("plugin %s does not exist", pluginId)
+		}
+		return manifest, nil
+	}
+
+	order, err := resolveStartOrder("app", getManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"base", "db", "cache", "app"}) {
+		t.Errorf("unexpected order: %v", order)
+	}
+	_, err = resolveStartOrder("old", getManifest)
+	if err == nil || !strings.Contains(err.Error(), "version 3 is installed") {
+		t.Errorf("expected version error, got %v", err)
+	}
+	_, err = resolveStartOrder("lost", getManifest)
+	if err == nil || !strings.Contains(err.Error(), "not installed") {
+		t.Errorf("expected missing dependency error, got %v", err)
+	}
+	_, err = resolveStartOrder("a", getManifest)
+	if err == nil || !strings.Contains(err.Error(), "b -> c -> b") {
+		t.Errorf("expected cycle error, got %v", err)
+	}
+}
+
+func TestDependencyVersionConstraint(t *testing.T) {
+	cases := []struct {
+		constraint string
+		version    int
+		ok         bool
+	}{
+		{"", 1, true},
+		{"3", 3, true},
+		{"3", 2, false},
+		{">=2, <5", 4, true},
+		{">=2, <5", 5, false},
+		{"=2", 2, true},
+		{"!=2", 2, false},
+		{">1", 1, false},
+		{"<=1", 1, true},
+	}
+	for _, c := range cases {
+		ok, err := plugin.CheckVersionConstraint(c.constraint, c.version)
+		if err != nil || ok != c.ok {
+			t.Errorf("%q %d: expected %v, got %v %v", c.constraint, c.version, c.ok, ok, err)
+		}
+	}
+	if _, err := plugin.CheckVersionConstraint(">=x", 1); err == nil {
+		t.Error("expected error for invalid constraint")
+	}
+}
+
+func TestDependencyUninstallGuard(t *testing.T) {
+	defer pluginMap.Clear()
+	pluginMap.Set("db", &PluginInfo{Id: "db", Version: 3})
+	pluginMap.Set("app", &PluginInfo{Id: "app", Dependencies: []plugin.Dependency{{PluginId: "db", Version: ">=2"}}})
+
+	err := UninstallPlugin("db")
+	if err == nil || !strings.Contains(err.Error(), "required by app") {
+		t.Errorf("expected uninstall to be refused, got %v", err)
+	}
+	if !dependencySatisfied(plugin.Dependency{PluginId: "db", Version: ">=2"}) {
+		t.Error("installed dependency is not satisfied")
+	}
+	if dependencySatisfied(plugin.Dependency{PluginId: "db", Version: ">=4"}) {
+		t.Error("outdated dependency is satisfied")
+	}
+	//依赖链中已经出现的插件不会再次安装
+	err = installDependencies(plugin.Manifest{PluginId: "b", Dependencies: []plugin.Dependency{{PluginId: "a"}}}, 0, []string{"a"})
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> a") {
+		t.Errorf("expected cycle error, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package master
+
+import (
+	"github.com/xiwh/hexhub-agent-plugin/plugin"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunLaunchConfig(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell script")
+	}
+	pluginRegistry = &registry{entries: make(map[string]*RegistryEntry)}
+	plugin.HomeDir = t.TempDir()
+	defer pluginLogs.Clear()
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "bin", "data"), 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "bin", "run.sh"), []byte("#!/bin/sh\necho \"$@\"\necho \"$FOO\"\npwd\n"), 0755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := plugin.Manifest{
+		PluginId:  "launch",
+		Args:      []string{"-extra"},
+		Env:       map[string]string{"FOO": "bar"},
+		Cwd:       "bin/data",
+		Platforms: map[string]plugin.Platform{runtime.GOOS: {ExecEnter: "bin/run.sh"}},
+	}
+	launch, err := manifest.LaunchConfig(runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &PluginInfo{Id: "launch", PluginDir: dir, ExecEnter: launch.ExecEnter, launch: launch, lock: new(sync.Mutex)}
+	pluginMap.Set(info.Id, info)
+	defer pluginMap.Clear()
+
+	info.lock.Lock()
+	err = run(info)
+	info.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	var lines []LogLine
+	for len(lines) < 3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		lines = RecentLogs("launch", 0)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("unexpected output: %+v", lines)
+	}
+	if !strings.HasPrefix(lines[0].Text, "-token=") || !strings.HasSuffix(lines[0].Text, " -extra") {
+		t.Errorf("unexpected args: %s", lines[0].Text)
+	}
+	if lines[1].Text != "bar" {
+		t.Errorf("unexpected env: %s", lines[1].Text)
+	}
+	wd, _ := filepath.EvalSymlinks(filepath.Join(dir, "bin", "data"))
+	if pwd, _ := filepath.EvalSymlinks(lines[2].Text); pwd != wd {
+		t.Errorf("unexpected working directory: %s", lines[2].Text)
+	}
+}
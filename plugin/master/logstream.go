@@ -0,0 +1,290 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/wonderivan/logger"
+	httputil2 "github.com/xiwh/hexhub-agent-plugin/util/httputil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 日志级别,由低到高
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// followerBufferSize 每个订阅者缓冲的日志行数,消费过慢时丢弃新的日志行
+const followerBufferSize = 256
+
+// logKeepAliveInterval SSE连接的心跳间隔,避免被代理断开
+const logKeepAliveInterval = 15 * time.Second
+
+// logLevelScanSize 在行首多少字节内查找[LEVEL]标记
+const logLevelScanSize = 64
+
+var logLevelOrder = map[string]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+// logLevelAlias 常见日志库的级别写法,包括wonderivan/logger的缩写
+var logLevelAlias = map[string]string{
+	"trace":    LogLevelDebug,
+	"trac":     LogLevelDebug,
+	"debug":    LogLevelDebug,
+	"debg":     LogLevelDebug,
+	"dbg":      LogLevelDebug,
+	"info":     LogLevelInfo,
+	"inf":      LogLevelInfo,
+	"notice":   LogLevelInfo,
+	"warn":     LogLevelWarn,
+	"warning":  LogLevelWarn,
+	"wrn":      LogLevelWarn,
+	"error":    LogLevelError,
+	"eror":     LogLevelError,
+	"err":      LogLevelError,
+	"crit":     LogLevelError,
+	"critical": LogLevelError,
+	"alrt":     LogLevelError,
+	"alert":    LogLevelError,
+	"emer":     LogLevelError,
+	"fatal":    LogLevelError,
+	"panic":    LogLevelError,
+}
+
+// logFollower 一个实时跟踪日志的订阅者
+type logFollower struct {
+	ch chan LogLine
+}
+
+// push 非阻塞地投递日志行,缓冲已满时丢弃;调用时需要持有pluginLog的锁
+func (t *logFollower) push(line LogLine) {
+	select {
+	case t.ch <- line:
+	default:
+	}
+}
+
+// follow 订阅新的日志行并返回最近的backlog行,两者在同一把锁内完成,不会遗漏或重复
+func (t *pluginLog) follow(backlog int) ([]LogLine, *logFollower, func()) {
+	follower := &logFollower{ch: make(chan LogLine, followerBufferSize)}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var lines []LogLine
+	if backlog > 0 {
+		lines = t.recentLocked(backlog)
+		if len(lines) == 0 {
+			//master重启后内存中没有日志,从文件中读取
+			var err error
+			lines, err = readLogs(t.dir, backlog, time.Time{})
+			if err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+	if t.followers == nil {
+		t.followers = make(map[*logFollower]struct{})
+	}
+	t.followers[follower] = struct{}{}
+	return lines, follower, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.followers, follower)
+	}
+}
+
+// detectLevel 识别结构化日志的级别,支持JSON的level/lvl/severity字段和行首的[LEVEL]标记,
+// 无法识别时stderr视为error,stdout视为info
+func detectLevel(stream string, text string) string {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "{") {
+		var fields map[string]any
+		if json.Unmarshal([]byte(trimmed), &fields) == nil {
+			for _, key := range []string{"level", "lvl", "severity"} {
+				if s, ok := fields[key].(string); ok {
+					if level, ok := logLevelAlias[strings.ToLower(s)]; ok {
+						return level
+					}
+				}
+			}
+		}
+	}
+	head := text
+	if len(head) > logLevelScanSize {
+		head = head[:logLevelScanSize]
+	}
+	for {
+		start := strings.IndexByte(head, '[')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(head[start:], ']')
+		if end < 0 {
+			break
+		}
+		if level, ok := logLevelAlias[strings.ToLower(head[start+1:start+end])]; ok {
+			return level
+		}
+		head = head[start+end:]
+	}
+	if stream == LogStreamStderr {
+		return LogLevelError
+	}
+	return LogLevelInfo
+}
+
+// levelEnabled 日志行的级别不低于minLevel时返回true,minLevel为空时不过滤
+func levelEnabled(level string, minLevel string) bool {
+	if minLevel == "" {
+		return true
+	}
+	return logLevelOrder[level] >= logLevelOrder[minLevel]
+}
+
+var logUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 0x1fff,
+	//与ServeHTTP使用相同的token或域名校验
+	CheckOrigin: func(r *http.Request) bool {
+		ok, _ := authorize(r)
+		return ok
+	},
+}
+
+// pluginLogsFollowHandler 实时输出插件日志,websocket请求每条消息为一行日志的JSON,
+// 其它请求使用SSE;先回放最近tail行,level为最低日志级别
+func pluginLogsFollowHandler(writer http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	pluginId := req.Form.Get("pluginId")
+	if _, ok := pluginMap.Get(pluginId); !ok {
+		_ = httputil2.OutResult(writer, httputil2.Error(fmt.Errorf("plugin %s does not exist", pluginId)))
+		return
+	}
+	tail := 200
+	if s := req.Form.Get("tail"); s != "" {
+		var err error
+		tail, err = strconv.Atoi(s)
+		if err != nil {
+			_ = httputil2.OutResult(writer, httputil2.Error(err))
+			return
+		}
+	}
+	minLevel := strings.ToLower(req.Form.Get("level"))
+	if minLevel != "" {
+		if _, ok := logLevelOrder[minLevel]; !ok {
+			_ = httputil2.OutResult(writer, httputil2.Error(fmt.Errorf("unknown log level %s", minLevel)))
+			return
+		}
+	}
+
+	if websocket.IsWebSocketUpgrade(req) {
+		followWebsocket(writer, req, pluginId, tail, minLevel)
+	} else {
+		followSSE(writer, req, pluginId, tail, minLevel)
+	}
+}
+
+func followWebsocket(writer http.ResponseWriter, req *http.Request, pluginId string, tail int, minLevel string) {
+	wsConn, err := logUpgrader.Upgrade(writer, req, nil)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	defer wsConn.Close()
+	backlog, follower, unsubscribe := getPluginLog(pluginId).follow(tail)
+	defer unsubscribe()
+
+	//客户端只会发送关闭帧,读取失败即认为连接已断开
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := wsConn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, line := range backlog {
+		if !levelEnabled(line.Level, minLevel) {
+			continue
+		}
+		if err = wsConn.WriteJSON(line); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case <-closed:
+			return
+		case line := <-follower.ch:
+			if !levelEnabled(line.Level, minLevel) {
+				continue
+			}
+			if err = wsConn.WriteJSON(line); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func followSSE(writer http.ResponseWriter, req *http.Request, pluginId string, tail int, minLevel string) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		_ = httputil2.OutResult(writer, httputil2.Error(fmt.Errorf("streaming is not supported")))
+		return
+	}
+	header := writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	writer.WriteHeader(200)
+
+	backlog, follower, unsubscribe := getPluginLog(pluginId).follow(tail)
+	defer unsubscribe()
+
+	send := func(line LogLine) error {
+		if !levelEnabled(line.Level, minLevel) {
+			return nil
+		}
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(writer, "data: %s\n\n", data)
+		return err
+	}
+	for _, line := range backlog {
+		if err := send(line); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(logKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case line := <-follower.ch:
+			if err := send(line); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
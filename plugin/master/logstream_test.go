@@ -0,0 +1,130 @@
+package master
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/xiwh/hexhub-agent-plugin/plugin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogStreamDetectLevel(t *testing.T) {
+	cases := []struct {
+		stream string
+		text   string
+		level  string
+	}{
+		{LogStreamStdout, `{"level":"WARN","msg":"disk almost full"}`, LogLevelWarn},
+		{LogStreamStdout, `{"severity":"debug"}`, LogLevelDebug},
+		{LogStreamStdout, "2024-01-02 03:04:05 [EROR] [main.go:12] failed", LogLevelError},
+		{LogStreamStderr, "2024-01-02 03:04:05 [INFO] [main.go:12] started", LogLevelInfo},
+		{LogStreamStdout, "plain output [x]", LogLevelInfo},
+		{LogStreamStderr, "panic: boom", LogLevelError},
+	}
+	for _, c := range cases {
+		if level := detectLevel(c.stream, c.text); level != c.level {
+			t.Errorf("%s: expected %s, got %s", c.text, c.level, level)
+		}
+	}
+}
+
+func TestLogStreamFollow(t *testing.T) {
+	plugin.HomeDir = t.TempDir()
+	defer pluginLogs.Clear()
+	pluginMap.Set("demo", &PluginInfo{Id: "demo"})
+	defer pluginMap.Clear()
+	log := getPluginLog("demo")
+	log.capture(LogStreamStdout, strings.NewReader("[DEBG] old debug\n[WARN] old warn\n"))
+
+	server := httptest.NewServer(http.HandlerFunc(pluginLogsFollowHandler))
+	defer server.Close()
+
+	//SSE订阅者
+	resp, err := http.Get(server.URL + "?pluginId=demo&level=warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	events := make(chan LogLine, 10)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data := strings.TrimPrefix(scanner.Text(), "data: ")
+			if data == scanner.Text() {
+				continue
+			}
+			var line LogLine
+			if json.Unmarshal([]byte(data), &line) == nil {
+				events <- line
+			}
+		}
+	}()
+
+	//websocket订阅者,回放最近1行;origin需要通过与ServeHTTP相同的校验
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "?pluginId=demo&tail=1"
+	_, _, err = websocket.DefaultDialer.Dial(wsUrl, http.Header{"Origin": {"http://evil.example.com"}})
+	if err == nil {
+		t.Fatal("expected handshake with disallowed origin to fail")
+	}
+	mAllowedDomainNames.Set("app.example.com", nil)
+	defer mAllowedDomainNames.Clear()
+	wsConn, _, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"Origin": {"http://app.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsConn.Close()
+	var line LogLine
+	if err = wsConn.ReadJSON(&line); err != nil || line.Text != "[WARN] old warn" {
+		t.Fatalf("unexpected websocket backlog: %+v %v", line, err)
+	}
+
+	expectEvent := func(text string) {
+		select {
+		case line := <-events:
+			if line.Text != text {
+				t.Fatalf("expected %s, got %+v", text, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", text)
+		}
+	}
+	expectEvent("[WARN] old warn")
+
+	log.capture(LogStreamStdout, strings.NewReader("info line\n"))
+	log.capture(LogStreamStderr, strings.NewReader("stderr line\n"))
+	expectEvent("stderr line")
+	_ = wsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, text := range []string{"info line", "stderr line"} {
+		if err = wsConn.ReadJSON(&line); err != nil || line.Text != text {
+			t.Fatalf("expected %s, got %+v %v", text, line, err)
+		}
+	}
+	if line.Level != LogLevelError || line.Stream != LogStreamStderr {
+		t.Errorf("unexpected stderr line: %+v", line)
+	}
+
+	//断开后订阅者被移除
+	_ = wsConn.Close()
+	resp.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		log.write(LogStreamStdout, []byte("tick"))
+		log.lock.Lock()
+		n := len(log.followers)
+		log.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d followers are not removed", n)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
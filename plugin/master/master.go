@@ -17,6 +17,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
@@ -40,6 +41,15 @@ const PluginStatusDownloading = 3
 const PluginStatusDownloadFailed = 4
 const PluginStatusInstallFailed = 5
 
+// PluginStatusCrashLoop 插件连续崩溃达到重启次数上限,需要手动启动
+const PluginStatusCrashLoop = 6
+
+// PluginStatusInvalid 插件的manifest无效或不兼容当前master和系统,ErrorMsg为具体原因
+const PluginStatusInvalid = 7
+
+// PluginStatusVerifyFailed 插件安装包的签名或sha256校验失败,没有安装
+const PluginStatusVerifyFailed = 8
+
 var RouteMap = make(map[string]func(http.ResponseWriter, *http.Request))
 
 type PluginInfo struct {
@@ -56,10 +66,31 @@ type PluginInfo struct {
 	Endpoint       string `json:"endpoint"`
 	PluginDir      string `json:"pluginDir"`
 	AutoExit       bool   `json:"autoExit"`
-	Connections    int64  `json:"connections"`
-	LastConnTime   int64  `json:"lastConnTime"`
-	lock           *sync.Mutex
-	cmd            *exec.Cmd
+	AutoStart      bool   `json:"autoStart"`
+	RestartPolicy  string `json:"restartPolicy"`
+	MaxRestarts    int    `json:"maxRestarts"`
+	RestartCount   int    `json:"restartCount"`
+	RetryCount     int    `json:"retryCount"`
+	NextRetryTime  int64  `json:"nextRetryTime"`
+	LastExitCode   int    `json:"lastExitCode"`
+	LastSignal     string `json:"lastSignal"`
+	LastExitTime   int64  `json:"lastExitTime"`
+	// CrashLog 最近一次异常退出前的输出
+	CrashLog     []LogLine           `json:"crashLog,omitempty"`
+	Dependencies []plugin.Dependency `json:"dependencies"`
+	Connections  int64               `json:"connections"`
+	LastConnTime int64               `json:"lastConnTime"`
+	// Registry、DesiredState、ActualState和Drift只在接口返回的副本中填充
+	Registry     *RegistryEntry `json:"registry,omitempty"`
+	DesiredState string         `json:"desiredState,omitempty"`
+	ActualState  string         `json:"actualState,omitempty"`
+	Drift        bool           `json:"drift"`
+	lock         *sync.Mutex
+	cmd          *exec.Cmd
+	startTime    time.Time
+	stopping     bool
+	// launch 当前平台的启动配置,ExecEnter为其中的可执行文件
+	launch plugin.LaunchConfig
 }
 
 type masterInfo struct {
@@ -81,17 +112,37 @@ func Start(namespace string, version int, versionName, apiEndpoint string, allow
 	}
 	token := uuid.New().String()
 	plugin.Init(MasterId, namespace, apiEndpoint, port, debug, token)
-	manifests, err := plugin.GetManifests()
+	manifests, invalid, err := loadManifests()
+	if err != nil {
+		panic(err)
+	}
+	pluginRegistry, err = loadRegistry(filepath.Join(plugin.HomeDir, RegistryFileName))
+	if err != nil {
+		logger.Error(err)
+	}
+	pluginRegistry.reconcile(plugin.PluginsDir, manifests, invalid)
+	err = loadTrustedKeys(filepath.Join(plugin.HomeDir, TrustedKeysFileName))
+	if err != nil {
+		logger.Error(err)
+	}
+	//对比注册表时可能清除了不完整的插件目录,重新读取
+	manifests, invalid, err = loadManifests()
 	if err != nil {
 		panic(err)
 	}
 	for _, manifest := range manifests {
 		initManifest(manifest)
 	}
+	for pluginId, err := range invalid {
+		logger.Error(err)
+		initInvalidPlugin(pluginId, err)
+	}
+	applyAutoStart()
 	// Forwards incoming requests to whatever location URL points to, adds proper forwarding headers
 	mForward, _ = forward.New()
 	heartbeat()
 	pluginCoDeath()
+	reconcileLoop()
 	panic(http.ListenAndServe(plugin.AgentAddr, new(masterHttpHandle)))
 }
 
@@ -99,24 +150,31 @@ func RegisterRoute(pattern string, f func(http.ResponseWriter, *http.Request)) {
 	RouteMap[strings.TrimLeft(pattern, "/")] = f
 }
 
-func (t masterHttpHandle) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
-	refererUrl, _ := url.Parse(req.Header.Get("Referer"))
-	originUrl, _ := url.Parse(req.Header.Get("Origin"))
-	//判断是否允许访问
+// authorize 判断请求是否允许访问,不允许时返回错误提示
+func authorize(req *http.Request) (bool, string) {
 	if req.Header.Get("Token") != "" {
 		//如果有token则验证token是否有效
 		if !checkToken(req) {
-			writer.WriteHeader(401)
-			writer.Write([]byte("<h1>session has expired</h1>"))
-			return
-		}
-	} else {
-		//否则验证origin或referer域名是否有效
-		if !mAllowedDomainNames.Has(originUrl.Host) && !mAllowedDomainNames.Has(refererUrl.Host) {
-			writer.WriteHeader(401)
-			writer.Write([]byte("<h1>session invalid</h1>"))
-			return
+			return false, "<h1>session has expired</h1>"
 		}
+		return true, ""
+	}
+	//否则验证origin或referer域名是否有效
+	refererUrl, _ := url.Parse(req.Header.Get("Referer"))
+	originUrl, _ := url.Parse(req.Header.Get("Origin"))
+	if !mAllowedDomainNames.Has(originUrl.Host) && !mAllowedDomainNames.Has(refererUrl.Host) {
+		return false, "<h1>session invalid</h1>"
+	}
+	return true, ""
+}
+
+func (t masterHttpHandle) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	originUrl, _ := url.Parse(req.Header.Get("Origin"))
+	//判断是否允许访问
+	if ok, msg := authorize(req); !ok {
+		writer.WriteHeader(401)
+		writer.Write([]byte(msg))
+		return
 	}
 
 	//允许跨域处理
@@ -156,6 +214,15 @@ func (t masterHttpHandle) ServeHTTP(writer http.ResponseWriter, req *http.Reques
 	case "/plugin/stop":
 		pluginStopHandler(writer, req)
 		break
+	case "/plugin/logs":
+		pluginLogsHandler(writer, req)
+		break
+	case "/plugin/logs/follow":
+		pluginLogsFollowHandler(writer, req)
+		break
+	case "/plugin/enable":
+		pluginEnableHandler(writer, req)
+		break
 	case "/plugin/uninstall":
 		pluginUninstallHandler(writer, req)
 		break
@@ -263,6 +330,10 @@ func heartbeat() {
 					if info.AutoExit && info.Connections == 0 && (now-info.LastConnTime) >= AutoExitTimeLimit {
 						//达到自动退出的条件(允许自动退出且没有进行中的连接且超过5分钟未进行连接)
 						if !plugin.Debug {
+							//自动退出后等待下次使用时再启动
+							pluginRegistry.Update(info.Id, func(entry *RegistryEntry) {
+								entry.DesiredState = DesiredStateStopped
+							})
 							_ = StopPlugin(info.Id)
 						}
 					} else {
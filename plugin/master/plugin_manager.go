@@ -26,6 +26,11 @@ type VersionInfo struct {
 	UpdateDescription string          `json:"updateDescription"`
 	TotalSize         int64           `json:"totalSize"`
 	DownloadUrl       string          `json:"downloadUrl"`
+	// Sha256 安装包的sha256,十六进制
+	Sha256 string `json:"sha256"`
+	// Signature 发布者对PackageSigningMessage的ed25519签名,base64编码;KeyId为签名使用的公钥
+	Signature string `json:"signature"`
+	KeyId     string `json:"keyId"`
 }
 
 type CheckUpdateResult struct {
@@ -46,14 +51,21 @@ var globalLock = new(sync.Mutex)
 func initManifest(manifest plugin.Manifest) *PluginInfo {
 	globalLock.Lock()
 	defer globalLock.Unlock()
+	//manifest已经检查过兼容性,当前平台一定有可执行文件
+	launch, _ := manifest.LaunchConfig(runtime.GOOS, runtime.GOARCH)
 	pluginInfo, ok := pluginMap.Get(manifest.PluginId)
 	if ok {
 		pluginInfo.Version = manifest.Version
 		pluginInfo.VersionName = manifest.VersionName
-		pluginInfo.ExecEnter = manifest.ExecEnter
+		pluginInfo.ExecEnter = launch.ExecEnter
+		pluginInfo.launch = launch
 		pluginInfo.Description = manifest.Description
 		pluginInfo.Endpoint = manifest.Endpoint
 		pluginInfo.AutoExit = manifest.AutoExit
+		pluginInfo.AutoStart = manifest.AutoStart
+		pluginInfo.RestartPolicy = manifest.RestartPolicy
+		pluginInfo.MaxRestarts = manifest.MaxRestarts
+		pluginInfo.Dependencies = manifest.Dependencies
 		pluginInfo.DownloadedSize = 0
 	} else {
 		pluginInfo = &PluginInfo{
@@ -62,24 +74,109 @@ func initManifest(manifest plugin.Manifest) *PluginInfo {
 			Description:    manifest.Description,
 			Version:        manifest.Version,
 			VersionName:    manifest.VersionName,
-			ExecEnter:      manifest.ExecEnter,
+			ExecEnter:      launch.ExecEnter,
 			AutoExit:       manifest.AutoExit,
+			AutoStart:      manifest.AutoStart,
+			RestartPolicy:  manifest.RestartPolicy,
+			MaxRestarts:    manifest.MaxRestarts,
+			Dependencies:   manifest.Dependencies,
 			Status:         PluginStatusNotStarted,
 			DownloadedSize: 0,
 			ErrorMsg:       "",
 			Endpoint:       manifest.Endpoint,
 			PluginDir:      strings.Join([]string{plugin.PluginsDir, string(os.PathSeparator), manifest.PluginId}, ""),
 			lock:           new(sync.Mutex),
+			launch:         launch,
 		}
 		pluginMap.Set(manifest.PluginId, pluginInfo)
 	}
 	return pluginInfo
 }
 
+// initInvalidPlugin 记录manifest无效的插件,在插件列表中显示错误原因
+func initInvalidPlugin(pluginId string, err error) *PluginInfo {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	pluginInfo, ok := pluginMap.Get(pluginId)
+	if !ok {
+		pluginInfo = &PluginInfo{
+			Id:        pluginId,
+			Name:      pluginId,
+			PluginDir: strings.Join([]string{plugin.PluginsDir, string(os.PathSeparator), pluginId}, ""),
+			lock:      new(sync.Mutex),
+		}
+		pluginMap.Set(pluginId, pluginInfo)
+	}
+	pluginInfo.Status = PluginStatusInvalid
+	pluginInfo.ErrorMsg = err.Error()
+	return pluginInfo
+}
+
+// getManifest 读取已安装插件的manifest,并检查是否兼容当前master和系统
+func getManifest(pluginId string) (plugin.Manifest, error) {
+	manifest, err := plugin.GetManifest(pluginId)
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, manifest.CheckCompatible(CurrentVersion)
+}
+
+// loadManifests 读取所有插件的manifest,不兼容的插件与manifest无效的插件一起放入invalid
+func loadManifests() (map[string]plugin.Manifest, map[string]error, error) {
+	manifests, invalid, err := plugin.LoadManifests()
+	if err != nil {
+		return nil, nil, err
+	}
+	for pluginId, manifest := range manifests {
+		if err = manifest.CheckCompatible(CurrentVersion); err != nil {
+			delete(manifests, pluginId)
+			invalid[pluginId] = err
+		}
+	}
+	return manifests, invalid, nil
+}
+
 func GetPluginInfo(pluginId string) (*PluginInfo, bool) {
 	return pluginMap.Get(pluginId)
 }
 
+// snapshot 返回用于接口输出的副本,附带持久化的插件状态
+func (t *PluginInfo) snapshot() PluginInfo {
+	info := *t
+	info.DesiredState = DesiredStateStopped
+	entry, ok := pluginRegistry.Get(t.Id)
+	if ok {
+		info.Registry = &entry
+		if entry.Enabled {
+			info.DesiredState = entry.DesiredState
+		}
+	}
+	info.ActualState = actualState(t)
+	info.Drift = isDrifted(info.DesiredState, info.ActualState)
+	return info
+}
+
+// SetPluginEnabled 启用或禁用插件,禁用后插件不能启动,正在运行的插件会被停止
+func SetPluginEnabled(pluginId string, enabled bool) error {
+	_, ok := pluginMap.Get(pluginId)
+	if !ok {
+		return fmt.Errorf("plugin %s does not exist", pluginId)
+	}
+	pluginRegistry.Update(pluginId, func(entry *RegistryEntry) {
+		entry.Enabled = enabled
+		if !enabled {
+			entry.DesiredState = DesiredStateStopped
+		}
+	})
+	if !enabled {
+		pluginInfo, _ := pluginMap.Get(pluginId)
+		if pluginInfo.Status == PluginStatusRunning || pluginInfo.Status == PluginStatusStarting {
+			return StopPlugin(pluginId)
+		}
+	}
+	return nil
+}
+
 func RestartPlugin(pluginId string) error {
 	err := StopPlugin(pluginId)
 	//如果之前在启动中，那么等待250ms再重启，避免重启失败
@@ -101,8 +198,35 @@ func StopPlugin(pluginId string) error {
 	return fmt.Errorf("plugin %s is not running", pluginId)
 }
 
+// StartPlugin 先按顺序启动插件依赖的插件,再启动插件本身
 func StartPlugin(pluginId string) error {
+	order, err := resolveStartOrder(pluginId, getManifest)
+	if err != nil {
+		return err
+	}
+	for _, id := range order[:len(order)-1] {
+		err = startPlugin(id)
+		if err == nil {
+			err = waitPluginRunning(id, dependencyStartTimeout)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to start dependency %s of plugin %s: %w", id, pluginId, err)
+		}
+	}
+	return startPlugin(pluginId)
+}
+
+func startPlugin(pluginId string) error {
+	entry, ok := pluginRegistry.Get(pluginId)
+	if ok && !entry.Enabled {
+		return fmt.Errorf("plugin %s is disabled", pluginId)
+	}
 	currentInfo, ok := pluginMap.Get(pluginId)
+	if ok {
+		pluginRegistry.Update(pluginId, func(entry *RegistryEntry) {
+			entry.DesiredState = DesiredStateRunning
+		})
+	}
 	if ok {
 		currentInfo.lock.Lock()
 		currentInfo, ok = pluginMap.Get(pluginId)
@@ -127,17 +251,29 @@ func StartPlugin(pluginId string) error {
 		}
 	}
 	//未检测到启动
-	manifest, err := plugin.GetManifest(pluginId)
+	manifest, err := getManifest(pluginId)
 	if err != nil {
+		var manifestErr *plugin.ManifestError
+		if _, ok := pluginMap.Get(pluginId); ok && errors.As(err, &manifestErr) {
+			initInvalidPlugin(pluginId, err)
+		}
 		return err
 	}
 	pluginInfo := initManifest(manifest)
 	pluginInfo.lock.Lock()
 	defer pluginInfo.lock.Unlock()
+	//手动启动时重新计算连续重启次数,包括处于崩溃循环的插件
+	pluginInfo.RetryCount = 0
+	pluginInfo.NextRetryTime = 0
 	return run(pluginInfo)
 }
 
+// CheckUpdate 检查插件更新,插件未安装或有新版本时先安装缺失的依赖,再安装插件
 func CheckUpdate(pluginId string, appVersion int) (result CheckUpdateResult, err error) {
+	return checkUpdate(pluginId, appVersion, nil)
+}
+
+func checkUpdate(pluginId string, appVersion int, chain []string) (result CheckUpdateResult, err error) {
 	now := time.Now().UnixMilli()
 	latestInfo, _ := latestInfoMap.Get(pluginId)
 	if latestInfo == nil || now-latestInfo.time >= 5*60000 {
@@ -167,8 +303,14 @@ func CheckUpdate(pluginId string, appVersion int) (result CheckUpdateResult, err
 	if !ok ||
 		currentInfo.Status == PluginStatusDownloadFailed ||
 		currentInfo.Status == PluginStatusInstallFailed ||
+		currentInfo.Status == PluginStatusVerifyFailed ||
+		currentInfo.Status == PluginStatusInvalid ||
 		currentInfo.Version < latestInfo.info.Manifest.Version {
 
+		err = installDependencies(latestInfo.info.Manifest, appVersion, chain)
+		if err != nil {
+			return result, err
+		}
 		err = InstallPlugin(latestInfo.info, latestInfo.info.Manifest)
 		if err != nil {
 			return result, err
@@ -194,6 +336,9 @@ func UninstallPlugin(pluginId string) error {
 		_ = os.RemoveAll(filepath.Join(plugin.PluginsDir, pluginId))
 		return nil
 	}
+	if ids := dependents(pluginId); len(ids) > 0 {
+		return fmt.Errorf("plugin %s is required by %s, uninstall them first", pluginId, strings.Join(ids, ", "))
+	}
 
 	pluginInfo.lock.Lock()
 	defer pluginInfo.lock.Unlock()
@@ -204,15 +349,28 @@ func UninstallPlugin(pluginId string) error {
 	}
 	time.Sleep(500 * time.Millisecond)
 	err = os.RemoveAll(pluginInfo.PluginDir)
-	if err != nil {
+	if err == nil {
 		globalLock.Lock()
 		defer globalLock.Unlock()
 		pluginMap.Remove(pluginId)
+		pluginRegistry.Remove(pluginId)
+		if log, ok := pluginLogs.Pop(pluginId); ok {
+			log.closeFile()
+		}
+		_ = os.RemoveAll(logDir(pluginId))
 	}
 	return err
 }
 
 func InstallPlugin(latestInfo VersionInfo, manifest plugin.Manifest) error {
+	//下载前先检查服务端返回的manifest,避免下载无法使用的插件
+	err := manifest.Validate()
+	if err == nil {
+		err = manifest.CheckCompatible(CurrentVersion)
+	}
+	if err != nil {
+		return err
+	}
 	globalLock.Lock()
 	//安装前的插件信息
 	temp, ok := pluginMap.Get(manifest.PluginId)
@@ -222,12 +380,22 @@ func InstallPlugin(latestInfo VersionInfo, manifest plugin.Manifest) error {
 	}
 	globalLock.Unlock()
 
+	//停止插件和更新插件信息之前校验签名,签名覆盖插件id、版本号和安装包的sha256,校验失败时已安装的插件不受影响
+	if latestInfo.PluginId != manifest.PluginId || latestInfo.Version != manifest.Version {
+		err = fmt.Errorf("version info of plugin %s version %d does not match its manifest", latestInfo.PluginId, latestInfo.Version)
+	} else {
+		err = verifySignature(latestInfo)
+	}
+	if err != nil {
+		return verifyFailed(manifest, err)
+	}
+
 	//安装前提前关闭进程防止无法操作相关文件
 	currentInfo := initManifest(manifest)
 	currentInfo.lock.Lock()
 	defer currentInfo.lock.Unlock()
 
-	err := WaitStopPlugin(currentInfo)
+	err = WaitStopPlugin(currentInfo)
 	if err != nil {
 		return err
 	}
@@ -251,21 +419,101 @@ func InstallPlugin(latestInfo VersionInfo, manifest plugin.Manifest) error {
 	if err != nil {
 		currentInfo.Status = PluginStatusDownloadFailed
 		currentInfo.ErrorMsg = err.Error()
+		pluginRegistry.Update(manifest.PluginId, func(entry *RegistryEntry) {
+			entry.LastError = err.Error()
+		})
 		return err
 	}
 	defer os.RemoveAll(path)
+	//解压前确认下载的安装包就是签名的安装包
+	err = verifyDigest(path, latestInfo.Sha256)
+	if err != nil {
+		err = verifyFailed(manifest, err)
+		if ok {
+			//插件目录还是旧版本,恢复旧版本的信息,由对比任务按期望状态重新启动
+			restoreManifest(currentInfo, lastInfo)
+		} else {
+			currentInfo.Status = PluginStatusVerifyFailed
+		}
+		currentInfo.ErrorMsg = err.Error()
+		triggerReconcile()
+		return err
+	}
+	//先记录安装中,master在解压过程中退出时下次启动会清除不完整的目录
+	pluginRegistry.Update(manifest.PluginId, func(entry *RegistryEntry) {
+		entry.InstallState = InstallStateInstalling
+	})
 	_ = os.RemoveAll(currentInfo.PluginDir)
 	err = util.Unzip(path, currentInfo.PluginDir, os.ModePerm)
+	if err == nil {
+		//安装包中的manifest才是实际运行时使用的,需要再次校验
+		_, err = getManifest(manifest.PluginId)
+	}
 	if err != nil {
+		currentInfo.ErrorMsg = err.Error()
 		currentInfo.Status = PluginStatusInstallFailed
 		//安装失败清除残余文件
 		_ = os.RemoveAll(currentInfo.PluginDir)
+		pluginRegistry.Update(manifest.PluginId, func(entry *RegistryEntry) {
+			entry.InstallState = InstallStateInstallFailed
+			entry.LastError = err.Error()
+		})
 		return err
 	}
 	currentInfo.Status = PluginStatusNotStarted
+	pluginRegistry.Update(manifest.PluginId, func(entry *RegistryEntry) {
+		now := time.Now().UnixMilli()
+		if entry.InstallTime == 0 {
+			entry.InstallTime = now
+		}
+		entry.UpdateTime = now
+		entry.InstallState = InstallStateInstalled
+		entry.Version = manifest.Version
+		entry.VersionName = manifest.VersionName
+		entry.LastError = ""
+	})
+	//更新前在运行的插件期望状态仍为运行,由对比任务重新启动
+	triggerReconcile()
 	return nil
 }
 
+// verifyFailed 记录安装包校验失败,已安装插件的信息和进程保持不变;
+// 插件未安装时添加校验失败的插件信息,用于在插件列表中显示错误原因
+func verifyFailed(manifest plugin.Manifest, err error) error {
+	err = fmt.Errorf("failed to verify package of plugin %s: %w", manifest.PluginId, err)
+	logger.Error(err)
+	pluginRegistry.Update(manifest.PluginId, func(entry *RegistryEntry) {
+		entry.LastError = err.Error()
+	})
+	if _, ok := pluginMap.Get(manifest.PluginId); !ok {
+		pluginInfo := initManifest(manifest)
+		pluginInfo.lock.Lock()
+		pluginInfo.Status = PluginStatusVerifyFailed
+		pluginInfo.ErrorMsg = err.Error()
+		pluginInfo.lock.Unlock()
+	}
+	return err
+}
+
+// restoreManifest 安装失败但旧版本的文件仍然完整时恢复安装前的插件信息;调用时需要持有插件的锁
+func restoreManifest(pluginInfo *PluginInfo, last PluginInfo) {
+	pluginInfo.Version = last.Version
+	pluginInfo.VersionName = last.VersionName
+	pluginInfo.ExecEnter = last.ExecEnter
+	pluginInfo.launch = last.launch
+	pluginInfo.Description = last.Description
+	pluginInfo.Endpoint = last.Endpoint
+	pluginInfo.AutoExit = last.AutoExit
+	pluginInfo.AutoStart = last.AutoStart
+	pluginInfo.RestartPolicy = last.RestartPolicy
+	pluginInfo.MaxRestarts = last.MaxRestarts
+	pluginInfo.Dependencies = last.Dependencies
+	pluginInfo.Status = last.Status
+	if pluginInfo.Status == PluginStatusRunning || pluginInfo.Status == PluginStatusStarting {
+		pluginInfo.Status = PluginStatusNotStarted
+	}
+}
+
 func run(pluginInfo *PluginInfo) error {
 	//var cmdStr string
 	//argsStr := fmt.Sprintf(
@@ -279,40 +527,70 @@ func run(pluginInfo *PluginInfo) error {
 	//println(argsStr)
 
 	pluginInfo.Status = PluginStatusStarting
-	currentEndpoint := pluginInfo.Endpoint
 
-	cmd, err := executil.ExecChildProcess(
-		filepath.Join(pluginInfo.PluginDir, pluginInfo.ExecEnter),
+	//标准参数在前,manifest中的参数追加在后面
+	args := []string{
 		fmt.Sprintf("-token=%s", plugin.Token),
 		fmt.Sprintf("-namespace=%s", plugin.Namespace),
 		fmt.Sprintf("-apiEndpoint=%s", plugin.ApiEndpoint),
 		fmt.Sprintf("-masterPort=%s", strconv.FormatInt(int64(plugin.MasterPort), 10)),
 		fmt.Sprintf("-debug=%s", strconv.FormatBool(plugin.Debug)),
+	}
+	args = append(args, pluginInfo.launch.Args...)
+	cmd, stdout, stderr, err := executil.ExecChildProcessWithOutput(
+		executil.ExecOptions{Dir: pluginInfo.launch.Dir(pluginInfo.PluginDir), Env: pluginInfo.launch.Environ()},
+		filepath.Join(pluginInfo.PluginDir, pluginInfo.ExecEnter),
+		args...,
 	)
 	if err != nil {
 		pluginInfo.Status = PluginStatusNotStarted
+		pluginRegistry.Update(pluginInfo.Id, func(entry *RegistryEntry) {
+			entry.LastError = err.Error()
+		})
 		return err
 	}
 
+	pluginInfo.cmd = cmd
+	pluginInfo.startTime = time.Now()
+	pluginInfo.stopping = false
+
+	log := getPluginLog(pluginInfo.Id)
+	output := new(sync.WaitGroup)
+	output.Add(2)
+	for stream, r := range map[string]*os.File{LogStreamStdout: stdout, LogStreamStderr: stderr} {
+		go func(stream string, r *os.File) {
+			defer output.Done()
+			defer r.Close()
+			log.capture(stream, r)
+		}(stream, r)
+	}
+
 	go func() {
 
 		defer func() {
-			//如果插件进程已经是另外一个进程了，则不用更新状态
-			if currentEndpoint == pluginInfo.Endpoint {
-				pluginInfo.Status = PluginStatusNotStarted
-			}
 			err := recover()
 			if err != nil {
 				logger.Error(err)
 			}
 		}()
-		err = cmd.Wait()
+		err := cmd.Wait()
 		if err != nil {
 			logger.Error(err)
 		}
+		//等待最后的输出写入日志,后台进程继承了管道时不会结束,最多等待1秒
+		outputDone := make(chan struct{})
+		go func() {
+			output.Wait()
+			close(outputDone)
+		}()
+		select {
+		case <-outputDone:
+		case <-time.After(time.Second):
+		}
+		onPluginExit(pluginInfo, cmd, err)
 	}()
 
-	return err
+	return nil
 }
 
 func WaitStopPlugin(pluginInfo *PluginInfo) error {
@@ -333,6 +611,9 @@ func WaitStopPlugin(pluginInfo *PluginInfo) error {
 }
 
 func _stopPlugin(pluginInfo *PluginInfo) error {
+	//主动停止的插件退出后不重启,等待中的重启也一并取消
+	pluginInfo.stopping = true
+	pluginInfo.NextRetryTime = 0
 	if pluginInfo.Endpoint != "" {
 		err := Post(pluginInfo.Id, "kill", nil, nil)
 		pluginInfo.Status = PluginStatusNotStarted
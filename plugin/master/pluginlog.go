@@ -0,0 +1,261 @@
+package master
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	cmap "github.com/orcaman/concurrent-map/v2"
+	"github.com/wonderivan/logger"
+	"github.com/xiwh/hexhub-agent-plugin/plugin"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 插件日志的输出流
+const (
+	LogStreamStdout = "stdout"
+	LogStreamStderr = "stderr"
+)
+
+// MaxLogFileSize 单个日志文件的大小上限,超过后轮转
+const MaxLogFileSize = 10 * 1024 * 1024
+
+// MaxLogFiles 每个插件保留的日志文件数量,包括正在写入的文件
+const MaxLogFiles = 5
+
+// logRingSize 内存中保留的最近日志行数,用于崩溃报告
+const logRingSize = 1000
+
+// maxLogLineSize 单行日志的长度上限,超过的部分被截断
+const maxLogLineSize = 16 * 1024
+
+// crashLogLines 崩溃时记录到PluginInfo的日志行数
+const crashLogLines = 20
+
+const logFileName = "plugin.log"
+
+const logTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+type LogLine struct {
+	Time   int64  `json:"time"`
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+	Level  string `json:"level,omitempty"`
+}
+
+// pluginLog 一个插件的日志,写入按大小轮转的文件和内存中的环形缓冲
+type pluginLog struct {
+	dir  string
+	lock sync.Mutex
+	file *os.File
+	size int64
+	ring []LogLine
+	next int
+	full bool
+	// followers 实时跟踪日志的订阅者
+	followers map[*logFollower]struct{}
+}
+
+var pluginLogs = cmap.New[*pluginLog]()
+
+func logDir(pluginId string) string {
+	return filepath.Join(plugin.HomeDir, "logs", pluginId)
+}
+
+func getPluginLog(pluginId string) *pluginLog {
+	return pluginLogs.Upsert(pluginId, nil, func(exist bool, valueInMap *pluginLog, newValue *pluginLog) *pluginLog {
+		if exist {
+			return valueInMap
+		}
+		return &pluginLog{dir: logDir(pluginId), ring: make([]LogLine, logRingSize)}
+	})
+}
+
+// capture 读取r中的输出直到EOF,按行写入日志
+func (t *pluginLog) capture(stream string, r io.Reader) {
+	reader := bufio.NewReaderSize(r, 4096)
+	var line []byte
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if len(line) < maxLogLineSize {
+			line = append(line, chunk...)
+		}
+		if err != nil {
+			if len(line) > 0 {
+				t.write(stream, line)
+			}
+			return
+		}
+		if !isPrefix {
+			t.write(stream, line)
+			line = line[:0]
+		}
+	}
+}
+
+func (t *pluginLog) write(stream string, text []byte) {
+	if len(text) > maxLogLineSize {
+		text = text[:maxLogLineSize]
+	}
+	now := time.Now()
+	line := LogLine{Time: now.UnixMilli(), Stream: stream, Text: string(bytes.TrimRight(text, "\r"))}
+	line.Level = detectLevel(line.Stream, line.Text)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for follower := range t.followers {
+		follower.push(line)
+	}
+	t.ring[t.next] = line
+	t.next = (t.next + 1) % len(t.ring)
+	if t.next == 0 {
+		t.full = true
+	}
+	err := t.writeFile(fmt.Sprintf("%s %s %s\n", now.Format(logTimeLayout), stream, line.Text))
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// writeFile 写入当前日志文件,超过大小上限时先轮转;调用时需要持有锁
+func (t *pluginLog) writeFile(s string) error {
+	if t.file != nil && t.size+int64(len(s)) > MaxLogFileSize {
+		_ = t.file.Close()
+		t.file = nil
+		rotateLogFiles(t.dir)
+	}
+	if t.file == nil {
+		err := os.MkdirAll(t.dir, 0755)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filepath.Join(t.dir, logFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		t.file = file
+		t.size = stat.Size()
+	}
+	n, err := t.file.WriteString(s)
+	t.size += int64(n)
+	return err
+}
+
+// rotateLogFiles plugin.log依次重命名为plugin.log.1、plugin.log.2...,最旧的文件被删除
+func rotateLogFiles(dir string) {
+	base := filepath.Join(dir, logFileName)
+	_ = os.Remove(fmt.Sprintf("%s.%d", base, MaxLogFiles-1))
+	for i := MaxLogFiles - 2; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", base, i), fmt.Sprintf("%s.%d", base, i+1))
+	}
+	_ = os.Rename(base, base+".1")
+}
+
+// recent 返回内存中最近的n行日志
+func (t *pluginLog) recent(n int) []LogLine {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.recentLocked(n)
+}
+
+// recentLocked 调用时需要持有锁
+func (t *pluginLog) recentLocked(n int) []LogLine {
+	size := t.next
+	if t.full {
+		size = len(t.ring)
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+	lines := make([]LogLine, 0, n)
+	for i := size - n; i < size; i++ {
+		lines = append(lines, t.ring[(t.next-size+i+len(t.ring))%len(t.ring)])
+	}
+	return lines
+}
+
+// closeFile 关闭当前日志文件,下次写入时重新打开
+func (t *pluginLog) closeFile() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file != nil {
+		_ = t.file.Close()
+		t.file = nil
+	}
+}
+
+// RecentLogs 返回插件在内存中最近的n行输出
+func RecentLogs(pluginId string, n int) []LogLine {
+	log, ok := pluginLogs.Get(pluginId)
+	if !ok {
+		return []LogLine{}
+	}
+	return log.recent(n)
+}
+
+// ReadLogs 从日志文件中读取since之后的最后tail行,tail小于等于0时不限制
+func ReadLogs(pluginId string, tail int, since time.Time) ([]LogLine, error) {
+	return readLogs(logDir(pluginId), tail, since)
+}
+
+func readLogs(dir string, tail int, since time.Time) ([]LogLine, error) {
+	lines := make([]LogLine, 0)
+	for i := MaxLogFiles - 1; i >= 0; i-- {
+		path := filepath.Join(dir, logFileName)
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", path, i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 4096), maxLogLineSize+128)
+		for scanner.Scan() {
+			line, ok := parseLogLine(scanner.Text())
+			if !ok || line.Time < since.UnixMilli() {
+				continue
+			}
+			lines = append(lines, line)
+			if tail > 0 && len(lines) >= 2*tail {
+				//只保留最后tail行,避免读取大文件时占用过多内存
+				lines = append(lines[:0], lines[len(lines)-tail:]...)
+			}
+		}
+		_ = file.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if tail > 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	return lines, nil
+}
+
+func parseLogLine(s string) (LogLine, bool) {
+	timeStr, rest, ok := strings.Cut(s, " ")
+	if !ok {
+		return LogLine{}, false
+	}
+	stream, text, ok := strings.Cut(rest, " ")
+	if !ok {
+		return LogLine{}, false
+	}
+	logTime, err := time.Parse(logTimeLayout, timeStr)
+	if err != nil {
+		return LogLine{}, false
+	}
+	return LogLine{Time: logTime.UnixMilli(), Stream: stream, Text: text, Level: detectLevel(stream, text)}, true
+}
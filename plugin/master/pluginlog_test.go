@@ -0,0 +1,63 @@
+package master
+
+import (
+	"github.com/xiwh/hexhub-agent-plugin/plugin"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPluginLog(t *testing.T) {
+	plugin.HomeDir = t.TempDir()
+	defer pluginLogs.Clear()
+	log := getPluginLog("demo")
+	log.capture(LogStreamStdout, strings.NewReader("first\r\nsecond\nno newline"))
+	//轮转后仍然可以按顺序读取所有文件
+	log.closeFile()
+	rotateLogFiles(log.dir)
+	log.capture(LogStreamStderr, strings.NewReader("error: "+strings.Repeat("x", maxLogLineSize)+"\n"))
+
+	lines, err := ReadLogs("demo", 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %+v", lines)
+	}
+	if lines[0].Text != "first" || lines[0].Stream != LogStreamStdout || lines[2].Text != "no newline" {
+		t.Errorf("unexpected lines: %+v", lines[:3])
+	}
+	if lines[3].Stream != LogStreamStderr || len(lines[3].Text) != maxLogLineSize {
+		t.Errorf("long line is not truncated: %s %d", lines[3].Stream, len(lines[3].Text))
+	}
+
+	lines, err = ReadLogs("demo", 2, time.Time{})
+	if err != nil || len(lines) != 2 || lines[0].Text != "no newline" {
+		t.Errorf("unexpected tail: %+v %v", lines, err)
+	}
+	lines, err = ReadLogs("demo", 0, time.Now().Add(time.Minute))
+	if err != nil || len(lines) != 0 {
+		t.Errorf("expected no lines after since, got %+v %v", lines, err)
+	}
+
+	recent := RecentLogs("demo", 2)
+	if len(recent) != 2 || recent[0].Text != "no newline" || recent[1].Stream != LogStreamStderr {
+		t.Errorf("unexpected recent lines: %+v", recent)
+	}
+}
+
+func TestPluginLogRing(t *testing.T) {
+	plugin.HomeDir = t.TempDir()
+	defer pluginLogs.Clear()
+	log := getPluginLog("ring")
+	var sb strings.Builder
+	for i := 0; i < logRingSize+10; i++ {
+		sb.WriteString("line\n")
+	}
+	sb.WriteString("last\n")
+	log.capture(LogStreamStdout, strings.NewReader(sb.String()))
+	recent := log.recent(0)
+	if len(recent) != logRingSize || recent[len(recent)-1].Text != "last" {
+		t.Errorf("unexpected ring size %d", len(recent))
+	}
+}
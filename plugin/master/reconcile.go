@@ -0,0 +1,97 @@
+package master
+
+import (
+	"github.com/wonderivan/logger"
+	"time"
+)
+
+// ReconcileInterval 对比期望状态和实际状态的周期
+const ReconcileInterval = 10 * time.Second
+
+// 实际状态
+const (
+	ActualStateRunning = "running"
+	ActualStateStopped = "stopped"
+	ActualStateBusy    = "busy"
+)
+
+var reconcileTrigger = make(chan struct{}, 1)
+
+// triggerReconcile 立即执行一次对比,例如插件更新完成后
+func triggerReconcile() {
+	select {
+	case reconcileTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// applyAutoStart master启动时将已启用的autoStart插件的期望状态设置为运行
+func applyAutoStart() {
+	pluginMap.IterCb(func(k string, info *PluginInfo) {
+		entry, ok := pluginRegistry.Get(info.Id)
+		if info.AutoStart && (!ok || entry.Enabled) {
+			pluginRegistry.Update(info.Id, func(entry *RegistryEntry) {
+				entry.DesiredState = DesiredStateRunning
+			})
+		}
+	})
+}
+
+func reconcileLoop() {
+	go func() {
+		triggerReconcile()
+		ticker := time.NewTicker(ReconcileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-reconcileTrigger:
+			}
+			reconcilePlugins()
+		}
+	}()
+}
+
+// reconcilePlugins 启动期望运行但没有运行的插件;期望停止但仍在运行的插件只报告偏差,
+// 它们可能是调试时手动启动后注册进来的
+func reconcilePlugins() {
+	var starts []string
+	pluginMap.IterCb(func(k string, info *PluginInfo) {
+		entry, ok := pluginRegistry.Get(info.Id)
+		if !ok || !entry.Enabled || entry.DesiredState != DesiredStateRunning {
+			return
+		}
+		//等待退避重启和崩溃循环的插件由supervisor处理
+		if info.Status == PluginStatusNotStarted && info.NextRetryTime == 0 {
+			starts = append(starts, info.Id)
+		}
+	})
+	for _, pluginId := range starts {
+		logger.Info("reconcile: starting plugin %s", pluginId)
+		err := StartPlugin(pluginId)
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+func actualState(info *PluginInfo) string {
+	switch info.Status {
+	case PluginStatusRunning:
+		return ActualStateRunning
+	case PluginStatusStarting, PluginStatusDownloading:
+		return ActualStateBusy
+	}
+	return ActualStateStopped
+}
+
+// isDrifted 期望状态与实际状态不一致,启动或下载中的插件不算偏差
+func isDrifted(desiredState string, actual string) bool {
+	switch actual {
+	case ActualStateRunning:
+		return desiredState != DesiredStateRunning
+	case ActualStateStopped:
+		return desiredState == DesiredStateRunning
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package master
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAutoStartAndDrift(t *testing.T) {
+	pluginRegistry = &registry{entries: make(map[string]*RegistryEntry)}
+	defer pluginMap.Clear()
+	for _, info := range []*PluginInfo{
+		{Id: "sync", AutoStart: true, Status: PluginStatusNotStarted},
+		{Id: "disabled", AutoStart: true, Status: PluginStatusNotStarted},
+		{Id: "manual", Status: PluginStatusRunning},
+		{Id: "updating", AutoStart: true, Status: PluginStatusDownloading},
+	} {
+		info.lock = new(sync.Mutex)
+		pluginMap.Set(info.Id, info)
+	}
+	pluginRegistry.Update("disabled", func(entry *RegistryEntry) {
+		entry.Enabled = false
+	})
+	applyAutoStart()
+
+	expected := map[string]struct {
+		desired string
+		actual  string
+		drift   bool
+	}{
+		"sync":     {DesiredStateRunning, ActualStateStopped, true},
+		"disabled": {DesiredStateStopped, ActualStateStopped, false},
+		"manual":   {DesiredStateStopped, ActualStateRunning, true},
+		"updating": {DesiredStateRunning, ActualStateBusy, false},
+	}
+	for id, e := range expected {
+		info, _ := pluginMap.Get(id)
+		snapshot := info.snapshot()
+		if snapshot.DesiredState != e.desired || snapshot.ActualState != e.actual || snapshot.Drift != e.drift {
+			t.Errorf("%s: unexpected state %s/%s drift=%v", id, snapshot.DesiredState, snapshot.ActualState, snapshot.Drift)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/wonderivan/logger"
+	"github.com/xiwh/hexhub-agent-plugin/plugin"
+	"github.com/xiwh/hexhub-agent-plugin/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RegistryFileName 插件注册表文件名,位于plugin.HomeDir下
+const RegistryFileName = "registry.json"
+
+// 期望状态
+const (
+	DesiredStateRunning = "running"
+	DesiredStateStopped = "stopped"
+)
+
+// 安装状态
+const (
+	InstallStateInstalling    = "installing"
+	InstallStateInstalled     = "installed"
+	InstallStateInstallFailed = "installFailed"
+)
+
+// RegistryEntry 持久化的插件状态,master重启后仍然保留
+type RegistryEntry struct {
+	PluginId     string `json:"pluginId"`
+	Enabled      bool   `json:"enabled"`
+	DesiredState string `json:"desiredState"`
+	InstallState string `json:"installState"`
+	Version      int    `json:"version"`
+	VersionName  string `json:"versionName"`
+	InstallTime  int64  `json:"installTime"`
+	UpdateTime   int64  `json:"updateTime"`
+	LastError    string `json:"lastError"`
+	LastExitCode int    `json:"lastExitCode"`
+}
+
+type registryFile struct {
+	Plugins []*RegistryEntry `json:"plugins"`
+}
+
+type registry struct {
+	path    string
+	lock    sync.Mutex
+	entries map[string]*RegistryEntry
+}
+
+var pluginRegistry = &registry{entries: make(map[string]*RegistryEntry)}
+
+// loadRegistry 读取注册表文件,文件不存在时返回空注册表
+func loadRegistry(path string) (*registry, error) {
+	t := &registry{path: path, entries: make(map[string]*RegistryEntry)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return t, err
+	}
+	var file registryFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		//保留损坏的文件用于排查和手动恢复,避免下次保存时被覆盖
+		backup := fmt.Sprintf("%s.corrupt-%d", path, time.Now().UnixMilli())
+		if renameErr := os.Rename(path, backup); renameErr != nil {
+			return t, fmt.Errorf("invalid registry file %s: %w, failed to back it up: %s", path, err, renameErr)
+		}
+		return t, fmt.Errorf("invalid registry file %s, moved to %s: %w", path, backup, err)
+	}
+	for _, entry := range file.Plugins {
+		if entry.PluginId != "" {
+			t.entries[entry.PluginId] = entry
+		}
+	}
+	return t, nil
+}
+
+// Get 返回插件状态的副本
+func (t *registry) Get(pluginId string) (RegistryEntry, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entry, ok := t.entries[pluginId]
+	if !ok {
+		return RegistryEntry{}, false
+	}
+	return *entry, true
+}
+
+func (t *registry) Entries() []RegistryEntry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entries := make([]RegistryEntry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].PluginId < entries[j].PluginId
+	})
+	return entries
+}
+
+// Update 修改插件状态并写入文件,插件不存在时以默认值创建
+func (t *registry) Update(pluginId string, f func(entry *RegistryEntry)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entry, ok := t.entries[pluginId]
+	if !ok {
+		entry = &RegistryEntry{
+			PluginId:     pluginId,
+			Enabled:      true,
+			DesiredState: DesiredStateStopped,
+		}
+		t.entries[pluginId] = entry
+	}
+	f(entry)
+	t.save()
+}
+
+func (t *registry) Remove(pluginId string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.entries, pluginId)
+	t.save()
+}
+
+// save 原子写入注册表文件,调用时需要持有锁;写入失败只记录日志,内存中的状态仍然有效
+func (t *registry) save() {
+	if t.path == "" {
+		return
+	}
+	file := registryFile{Plugins: make([]*RegistryEntry, 0, len(t.entries))}
+	for _, entry := range t.entries {
+		file.Plugins = append(file.Plugins, entry)
+	}
+	sort.Slice(file.Plugins, func(i, j int) bool {
+		return file.Plugins[i].PluginId < file.Plugins[j].PluginId
+	})
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	err = util.WriteFileAtomic(t.path, data, 0600)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// reconcile 启动时对比注册表和插件目录:只清除安装中断的目录,移除目录已经不存在的插件,为手动放入的插件创建记录;
+// 没有有效manifest的目录可能正在复制或由用户放入,保留在磁盘上并记录错误
+func (t *registry) reconcile(pluginsDir string, manifests map[string]plugin.Manifest, invalid map[string]error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	dirs, err := os.ReadDir(pluginsDir)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	found := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		pluginId := dir.Name()
+		pluginDir := filepath.Join(pluginsDir, pluginId)
+		entry, ok := t.entries[pluginId]
+		manifest, valid := manifests[pluginId]
+		if ok && entry.InstallState == InstallStateInstalling {
+			//上次安装过程中master退出,目录中的文件不完整
+			logger.Warn("plugin %s was not completely installed, removing %s", pluginId, pluginDir)
+			removeDir(pluginDir)
+			entry.InstallState = InstallStateInstallFailed
+			entry.LastError = "installation was interrupted"
+			continue
+		}
+		if !valid {
+			found[pluginId] = true
+			reason := "plugin directory has no valid manifest"
+			if err, ok := invalid[pluginId]; ok {
+				reason = err.Error()
+			}
+			logger.Warn("plugin directory %s is invalid: %s", pluginDir, reason)
+			if entry != nil {
+				entry.LastError = reason
+			}
+			continue
+		}
+		found[pluginId] = true
+		if !ok {
+			entry = &RegistryEntry{
+				PluginId:     pluginId,
+				Enabled:      true,
+				DesiredState: DesiredStateStopped,
+				InstallTime:  dirModTime(pluginDir),
+			}
+			t.entries[pluginId] = entry
+		}
+		entry.InstallState = InstallStateInstalled
+		entry.Version = manifest.Version
+		entry.VersionName = manifest.VersionName
+	}
+	for pluginId, entry := range t.entries {
+		if !found[pluginId] && entry.InstallState != InstallStateInstallFailed {
+			//目录被删除,视为已卸载
+			delete(t.entries, pluginId)
+		}
+	}
+	t.save()
+}
+
+func removeDir(dir string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func dirModTime(dir string) int64 {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return time.Now().UnixMilli()
+	}
+	return stat.ModTime().UnixMilli()
+}
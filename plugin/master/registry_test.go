@@ -0,0 +1,148 @@
+package master
+
+import (
+	"errors"
+	"github.com/xiwh/hexhub-agent-plugin/plugin"
+	"github.com/xiwh/hexhub-agent-plugin/util"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRegistryReconcile(t *testing.T) {
+	home := t.TempDir()
+	pluginsDir := filepath.Join(home, "plugins")
+	for _, id := range []string{"ok", "manual", "half", "broken", "bad"} {
+		err := os.MkdirAll(filepath.Join(pluginsDir, id), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(home, RegistryFileName)
+	r, err := loadRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Update("ok", func(entry *RegistryEntry) {
+		entry.InstallState = InstallStateInstalled
+		entry.DesiredState = DesiredStateRunning
+		entry.LastExitCode = 3
+	})
+	r.Update("half", func(entry *RegistryEntry) {
+		entry.InstallState = InstallStateInstalling
+	})
+	r.Update("bad", func(entry *RegistryEntry) {
+		entry.InstallState = InstallStateInstalled
+	})
+	r.Update("removed", func(entry *RegistryEntry) {
+		entry.InstallState = InstallStateInstalled
+	})
+
+	manifests := map[string]plugin.Manifest{
+		"ok":     {PluginId: "ok", Version: 2},
+		"manual": {PluginId: "manual", Version: 1},
+		"half":   {PluginId: "half", Version: 1},
+	}
+	invalid := map[string]error{"bad": errors.New("name is required")}
+	r.reconcile(pluginsDir, manifests, invalid)
+
+	//从文件重新读取,确认状态已经持久化
+	r, err = loadRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := r.Get("ok")
+	if !ok || entry.DesiredState != DesiredStateRunning || entry.LastExitCode != 3 || entry.Version != 2 {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	entry, ok = r.Get("manual")
+	if !ok || !entry.Enabled || entry.InstallState != InstallStateInstalled || entry.InstallTime == 0 {
+		t.Errorf("unexpected manual entry: %+v", entry)
+	}
+	entry, ok = r.Get("half")
+	if !ok || entry.InstallState != InstallStateInstallFailed || entry.LastError == "" {
+		t.Errorf("unexpected half installed entry: %+v", entry)
+	}
+	if _, ok = r.Get("removed"); ok {
+		t.Error("entry of removed directory is not deleted")
+	}
+	if _, ok = r.Get("broken"); ok {
+		t.Error("directory without manifest is registered")
+	}
+	if util.IsDir(filepath.Join(pluginsDir, "half")) {
+		t.Error("directory of interrupted installation is not removed")
+	}
+	//没有manifest的目录可能正在复制,不能删除
+	for _, id := range []string{"ok", "broken"} {
+		if !util.IsDir(filepath.Join(pluginsDir, id)) {
+			t.Errorf("directory %s is removed", id)
+		}
+	}
+	//manifest无效的插件保留目录,在插件列表中显示错误
+	entry, ok = r.Get("bad")
+	if !ok || entry.LastError != "name is required" || !util.IsDir(filepath.Join(pluginsDir, "bad")) {
+		t.Errorf("unexpected invalid plugin entry: %+v", entry)
+	}
+}
+
+func TestRegistryInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), RegistryFileName)
+	err := os.WriteFile(path, []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := loadRegistry(path)
+	if err == nil {
+		t.Fatal("expected error for invalid registry file")
+	}
+	//损坏的文件被重命名保留,不会被重建的注册表覆盖
+	backups, _ := filepath.Glob(path + ".corrupt-*")
+	if len(backups) != 1 {
+		t.Fatalf("expected one backup of the corrupt file, got %v", backups)
+	}
+	if data, _ := os.ReadFile(backups[0]); string(data) != "{" {
+		t.Errorf("unexpected backup content: %s", data)
+	}
+	r.Update("a", func(entry *RegistryEntry) {})
+	r, err = loadRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Get("a"); !ok {
+		t.Error("entry is not saved")
+	}
+	if data, _ := os.ReadFile(backups[0]); string(data) != "{" {
+		t.Error("backup is overwritten")
+	}
+}
+
+func TestRegistryUninstall(t *testing.T) {
+	pluginRegistry = &registry{entries: make(map[string]*RegistryEntry)}
+	plugin.HomeDir = t.TempDir()
+	defer pluginMap.Clear()
+	dir := filepath.Join(t.TempDir(), "demo")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pluginMap.Set("demo", &PluginInfo{Id: "demo", PluginDir: dir, lock: new(sync.Mutex)})
+	pluginRegistry.Update("demo", func(entry *RegistryEntry) {
+		entry.InstallState = InstallStateInstalled
+	})
+
+	err = UninstallPlugin("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//目录删除成功后才移除插件和注册表记录
+	if util.IsDir(dir) {
+		t.Error("plugin directory is not removed")
+	}
+	if _, ok := pluginMap.Get("demo"); ok {
+		t.Error("plugin is not removed")
+	}
+	if _, ok := pluginRegistry.Get("demo"); ok {
+		t.Error("registry entry is not removed")
+	}
+}
@@ -0,0 +1,125 @@
+package master
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TrustedKeysFileName master启动时读取的可信公钥文件,位于HomeDir,内容为{"keyId": "base64公钥"}
+const TrustedKeysFileName = "trusted_keys.json"
+
+// trustedKeys 可信的插件发布者公钥,keyId -> 公钥;没有配置公钥时拒绝安装任何插件
+var trustedKeys = make(map[string]ed25519.PublicKey)
+var trustedKeysLock = new(sync.RWMutex)
+
+// AddTrustedPublisherKey 添加可信的发布者公钥,key为base64编码的ed25519公钥
+func AddTrustedPublisherKey(keyId string, key string) error {
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("invalid publisher key %s: %w", keyId, err)
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid publisher key %s: expected %d bytes, got %d", keyId, ed25519.PublicKeySize, len(data))
+	}
+	trustedKeysLock.Lock()
+	defer trustedKeysLock.Unlock()
+	trustedKeys[keyId] = data
+	return nil
+}
+
+// loadTrustedKeys 读取可信公钥文件,文件不存在时不添加任何公钥
+func loadTrustedKeys(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]string)
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return fmt.Errorf("invalid trusted keys file %s: %w", path, err)
+	}
+	for keyId, key := range keys {
+		if err = AddTrustedPublisherKey(keyId, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveTrustedPublisherKey 移除可信的发布者公钥,已安装的插件不受影响
+func RemoveTrustedPublisherKey(keyId string) {
+	trustedKeysLock.Lock()
+	defer trustedKeysLock.Unlock()
+	delete(trustedKeys, keyId)
+}
+
+// PackageSigningMessage 发布者签名的内容,包含插件id和版本号,避免签名被用于其它插件或旧版本的安装包
+func PackageSigningMessage(pluginId string, version int, sha256Hex string) []byte {
+	return []byte(fmt.Sprintf("hexhub-plugin-package\n%s\n%d\n%s", pluginId, version, strings.ToLower(sha256Hex)))
+}
+
+// verifySignature 下载前校验版本信息的签名,KeyId为空时依次尝试所有可信公钥
+func verifySignature(info VersionInfo) error {
+	if info.Sha256 == "" || info.Signature == "" {
+		return fmt.Errorf("package of plugin %s version %d is not signed", info.PluginId, info.Version)
+	}
+	if digest, err := hex.DecodeString(info.Sha256); err != nil || len(digest) != sha256.Size {
+		return fmt.Errorf("package of plugin %s has an invalid sha256 digest %q", info.PluginId, info.Sha256)
+	}
+	signature, err := base64.StdEncoding.DecodeString(info.Signature)
+	if err != nil {
+		return fmt.Errorf("package of plugin %s has an invalid signature: %w", info.PluginId, err)
+	}
+	trustedKeysLock.RLock()
+	defer trustedKeysLock.RUnlock()
+	if len(trustedKeys) == 0 {
+		return errors.New("no trusted publisher keys are configured, refusing to install plugins")
+	}
+	message := PackageSigningMessage(info.PluginId, info.Version, info.Sha256)
+	if info.KeyId != "" {
+		key, ok := trustedKeys[info.KeyId]
+		if !ok {
+			return fmt.Errorf("package of plugin %s is signed by untrusted key %s", info.PluginId, info.KeyId)
+		}
+		if !ed25519.Verify(key, message, signature) {
+			return fmt.Errorf("signature of plugin %s version %d does not match key %s", info.PluginId, info.Version, info.KeyId)
+		}
+		return nil
+	}
+	for _, key := range trustedKeys {
+		if ed25519.Verify(key, message, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature of plugin %s version %d does not match any trusted key", info.PluginId, info.Version)
+}
+
+// verifyDigest 校验下载的安装包与签名的sha256是否一致
+func verifyDigest(path string, sha256Hex string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(actual, sha256Hex) {
+		return fmt.Errorf("sha256 of the downloaded package is %s, expected %s", actual, strings.ToLower(sha256Hex))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package master
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSignatureVerify(t *testing.T) {
+	defer func() {
+		trustedKeysLock.Lock()
+		trustedKeys = make(map[string]ed25519.PublicKey)
+		trustedKeysLock.Unlock()
+	}()
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := []byte("plugin package")
+	digest := sha256.Sum256(pkg)
+	info := VersionInfo{PluginId: "demo", Version: 3, Sha256: hex.EncodeToString(digest[:])}
+	info.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, PackageSigningMessage("demo", 3, info.Sha256)))
+
+	err = verifySignature(info)
+	if err == nil || !strings.Contains(err.Error(), "no trusted publisher keys") {
+		t.Errorf("expected error without trusted keys, got %v", err)
+	}
+	if err = AddTrustedPublisherKey("bad", "AAAA"); err == nil {
+		t.Error("expected error for short key")
+	}
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, TrustedKeysFileName)
+	err = os.WriteFile(keysFile, []byte(`{"main":"`+base64.StdEncoding.EncodeToString(publicKey)+`","other":"`+
+		base64.StdEncoding.EncodeToString(otherPublicKey)+`"}`), 0600)
+	if err == nil {
+		err = loadTrustedKeys(keysFile)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifySignature(info); err != nil {
+		t.Error(err)
+	}
+	info.KeyId = "main"
+	if err = verifySignature(info); err != nil {
+		t.Error(err)
+	}
+
+	cases := map[string]func(info *VersionInfo){
+		"does not match key other": func(info *VersionInfo) { info.KeyId = "other" },
+		"untrusted key unknown":    func(info *VersionInfo) { info.KeyId = "unknown" },
+		"does not match any":       func(info *VersionInfo) { info.KeyId = ""; info.Version = 2 },
+		"is not signed":            func(info *VersionInfo) { info.Signature = "" },
+		"invalid sha256":           func(info *VersionInfo) { info.Sha256 = "abc" },
+	}
+	for problem, modify := range cases {
+		tampered := info
+		modify(&tampered)
+		if err = verifySignature(tampered); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected error containing %q, got %v", problem, err)
+		}
+	}
+	//被其它可信公钥签名时需要指定正确的keyId
+	info.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(otherPrivateKey, PackageSigningMessage("demo", 3, info.Sha256)))
+	info.KeyId = "other"
+	if err = verifySignature(info); err != nil {
+		t.Error(err)
+	}
+
+	path := filepath.Join(dir, "demo.zip")
+	if err = os.WriteFile(path, pkg, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyDigest(path, strings.ToUpper(info.Sha256)); err != nil {
+		t.Error(err)
+	}
+	if err = os.WriteFile(path, []byte("tampered package"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyDigest(path, info.Sha256); err == nil || !strings.Contains(err.Error(), "expected "+info.Sha256) {
+		t.Errorf("expected digest mismatch, got %v", err)
+	}
+}
+
+func TestSignatureInstallVerifyFailed(t *testing.T) {
+	pluginRegistry = &registry{entries: make(map[string]*RegistryEntry)}
+	defer pluginMap.Clear()
+	manifest := VersionInfo{PluginId: "demo", Version: 1, DownloadUrl: "http://127.0.0.1:1/demo.zip"}
+	manifest.Manifest.PluginId = "demo"
+	manifest.Manifest.Name = "demo"
+	manifest.Manifest.Version = 1
+	manifest.Manifest.ExecEnter = "demo"
+
+	err := InstallPlugin(manifest, manifest.Manifest)
+	if err == nil || !strings.Contains(err.Error(), "is not signed") {
+		t.Fatalf("expected unsigned package to be rejected, got %v", err)
+	}
+	info, _ := pluginMap.Get("demo")
+	if info.Status != PluginStatusVerifyFailed || info.ErrorMsg != err.Error() {
+		t.Errorf("unexpected plugin state: %d %s", info.Status, info.ErrorMsg)
+	}
+	entry, _ := pluginRegistry.Get("demo")
+	if entry.LastError != err.Error() {
+		t.Errorf("error is not recorded in registry: %+v", entry)
+	}
+}
+
+func TestSignatureVerifyFailedKeepsInstalled(t *testing.T) {
+	pluginRegistry = &registry{entries: make(map[string]*RegistryEntry)}
+	defer pluginMap.Clear()
+	installed := &PluginInfo{Id: "demo", Name: "demo", Version: 1, ExecEnter: "demo-v1", Status: PluginStatusNotStarted, lock: new(sync.Mutex)}
+	pluginMap.Set("demo", installed)
+	manifest := VersionInfo{PluginId: "demo", Version: 2, DownloadUrl: "http://127.0.0.1:1/demo.zip"}
+	manifest.Manifest.PluginId = "demo"
+	manifest.Manifest.Name = "demo"
+	manifest.Manifest.Version = 2
+	manifest.Manifest.ExecEnter = "demo-v2"
+
+	//未签名的更新每次都返回错误,已安装插件的信息保持不变
+	for i := 0; i < 2; i++ {
+		err := InstallPlugin(manifest, manifest.Manifest)
+		if err == nil || !strings.Contains(err.Error(), "is not signed") {
+			t.Fatalf("expected unsigned update to be rejected, got %v", err)
+		}
+	}
+	if installed.Version != 1 || installed.ExecEnter != "demo-v1" || installed.Status != PluginStatusNotStarted || installed.ErrorMsg != "" {
+		t.Errorf("installed plugin is modified: %+v", installed)
+	}
+	if entry, _ := pluginRegistry.Get("demo"); !strings.Contains(entry.LastError, "is not signed") {
+		t.Errorf("error is not recorded in registry: %+v", entry)
+	}
+}
@@ -0,0 +1,132 @@
+package master
+
+import (
+	"fmt"
+	"github.com/wonderivan/logger"
+	"github.com/xiwh/hexhub-agent-plugin/util/executil"
+	"os/exec"
+	"time"
+)
+
+// 插件进程退出后的重启策略,对应manifest的restartPolicy,默认never
+const (
+	RestartPolicyNever     = "never"
+	RestartPolicyOnFailure = "on-failure"
+	RestartPolicyAlways    = "always"
+)
+
+// DefaultMaxRestarts manifest未设置maxRestarts时允许的连续重启次数
+const DefaultMaxRestarts = 5
+
+const restartBackoffBase = time.Second
+const restartBackoffMax = time.Minute
+
+// stableRunTime 进程运行超过该时间后退出时重新计算连续重启次数
+const stableRunTime = time.Minute
+
+// restartBackoff 第retry次重启前的等待时间,从1秒开始指数增长,最长1分钟
+func restartBackoff(retry int) time.Duration {
+	backoff := restartBackoffBase
+	for i := 0; i < retry && backoff < restartBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > restartBackoffMax {
+		backoff = restartBackoffMax
+	}
+	return backoff
+}
+
+func shouldRestart(policy string, exitCode int, signal string) bool {
+	switch policy {
+	case RestartPolicyAlways:
+		return true
+	case RestartPolicyOnFailure:
+		return exitCode != 0 || signal != ""
+	}
+	return false
+}
+
+// onPluginExit 插件进程退出后记录退出状态,按重启策略安排重启
+func onPluginExit(pluginInfo *PluginInfo, cmd *exec.Cmd, waitErr error) {
+	pluginInfo.lock.Lock()
+	defer pluginInfo.lock.Unlock()
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	signal := executil.ExitSignal(cmd.ProcessState)
+	pluginRegistry.Update(pluginInfo.Id, func(entry *RegistryEntry) {
+		entry.LastExitCode = exitCode
+		if waitErr != nil {
+			entry.LastError = waitErr.Error()
+		}
+	})
+	//插件已经由另外一个进程接管,不用更新状态
+	if pluginInfo.cmd != cmd {
+		return
+	}
+	pluginInfo.Status = PluginStatusNotStarted
+	pluginInfo.LastExitCode = exitCode
+	pluginInfo.LastSignal = signal
+	pluginInfo.LastExitTime = time.Now().UnixMilli()
+	if exitCode != 0 || signal != "" {
+		//保留崩溃前的输出用于排查
+		pluginInfo.CrashLog = RecentLogs(pluginInfo.Id, crashLogLines)
+	}
+	if pluginInfo.stopping {
+		return
+	}
+	if !shouldRestart(pluginInfo.RestartPolicy, exitCode, signal) {
+		//不重启的插件意外退出后不再期望运行,避免对比任务重新启动
+		pluginRegistry.Update(pluginInfo.Id, func(entry *RegistryEntry) {
+			entry.DesiredState = DesiredStateStopped
+		})
+		return
+	}
+	if time.Since(pluginInfo.startTime) >= stableRunTime {
+		pluginInfo.RetryCount = 0
+	}
+	scheduleRestart(pluginInfo, cmd)
+}
+
+// scheduleRestart 退避后重启插件,连续重启次数达到上限时进入崩溃循环状态,需要手动启动;调用时需要持有插件的锁
+func scheduleRestart(pluginInfo *PluginInfo, cmd *exec.Cmd) {
+	maxRestarts := pluginInfo.MaxRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = DefaultMaxRestarts
+	}
+	if pluginInfo.RetryCount >= maxRestarts {
+		pluginInfo.Status = PluginStatusCrashLoop
+		pluginInfo.NextRetryTime = 0
+		pluginInfo.ErrorMsg = fmt.Sprintf("plugin exited %d times in a row, last exit code %d", pluginInfo.RetryCount+1, pluginInfo.LastExitCode)
+		if pluginInfo.LastSignal != "" {
+			pluginInfo.ErrorMsg += ", signal " + pluginInfo.LastSignal
+		}
+		logger.Error("plugin %s is crash looping: %s", pluginInfo.Id, pluginInfo.ErrorMsg)
+		return
+	}
+	backoff := restartBackoff(pluginInfo.RetryCount)
+	pluginInfo.RetryCount++
+	pluginInfo.NextRetryTime = time.Now().Add(backoff).UnixMilli()
+	time.AfterFunc(backoff, func() {
+		retryPlugin(pluginInfo, cmd)
+	})
+}
+
+func retryPlugin(pluginInfo *PluginInfo, cmd *exec.Cmd) {
+	pluginInfo.lock.Lock()
+	defer pluginInfo.lock.Unlock()
+	//等待期间插件被手动启动或停止时放弃本次重启
+	if pluginInfo.cmd != cmd || pluginInfo.stopping || pluginInfo.Status != PluginStatusNotStarted {
+		return
+	}
+	pluginInfo.NextRetryTime = 0
+	pluginInfo.RestartCount++
+	logger.Info("restarting plugin %s, retry %d", pluginInfo.Id, pluginInfo.RetryCount)
+	err := run(pluginInfo)
+	if err != nil {
+		logger.Error(err)
+		pluginInfo.ErrorMsg = err.Error()
+		scheduleRestart(pluginInfo, cmd)
+	}
+}
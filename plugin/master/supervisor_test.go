@@ -0,0 +1,83 @@
+package master
+
+import (
+	"github.com/xiwh/hexhub-agent-plugin/plugin"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, e := range expected {
+		if backoff := restartBackoff(i); backoff != e {
+			t.Errorf("retry %d: expected %s, got %s", i, e, backoff)
+		}
+	}
+	if backoff := restartBackoff(100); backoff != restartBackoffMax {
+		t.Errorf("expected backoff to be capped, got %s", backoff)
+	}
+	if shouldRestart(RestartPolicyOnFailure, 0, "") || !shouldRestart(RestartPolicyOnFailure, 0, "killed") ||
+		!shouldRestart(RestartPolicyAlways, 0, "") || shouldRestart("", 1, "") {
+		t.Error("unexpected restart policy result")
+	}
+}
+
+func TestSupervisorCrashLoop(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell script")
+	}
+	pluginRegistry = &registry{entries: make(map[string]*RegistryEntry)}
+	plugin.HomeDir = t.TempDir()
+	defer pluginLogs.Clear()
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "crash.sh"), []byte("#!/bin/sh\necho config is invalid >&2\nexit 3\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &PluginInfo{
+		Id:            "crash",
+		PluginDir:     dir,
+		ExecEnter:     "crash.sh",
+		RestartPolicy: RestartPolicyOnFailure,
+		MaxRestarts:   2,
+		lock:          new(sync.Mutex),
+	}
+	pluginMap.Set(info.Id, info)
+	defer pluginMap.Clear()
+
+	info.lock.Lock()
+	err = run(info)
+	info.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info.lock.Lock()
+		status := info.Status
+		info.lock.Unlock()
+		if status == PluginStatusCrashLoop {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("plugin is not in crash loop, status %d", status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	if info.RestartCount != 2 || info.LastExitCode != 3 || info.NextRetryTime != 0 || info.ErrorMsg == "" {
+		t.Errorf("unexpected supervisor state: %+v", info)
+	}
+	if len(info.CrashLog) == 0 || info.CrashLog[len(info.CrashLog)-1].Text != "config is invalid" {
+		t.Errorf("unexpected crash log: %+v", info.CrashLog)
+	}
+	entry, _ := pluginRegistry.Get("crash")
+	if entry.LastExitCode != 3 {
+		t.Errorf("exit code is not persisted: %+v", entry)
+	}
+}
@@ -3,6 +3,7 @@ package plugin
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/wonderivan/logger"
 	"github.com/xiwh/hexhub-agent-plugin/util"
@@ -37,14 +38,28 @@ type APIResult struct {
 }
 
 type Manifest struct {
-	PluginId    string `json:"pluginId"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Version     int    `json:"version"`
-	VersionName string `json:"versionName"`
-	ExecEnter   string `json:"execEnter"`
-	AutoExit    bool   `json:"autoExit"`
-	Endpoint    string `json:"endpoint"`
+	SchemaVersion int          `json:"schemaVersion"`
+	PluginId      string       `json:"pluginId"`
+	Name          string       `json:"name"`
+	Description   string       `json:"description"`
+	Version       int          `json:"version"`
+	VersionName   string       `json:"versionName"`
+	ExecEnter     string       `json:"execEnter"`
+	AutoExit      bool         `json:"autoExit"`
+	AutoStart     bool         `json:"autoStart"`
+	RestartPolicy string       `json:"restartPolicy"`
+	MaxRestarts   int          `json:"maxRestarts"`
+	Endpoint      string       `json:"endpoint"`
+	Dependencies  []Dependency `json:"dependencies"`
+	// MinMasterVersion、OS和Arch为空时不限制
+	MinMasterVersion int      `json:"minMasterVersion"`
+	OS               []string `json:"os"`
+	Arch             []string `json:"arch"`
+	// Platforms 各平台的启动配置,Args、Env和Cwd对所有平台生效,Cwd相对于插件目录
+	Platforms map[string]Platform `json:"platforms"`
+	Args      []string            `json:"args"`
+	Env       map[string]string   `json:"env"`
+	Cwd       string              `json:"cwd"`
 }
 
 func Init(currentPluginId string, namespace string, apiEndpoint string, masterPort int, debug bool, token string) {
@@ -89,7 +104,9 @@ func GetManifest(pluginId string) (Manifest, error) {
 		return manifest, err
 	}
 	if manifest.PluginId != pluginId {
-		return manifest, fmt.Errorf("the plugin id is not match, the expected value is %s, but the actual value is %s", pluginId, manifest.PluginId)
+		return manifest, &ManifestError{PluginId: pluginId, Path: manifestFile, Problems: []string{
+			fmt.Sprintf("the plugin id is not match, the expected value is %s, but the actual value is %s", pluginId, manifest.PluginId),
+		}}
 	}
 	return manifest, nil
 }
@@ -100,22 +117,13 @@ func GetMyManifest() (Manifest, error) {
 	return manifest, err
 }
 
+// GetManifests 返回所有有效的manifest,无效的manifest只记录日志,需要获取错误时使用LoadManifests
 func GetManifests() (map[string]Manifest, error) {
-	plugins, err := os.ReadDir(PluginsDir)
+	manifests, invalid, err := LoadManifests()
 	if err != nil {
 		return nil, err
 	}
-	manifests := make(map[string]Manifest, len(plugins))
-	for _, pluginPath := range plugins {
-		if pluginPath.IsDir() {
-			manifest, err := GetManifest(pluginPath.Name())
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-			manifests[manifest.PluginId] = manifest
-		}
-	}
+	logInvalidManifests(invalid)
 	return manifests, nil
 }
 
@@ -269,9 +277,10 @@ func readManifestFile(manifestFile string) (manifest Manifest, err error) {
 	if err != nil {
 		return manifest, err
 	}
-	err = json.Unmarshal(manifestJson, &manifest)
-	if err != nil {
-		return manifest, err
+	manifest, err = DecodeManifest(manifestJson)
+	var manifestErr *ManifestError
+	if errors.As(err, &manifestErr) {
+		manifestErr.Path = manifestFile
 	}
-	return manifest, nil
+	return manifest, err
 }
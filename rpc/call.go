@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"fmt"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"google.golang.org/protobuf/proto"
+)
+
+// MethodError 错误回复使用的method,回复包数据为RemoteError
+const MethodError = "Error"
+
+const ErrorCodeInternal = 1
+const ErrorCodeBadRequest = 2
+const ErrorCodeMethodNotFound = 3
+const ErrorCodeLimitExceeded = 4
+
+type RemoteError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (t *RemoteError) Error() string {
+	return fmt.Sprintf("remote error(%d): %s", t.Code, t.Message)
+}
+
+// Unmarshal 根据v的类型选择protobuf或json解析packet数据
+func Unmarshal(p packet.Packet, v any) error {
+	protoMsg, ok := v.(proto.Message)
+	if ok {
+		return p.ProtoData(protoMsg)
+	}
+	return p.Data(v)
+}
+
+// ReplyError 向请求方回复错误,非RemoteError的错误按ErrorCodeInternal处理
+func ReplyError(conn Conn, p packet.Packet, err error) error {
+	remoteErr, ok := err.(*RemoteError)
+	if !ok {
+		remoteErr = &RemoteError{Code: ErrorCodeInternal, Message: err.Error()}
+	}
+	return conn.Reply(MethodError, remoteErr, p)
+}
+
+// Call 发送请求并阻塞等待回复,回复数据解析到resp中,timeout单位为秒,对方回复错误时返回*RemoteError
+func Call(conn Conn, method string, req any, resp any, timeout int64) error {
+	done := make(chan error, 1)
+	err := conn.SendWaitReply(method, req, timeout, func(timeout bool, p packet.Packet) {
+		if timeout {
+			if conn.IsClosed() {
+				done <- ConnClosedError
+				return
+			}
+			done <- TimeoutError
+			return
+		}
+		if p.Method() == MethodError {
+			remoteErr := new(RemoteError)
+			err := p.Data(remoteErr)
+			if err != nil {
+				done <- err
+				return
+			}
+			done <- remoteErr
+			return
+		}
+		if resp == nil {
+			done <- nil
+			return
+		}
+		done <- Unmarshal(p, resp)
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-done:
+		return err
+	case <-conn.Ctx().Done():
+		return ConnClosedError
+	}
+}
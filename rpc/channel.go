@@ -3,8 +3,10 @@ package rpc
 import (
 	"context"
 	"errors"
+	"github.com/wonderivan/logger"
 	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -17,6 +19,9 @@ const CloseNormal = 0
 const CloseFailure = 1
 const CloseInterrupt = 2
 
+// CloseTimeout channel超过空闲时间没有收发数据被自动关闭
+const CloseTimeout = 3
+
 var ChannelClosedError = errors.New("channel is closed")
 var TimeoutError = errors.New("timeout")
 
@@ -27,9 +32,29 @@ type Channel struct {
 	conn            Conn
 	channelIdSerial uint32
 	isOpen          bool
-	isClosed        bool
+	isClosed        atomic.Bool
 	ctx             context.Context
 	ctxCancel       func()
+	createdAt       time.Time
+	lastActivity    atomic.Int64
+	readDeadline    atomic.Int64
+	writeDeadline   atomic.Int64
+	idleTimeout     atomic.Int64
+	idleTimer       *time.Timer
+	idleLock        sync.Mutex
+	closeInfo       atomic.Pointer[CloseInfo]
+	group           atomic.Pointer[ChannelGroup]
+}
+
+// ChannelStats channel的诊断信息
+type ChannelStats struct {
+	Id           uint32        `json:"id"`
+	Method       string        `json:"method"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	LastActivity time.Time     `json:"lastActivity"`
+	Age          time.Duration `json:"age"`
+	IdleTimeout  time.Duration `json:"idleTimeout"`
+	Group        uint32        `json:"group,omitempty"`
 }
 
 type CloseInfo struct {
@@ -39,7 +64,7 @@ type CloseInfo struct {
 
 func newChannel(rpcConn Conn, id uint32, method string, ctx context.Context) (*Channel, error) {
 	ctx, ctxCancel := context.WithCancel(ctx)
-	return &Channel{
+	v := &Channel{
 		method:          method,
 		mId:             id,
 		ch:              make(chan any, 4),
@@ -48,7 +73,10 @@ func newChannel(rpcConn Conn, id uint32, method string, ctx context.Context) (*C
 		channelIdSerial: 0,
 		ctx:             ctx,
 		ctxCancel:       ctxCancel,
-	}, nil
+		createdAt:       time.Now(),
+	}
+	v.lastActivity.Store(v.createdAt.UnixNano())
+	return v, nil
 }
 
 func (t *Channel) idString() string {
@@ -63,8 +91,111 @@ func (t *Channel) GetContext() context.Context {
 	return t.ctx
 }
 
+func (t *Channel) Method() string {
+	return t.method
+}
+
+// Age channel创建至今的时间
+func (t *Channel) Age() time.Duration {
+	return time.Since(t.createdAt)
+}
+
+// LastActivity 最后一次收发数据的时间
+func (t *Channel) LastActivity() time.Time {
+	return time.Unix(0, t.lastActivity.Load())
+}
+
+func (t *Channel) Stats() ChannelStats {
+	stats := ChannelStats{
+		Id:           t.mId,
+		Method:       t.method,
+		CreatedAt:    t.createdAt,
+		LastActivity: t.LastActivity(),
+		Age:          t.Age(),
+		IdleTimeout:  time.Duration(t.idleTimeout.Load()),
+	}
+	group := t.group.Load()
+	if group != nil {
+		stats.Group = group.Id()
+	}
+	return stats
+}
+
+// Group 返回channel所属的分组,不属于任何分组时返回nil
+func (t *Channel) Group() *ChannelGroup {
+	return t.group.Load()
+}
+
+func (t *Channel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// SetReadDeadline 设置读取的截止时间,超过后Read返回TimeoutError,零值表示不限制;对正在阻塞的Read从下一次调用开始生效
+func (t *Channel) SetReadDeadline(deadline time.Time) {
+	t.readDeadline.Store(deadlineNano(deadline))
+}
+
+// SetWriteDeadline 设置发送的截止时间,超过后新的Send返回TimeoutError,零值表示不限制;
+// 与net.Conn不同,截止时间只在开始发送前检查,已经阻塞在底层连接上的Send不会被中断,因为底层连接由所有channel共享
+func (t *Channel) SetWriteDeadline(deadline time.Time) {
+	t.writeDeadline.Store(deadlineNano(deadline))
+}
+
+func (t *Channel) SetDeadline(deadline time.Time) {
+	t.SetReadDeadline(deadline)
+	t.SetWriteDeadline(deadline)
+}
+
+func deadlineNano(deadline time.Time) int64 {
+	if deadline.IsZero() {
+		return 0
+	}
+	return deadline.UnixNano()
+}
+
+// SetIdleTimeout 超过timeout没有收发数据时以CloseTimeout自动关闭channel,为0时取消
+func (t *Channel) SetIdleTimeout(timeout time.Duration) {
+	t.idleLock.Lock()
+	defer t.idleLock.Unlock()
+	t.idleTimeout.Store(int64(timeout))
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+		t.idleTimer = nil
+	}
+	if timeout <= 0 || t.IsClosed() {
+		return
+	}
+	t.idleTimer = time.AfterFunc(timeout, t.checkIdle)
+}
+
+// checkIdle 空闲计时器到期时检查最后活动时间,期间有活动则顺延,避免每次收发都重置计时器
+func (t *Channel) checkIdle() {
+	t.idleLock.Lock()
+	defer t.idleLock.Unlock()
+	timeout := time.Duration(t.idleTimeout.Load())
+	if t.idleTimer == nil || timeout <= 0 || t.IsClosed() {
+		return
+	}
+	remaining := timeout - time.Since(t.LastActivity())
+	if remaining > 0 {
+		t.idleTimer.Reset(remaining)
+		return
+	}
+	go func() {
+		err := t.Close(CloseTimeout, "channel idle timeout")
+		if err != nil {
+			logger.Error(err)
+		}
+	}()
+}
+
+// CloseInfo 返回channel关闭的关闭码和原因,未关闭时返回nil
+func (t *Channel) CloseInfo() *CloseInfo {
+	return t.closeInfo.Load()
+}
+
 func (t *Channel) IsClosed() bool {
-	return t.isClosed
+	return t.isClosed.Load()
 }
 
 func (t *Channel) onOpen() {
@@ -72,46 +203,80 @@ func (t *Channel) onOpen() {
 }
 
 func (t *Channel) Close(code int, reason string) error {
-	if t.IsClosed() {
+	//本地关闭和收到对方关闭可能同时发生,只发送一次关闭帧
+	if !t.isClosed.CompareAndSwap(false, true) {
 		return nil
 	}
+	t.closeInfo.Store(&CloseInfo{code, reason})
 	t.isOpen = false
-	t.isClosed = true
-	defer close(t.ch)
 	t.ctxCancel()
+	t.idleLock.Lock()
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+		t.idleTimer = nil
+	}
+	t.idleLock.Unlock()
 	return t.conn.SendSpecifyId(ChannelMethodClose, t.mId, CloseInfo{
 		code,
 		reason,
 	})
 }
 
+// ReadTimeout 读取数据,超过timeout返回TimeoutError
 func (t *Channel) ReadTimeout(timeout time.Duration) (packet.Packet, error) {
+	return t.read(context.Background(), time.Now().Add(timeout))
+}
+
+// Read 读取数据,设置了读取截止时间时超时返回TimeoutError
+func (t *Channel) Read() (packet.Packet, error) {
+	return t.ReadContext(context.Background())
+}
+
+// ReadContext 读取数据,ctx结束时返回ctx.Err()
+func (t *Channel) ReadContext(ctx context.Context) (packet.Packet, error) {
+	return t.read(ctx, time.Time{})
+}
+
+// read deadline与读取截止时间取较早的一个,两者都为零值时不限制
+func (t *Channel) read(ctx context.Context, deadline time.Time) (packet.Packet, error) {
+	//关闭前已经收到的数据仍然可以读取
+	select {
+	case v := <-t.ch:
+		return channelData(v)
+	default:
+	}
 	if t.IsClosed() {
 		return packet.Packet{}, ChannelClosedError
 	}
+	readDeadline := t.readDeadline.Load()
+	if readDeadline != 0 && (deadline.IsZero() || readDeadline < deadline.UnixNano()) {
+		deadline = time.Unix(0, readDeadline)
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
 	select {
-	case v, ok := <-t.ch:
-		if !ok {
-			return packet.Packet{}, ChannelClosedError
+	case v := <-t.ch:
+		return channelData(v)
+	case <-t.ctx.Done():
+		//对方的数据和关闭按顺序到达,关闭时可能还有数据没有读取
+		select {
+		case v := <-t.ch:
+			return channelData(v)
+		default:
 		}
-		switch v.(type) {
-		case error:
-			return packet.Packet{}, v.(error)
-		}
-		return v.(packet.Packet), nil
-	case <-time.After(timeout):
+		return packet.Packet{}, ChannelClosedError
+	case <-ctx.Done():
+		return packet.Packet{}, ctx.Err()
+	case <-timeout:
 		return packet.Packet{}, TimeoutError
 	}
 }
 
-func (t *Channel) Read() (packet.Packet, error) {
-	if t.IsClosed() {
-		return packet.Packet{}, ChannelClosedError
-	}
-	v, ok := <-t.ch
-	if !ok {
-		return packet.Packet{}, ChannelClosedError
-	}
+func channelData(v any) (packet.Packet, error) {
 	switch v.(type) {
 	case error:
 		return packet.Packet{}, v.(error)
@@ -120,17 +285,25 @@ func (t *Channel) Read() (packet.Packet, error) {
 }
 
 func (t *Channel) Receive(data any) error {
-	if t.isClosed {
+	//ch不会被关闭,channel关闭后通过ctx结束等待,避免向已关闭的ch发送导致panic
+	t.touch()
+	select {
+	case t.ch <- data:
+		return nil
+	case <-t.ctx.Done():
 		return ChannelClosedError
 	}
-	t.ch <- data
-	return nil
 }
 
 func (t *Channel) Send(v any) error {
 	if t.IsClosed() {
 		return ChannelClosedError
 	}
+	writeDeadline := t.writeDeadline.Load()
+	if writeDeadline != 0 && time.Now().UnixNano() >= writeDeadline {
+		return TimeoutError
+	}
+	t.touch()
 	atomic.AddUint32(&t.channelIdSerial, 1)
 	return t.conn.SendSpecifyId(ChannelMethodSend, t.mId, v)
 }
@@ -0,0 +1,99 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChannelReadContextAndDeadlines(t *testing.T) {
+	_, client := newTestConnPair(t, echoSetup)
+	channel, err := client.OpenChannel("Echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = channel.ReadContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	channel.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = channel.Read()
+	if !errors.Is(err, TimeoutError) {
+		t.Errorf("expected TimeoutError, got %v", err)
+	}
+	channel.SetReadDeadline(time.Time{})
+
+	channel.SetWriteDeadline(time.Now().Add(-time.Second))
+	err = channel.Send(echo{N: 1})
+	if !errors.Is(err, TimeoutError) {
+		t.Errorf("expected TimeoutError, got %v", err)
+	}
+	channel.SetWriteDeadline(time.Time{})
+
+	err = channel.Send(echo{N: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := channel.ReadTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v echo
+	err = p.Data(&v)
+	if err != nil || v.N != 2 {
+		t.Errorf("unexpected echo %+v: %v", v, err)
+	}
+}
+
+func TestChannelIdleTimeout(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	server, client := newTestConnPair(t, func(server Conn) {
+		echoSetup(server)
+		server.SetChannelIdleTimeout(idle)
+	})
+	channel, err := client.OpenChannel("Echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//持续收发数据时不会因为空闲超时关闭
+	for i := 0; i < 8; i++ {
+		err = channel.Send(echo{N: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = channel.ReadTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(idle / 4)
+	}
+	stats := server.Stats()
+	if len(stats.OpenChannels) != 1 || stats.OpenChannels[0].Method != "Echo" || stats.OpenChannels[0].IdleTimeout != idle {
+		t.Fatalf("unexpected open channels: %+v", stats.OpenChannels)
+	}
+	if stats.OpenChannels[0].Age < idle || time.Since(stats.OpenChannels[0].LastActivity) > idle {
+		t.Errorf("unexpected channel activity: %+v", stats.OpenChannels[0])
+	}
+
+	_, err = channel.ReadTimeout(5 * time.Second)
+	if !errors.Is(err, ChannelClosedError) {
+		t.Fatalf("expected ChannelClosedError, got %v", err)
+	}
+	closeInfo := channel.CloseInfo()
+	if closeInfo == nil || closeInfo.Code != CloseTimeout {
+		t.Errorf("expected CloseTimeout, got %+v", closeInfo)
+	}
+	deadline := time.Now().Add(time.Second)
+	for server.Stats().Channels != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := server.Stats().Channels; n != 0 {
+		t.Errorf("expected idle channel to be removed, got %d", n)
+	}
+}
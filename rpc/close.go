@@ -0,0 +1,136 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"sync"
+)
+
+// CloseInitiatorLocal 本端调用Close或本端检测到协议错误主动关闭
+const CloseInitiatorLocal = "local"
+
+// CloseInitiatorRemote 对方发送了关闭帧
+const CloseInitiatorRemote = "remote"
+
+// CloseInitiatorTransport 底层连接异常断开或保活失败
+const CloseInitiatorTransport = "transport"
+
+// CloseReason 连接关闭的原因,Code使用websocket关闭码,Err为导致关闭的原始错误,可通过errors.Is/As判断
+type CloseReason struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	Initiator string `json:"initiator"`
+	Err       error  `json:"-"`
+}
+
+func (t *CloseReason) Error() string {
+	return fmt.Sprintf("rpc conn closed by %s (%d): %s", t.Initiator, t.Code, t.Message)
+}
+
+func (t *CloseReason) Unwrap() error {
+	return t.Err
+}
+
+// localCloseReason 本端关闭时根据错误类型选择关闭码,已经是CloseReason的直接使用
+func localCloseReason(err error) *CloseReason {
+	var reason *CloseReason
+	if errors.As(err, &reason) {
+		if reason.Initiator == "" {
+			v := *reason
+			v.Initiator = CloseInitiatorLocal
+			return &v
+		}
+		return reason
+	}
+	if err == nil {
+		return &CloseReason{Code: websocket.CloseNormalClosure, Initiator: CloseInitiatorLocal}
+	}
+	code := websocket.CloseNormalClosure
+	switch {
+	case errors.Is(err, packet.DataTooLargeError), errors.Is(err, packet.MethodTooLongError),
+		errors.Is(err, packet.DecompressedTooLargeError):
+		code = websocket.CloseMessageTooBig
+	case errors.Is(err, packet.TruncatedError), errors.Is(err, packet.InvalidMethodError),
+		errors.Is(err, packet.UnknownFlagsError):
+		code = websocket.CloseProtocolError
+	}
+	return &CloseReason{Code: code, Message: err.Error(), Initiator: CloseInitiatorLocal, Err: err}
+}
+
+// readCloseReason 读取失败时区分对方关闭、本端解码失败以及底层连接断开
+func readCloseReason(err error) *CloseReason {
+	var reason *CloseReason
+	if errors.As(err, &reason) {
+		return reason
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		initiator := CloseInitiatorRemote
+		if closeErr.Code == websocket.CloseAbnormalClosure {
+			initiator = CloseInitiatorTransport
+		}
+		return &CloseReason{Code: closeErr.Code, Message: closeErr.Text, Initiator: initiator, Err: err}
+	}
+	var decodeErr *packet.DecodeError
+	if errors.As(err, &decodeErr) {
+		return localCloseReason(err)
+	}
+	return &CloseReason{Code: websocket.CloseAbnormalClosure, Message: err.Error(), Initiator: CloseInitiatorTransport, Err: err}
+}
+
+// closeListeners 关闭回调列表,按注册顺序调用
+type closeListeners struct {
+	lock      sync.Mutex
+	serial    uint64
+	listeners []closeListener
+	reason    *CloseReason
+}
+
+type closeListener struct {
+	id uint64
+	f  func(conn Conn, err error)
+}
+
+// add 注册回调,连接已关闭时立即调用,返回的函数用于取消注册
+func (t *closeListeners) add(conn Conn, f func(conn Conn, err error)) func() {
+	t.lock.Lock()
+	if t.reason != nil {
+		reason := t.reason
+		t.lock.Unlock()
+		f(conn, reason)
+		return func() {}
+	}
+	t.serial++
+	id := t.serial
+	t.listeners = append(t.listeners, closeListener{id: id, f: f})
+	t.lock.Unlock()
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		for i, v := range t.listeners {
+			if v.id == id {
+				t.listeners = append(t.listeners[:i:i], t.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (t *closeListeners) fire(conn Conn, reason *CloseReason) {
+	t.lock.Lock()
+	t.reason = reason
+	listeners := t.listeners
+	t.listeners = nil
+	t.lock.Unlock()
+	for _, v := range listeners {
+		v.f(conn, reason)
+	}
+}
+
+func (t *closeListeners) closeReason() *CloseReason {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.reason
+}
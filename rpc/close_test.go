@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitReason(t *testing.T, reasons chan *CloseReason, name string) *CloseReason {
+	select {
+	case reason := <-reasons:
+		return reason
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s close listener is not called", name)
+		return nil
+	}
+}
+
+func closeReasonListener(reasons chan *CloseReason) func(conn Conn, err error) {
+	return func(conn Conn, err error) {
+		var reason *CloseReason
+		if errors.As(err, &reason) {
+			reasons <- reason
+		}
+	}
+}
+
+func TestOnCloseListeners(t *testing.T) {
+	serverReasons := make(chan *CloseReason, 2)
+	removedCalled := make(chan struct{}, 1)
+	server, client := newTestConnPair(t, func(server Conn) {
+		server.OnClose(closeReasonListener(serverReasons))
+		server.OnClose(closeReasonListener(serverReasons))
+		unregister := server.OnClose(func(conn Conn, err error) {
+			removedCalled <- struct{}{}
+		})
+		unregister()
+	})
+	clientReasons := make(chan *CloseReason, 1)
+	client.OnClose(closeReasonListener(clientReasons))
+
+	_ = client.Close(&CloseReason{Code: 4001, Message: "maintenance"})
+
+	reason := waitReason(t, clientReasons, "client")
+	if reason.Initiator != CloseInitiatorLocal || reason.Code != 4001 {
+		t.Errorf("unexpected client reason: %+v", reason)
+	}
+	for i := 0; i < 2; i++ {
+		reason = waitReason(t, serverReasons, "server")
+		if reason.Initiator != CloseInitiatorRemote || reason.Code != 4001 || reason.Message != "maintenance" {
+			t.Errorf("unexpected server reason: %+v", reason)
+		}
+	}
+	select {
+	case <-removedCalled:
+		t.Error("unregistered listener is called")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if server.CloseReason() == nil || server.CloseReason().Initiator != CloseInitiatorRemote {
+		t.Errorf("unexpected server CloseReason: %+v", server.CloseReason())
+	}
+
+	//关闭后注册的回调立即调用
+	late := make(chan *CloseReason, 1)
+	server.OnClose(closeReasonListener(late))
+	select {
+	case <-late:
+	default:
+		t.Error("listener registered after close is not called")
+	}
+}
+
+func TestCloseCodeFromDecodeError(t *testing.T) {
+	serverReasons := make(chan *CloseReason, 1)
+	_, client := newTestConnPair(t, func(server Conn) {
+		server.SetPacketLimits(packet.Limits{MaxDataLen: 16})
+		server.OnClose(closeReasonListener(serverReasons))
+	})
+	clientReasons := make(chan *CloseReason, 1)
+	client.OnClose(closeReasonListener(clientReasons))
+
+	_, _ = client.Send("Data", strings.Repeat("x", 64))
+
+	reason := waitReason(t, serverReasons, "server")
+	if reason.Initiator != CloseInitiatorLocal || reason.Code != websocket.CloseMessageTooBig || !errors.Is(reason, packet.DataTooLargeError) {
+		t.Errorf("unexpected server reason: %+v", reason)
+	}
+	reason = waitReason(t, clientReasons, "client")
+	if reason.Initiator != CloseInitiatorRemote || reason.Code != websocket.CloseMessageTooBig {
+		t.Errorf("unexpected client reason: %+v", reason)
+	}
+}
+
+func TestInvalidMethodKeepsConn(t *testing.T) {
+	server, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFunc("Echo", func(conn Conn, p packet.Packet) {
+			_ = conn.Reply(p.Method(), p.Bytes(), p)
+		})
+	})
+
+	err := Call(client, "Echo Me", "hello", nil, 5)
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != ErrorCodeBadRequest || !strings.Contains(remoteErr.Message, "invalid characters") {
+		t.Errorf("expected bad request error, got %v", err)
+	}
+	_, _ = client.Send("Echo Me", "hello")
+	if err = Call(client, "Echo", "hello", nil, 5); err != nil {
+		t.Error(err)
+	}
+	if server.IsClosed() || client.IsClosed() {
+		t.Error("connection is closed by invalid method")
+	}
+}
+
+func TestCloseReasonTransport(t *testing.T) {
+	pair := newFaultConnPair(t, nil)
+	serverReasons := make(chan *CloseReason, 1)
+	pair.server.OnClose(closeReasonListener(serverReasons))
+
+	_ = pair.clientTransport.Disconnect()
+
+	reason := waitReason(t, serverReasons, "server")
+	if reason.Initiator != CloseInitiatorTransport || reason.Code != websocket.CloseAbnormalClosure {
+		t.Errorf("unexpected server reason: %+v", reason)
+	}
+}
@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"fmt"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+)
+
+// MethodCompression 内置的压缩协商method,数据为本端可以解压的算法列表
+const MethodCompression = "RpcCompression"
+
+// DefaultCompressionThreshold 默认只压缩超过4KB的数据,小的控制包压缩收益低且增加延迟
+const DefaultCompressionThreshold = 4096
+
+type compressionInfo struct {
+	Codecs []string `json:"codecs"`
+}
+
+type compression struct {
+	compressor packet.Compressor
+	threshold  int
+}
+
+// SetCompression 开启按包压缩并向对方声明本端支持的算法,只有双方都开启且对方支持name算法时才会压缩发送,
+// 数据长度达到threshold才压缩,threshold<=0时使用DefaultCompressionThreshold;协商成功后关闭websocket的写压缩
+func (t *conn) SetCompression(name string, threshold int) error {
+	compressor, ok := packet.GetCompressor(name)
+	if !ok {
+		return fmt.Errorf("unsupported compressor %s", name)
+	}
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	t.compression.Store(&compression{compressor, threshold})
+	_, err := t.Send(MethodCompression, compressionInfo{Codecs: packet.CompressorNames()})
+	t.negotiated()
+	return err
+}
+
+func (t *conn) onPeerCompression(conn Conn, p packet.Packet) {
+	var info compressionInfo
+	err := p.Data(&info)
+	if err != nil {
+		return
+	}
+	codecs := make(map[string]bool, len(info.Codecs))
+	for _, codec := range info.Codecs {
+		codecs[codec] = true
+	}
+	t.peerCodecs.Store(&codecs)
+	t.negotiated()
+}
+
+// negotiated 双方都开启压缩且对方支持本端的算法时关闭websocket的permessage-deflate,
+// 避免大包被压缩两次以及小的控制包也要经过deflate
+func (t *conn) negotiated() {
+	c := t.compression.Load()
+	peerCodecs := t.peerCodecs.Load()
+	if c == nil || peerCodecs == nil || !(*peerCodecs)[c.compressor.Name()] {
+		return
+	}
+	transport, ok := t.transport.(writeCompressor)
+	if ok {
+		transport.setWriteCompression(false)
+	}
+}
+
+// encode 按协商结果编码packet,对方不支持或未开启压缩时按原数据编码
+func (t *conn) encode(kind int, method string, id uint32, v any) ([]byte, error) {
+	p, err := packet.CreatePacket(method, id, v)
+	if err != nil {
+		return nil, err
+	}
+	p = p.WithKind(kind)
+	c := t.compression.Load()
+	peerCodecs := t.peerCodecs.Load()
+	if c == nil || peerCodecs == nil || !(*peerCodecs)[c.compressor.Name()] {
+		return packet.EncodeCompressed(p, true, nil, 0)
+	}
+	return packet.EncodeCompressed(p, true, c.compressor, c.threshold)
+}
@@ -0,0 +1,164 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	received := make(chan packet.Packet, 2)
+	server, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFunc("Data", func(conn Conn, p packet.Packet) {
+			received <- p
+		})
+	})
+	if err := server.SetCompression(packet.GzipName, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetCompression(packet.GzipName, 1024); err != nil {
+		t.Fatal(err)
+	}
+	waitNegotiated(t, server, client)
+
+	large := strings.Repeat("hexhub ", 1024)
+	for _, data := range []string{"small", large} {
+		if _, err := client.Send("Data", data); err != nil {
+			t.Fatal(err)
+		}
+		p := <-received
+		if p.String() != data {
+			t.Fatalf("unexpected data of %d bytes", p.Len())
+		}
+		if p.Compressed() != (data == large) {
+			t.Errorf("unexpected compressed flag %v for %d bytes", p.Compressed(), len(data))
+		}
+	}
+}
+
+// compressionTransport 记录传输层压缩的开关
+type compressionTransport struct {
+	Transport
+	enabled atomic.Bool
+}
+
+func (t *compressionTransport) setWriteCompression(enable bool) {
+	t.enabled.Store(enable)
+}
+
+func TestCompressionDisablesTransportCompression(t *testing.T) {
+	transport := new(compressionTransport)
+	transport.enabled.Store(true)
+	c := &conn{transport: transport}
+	c.compression.Store(&compression{packet.Gzip, DefaultCompressionThreshold})
+	c.negotiated()
+	if !transport.enabled.Load() {
+		t.Fatal("transport compression is disabled before negotiation")
+	}
+	c.peerCodecs.Store(&map[string]bool{"zstd": true})
+	c.negotiated()
+	if !transport.enabled.Load() {
+		t.Fatal("transport compression is disabled when peer does not support gzip")
+	}
+	c.peerCodecs.Store(&map[string]bool{packet.GzipName: true})
+	c.negotiated()
+	if transport.enabled.Load() {
+		t.Error("transport compression is still enabled after negotiation")
+	}
+}
+
+// waitNegotiated 等待双方收到对方的压缩协商包
+func waitNegotiated(tb testing.TB, conns ...Conn) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, c := range conns {
+		for c.(*conn).peerCodecs.Load() == nil {
+			if time.Now().After(deadline) {
+				tb.Fatal("compression negotiation timeout")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func jsonWorkload() []byte {
+	type row struct {
+		Id       int    `json:"id"`
+		Name     string `json:"name"`
+		Path     string `json:"path"`
+		Size     int64  `json:"size"`
+		Mode     string `json:"mode"`
+		Modified string `json:"modified"`
+	}
+	rows := make([]row, 200)
+	for i := range rows {
+		rows[i] = row{i, fmt.Sprintf("file-%d.log", i), fmt.Sprintf("/var/log/hexhub/file-%d.log", i), int64(i * 1024), "-rw-r--r--", "2023-08-01T12:00:00Z"}
+	}
+	b, _ := json.Marshal(rows)
+	return b
+}
+
+func terminalWorkload() []byte {
+	return []byte("\x1b[01;32mroot@agent\x1b[00m:\x1b[01;34m~\x1b[00m$ ls -la\r\n")
+}
+
+// benchmarkSend 对比不压缩、websocket permessage-deflate和按包gzip压缩三种方式的发送吞吐
+func benchmarkSend(b *testing.B, data []byte, deflate bool, packetCompression bool) {
+	received := make(chan struct{}, 1024)
+	dialer := &websocket.Dialer{EnableCompression: deflate}
+	server, client := newConnPair(b, dialer, func(server Conn) {
+		server.HandleFunc("Data", func(conn Conn, p packet.Packet) {
+			received <- struct{}{}
+		})
+	})
+	if packetCompression {
+		_ = server.SetCompression(packet.GzipName, DefaultCompressionThreshold)
+		_ = client.SetCompression(packet.GzipName, DefaultCompressionThreshold)
+		waitNegotiated(b, server, client)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Send("Data", data); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		<-received
+	}
+}
+
+func BenchmarkSendJson(b *testing.B) {
+	data := jsonWorkload()
+	b.Run("none", func(b *testing.B) { benchmarkSend(b, data, false, false) })
+	b.Run("permessage-deflate", func(b *testing.B) { benchmarkSend(b, data, true, false) })
+	b.Run("packet-gzip", func(b *testing.B) { benchmarkSend(b, data, false, true) })
+}
+
+func BenchmarkSendTerminal(b *testing.B) {
+	data := terminalWorkload()
+	b.Run("none", func(b *testing.B) { benchmarkSend(b, data, false, false) })
+	b.Run("permessage-deflate", func(b *testing.B) { benchmarkSend(b, data, true, false) })
+	b.Run("packet-gzip", func(b *testing.B) { benchmarkSend(b, data, false, true) })
+}
+
+// BenchmarkEncodeJson 只比较编码时的压缩开销和压缩率
+func BenchmarkEncodeJson(b *testing.B) {
+	p, _ := packet.CreatePacket("Data", 1, jsonWorkload())
+	var size int
+	for i := 0; i < b.N; i++ {
+		encoded, err := packet.EncodeCompressed(p, true, packet.Gzip, DefaultCompressionThreshold)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(encoded)
+	}
+	b.ReportMetric(float64(size)/float64(p.Len()), "ratio")
+}
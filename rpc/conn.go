@@ -9,36 +9,47 @@ import (
 	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
 	"math"
 	"strconv"
-	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 )
 
 var ConnClosedError = errors.New("conn is closed")
 
+// NewConn 创建发起方的连接,使用IdSpaceUpper分配id
 func NewConn(wsConn *websocket.Conn, ctx context.Context) Conn {
+	return NewTransportConn(NewWebsocketTransport(wsConn), ctx, IdSpaceUpper)
+}
+
+// NewTransportConn 基于任意Transport创建连接,发起方使用IdSpaceUpper,接受方使用IdSpaceLower
+func NewTransportConn(transport Transport, ctx context.Context, idSpace int) Conn {
 	ctx, cancel := context.WithCancel(ctx)
 	v := &conn{
-		wsConn:            wsConn,
-		writeLock:         new(sync.Mutex),
-		isClosed:          false,
+		transport:         transport,
 		session:           cmap.New[any](),
 		handleMap:         cmap.New[handleFunc](),
 		replyFuncMap:      cmap.New[reply](),
 		channelMap:        cmap.New[*Channel](),
+		channelHandleMap:  cmap.New[channelHandleFunc](),
+		schemaMap:         cmap.New[Schema](),
+		limiterMap:        cmap.New[*limiter](),
+		counterMap:        cmap.New[*methodCounter](),
+		groupMap:          cmap.New[*ChannelGroup](),
 		channelAcceptChan: make(chan packet.Packet, 128),
-		closeFunc:         nil,
 		ctx:               ctx,
 		ctxCancel:         cancel,
-		id:                0xffffffff,
+		ids:               newIdAllocator(idSpace),
 	}
+	v.SetPacketLimits(packet.DefaultLimits)
+	v.HandleFuncAsync(MethodReflect, reflectHandle)
+	v.HandleFunc(MethodCompression, v.onPeerCompression)
+	v.HandleFunc(MethodHello, v.onHello)
 	return v
 }
 
 type Conn interface {
 	StartHandler() error
 	OpenChannel(method string, v any) (*Channel, error)
+	NewChannelGroup(name string) *ChannelGroup
 	AcceptChannel() (packet.Packet, *Channel, error)
 	Read() (packet.Packet, error)
 	Send(method string, v any) (uint32, error)
@@ -50,7 +61,18 @@ type Conn interface {
 	Close(err error) error
 	HandleFunc(method string, handle func(conn Conn, packet packet.Packet))
 	HandleFuncAsync(method string, handle func(conn Conn, packet packet.Packet))
-	OnClose(f func(conn Conn, err error))
+	HandleFuncKeyed(method string, key func(packet packet.Packet) string, handle func(conn Conn, packet packet.Packet))
+	HandleChannel(method string, handle func(conn Conn, packet packet.Packet, channel *Channel))
+	Describe(method string, schema Schema)
+	Methods() []MethodInfo
+	SetLimit(limit Limit)
+	SetMethodLimit(method string, limit Limit)
+	Stats() Stats
+	SetCompression(name string, threshold int) error
+	SetPacketLimits(limits packet.Limits)
+	SetChannelIdleTimeout(timeout time.Duration)
+	OnClose(f func(conn Conn, err error)) func()
+	CloseReason() *CloseReason
 	Ctx() context.Context
 }
 
@@ -62,59 +84,90 @@ type reply struct {
 type handleFunc struct {
 	isAsync bool
 	handle  func(conn Conn, packet packet.Packet)
+	key     func(packet packet.Packet) string
+	queues  *keyedQueues
+}
+
+type channelHandleFunc struct {
+	handle func(conn Conn, packet packet.Packet, channel *Channel)
 }
 
 type conn struct {
-	wsConn            *websocket.Conn
-	writeLock         *sync.Mutex
-	isClosed          bool
+	transport         Transport
+	isClosed          atomic.Bool
+	closing           atomic.Bool
 	session           cmap.ConcurrentMap[any]
 	handleMap         cmap.ConcurrentMap[handleFunc]
 	channelMap        cmap.ConcurrentMap[*Channel]
+	channelHandleMap  cmap.ConcurrentMap[channelHandleFunc]
+	schemaMap         cmap.ConcurrentMap[Schema]
+	connLimiter       atomic.Pointer[limiter]
+	limiterMap        cmap.ConcurrentMap[*limiter]
+	counterMap        cmap.ConcurrentMap[*methodCounter]
+	groupMap          cmap.ConcurrentMap[*ChannelGroup]
+	compression       atomic.Pointer[compression]
+	peerCodecs        atomic.Pointer[map[string]bool]
+	packetLimits      atomic.Pointer[packet.Limits]
 	replyFuncMap      cmap.ConcurrentMap[reply]
-	closeFunc         func(conn Conn, reason error)
+	closeListeners    closeListeners
 	channelAcceptChan chan packet.Packet
 	ctx               context.Context
 	ctxCancel         func()
-	id                uint32
+	ids               *idAllocator
+	idleTimeout       atomic.Int64
+	peerHello         atomic.Bool
 	err               error
 }
 
 func (t *conn) StartHandler() error {
+	err := t.sendHello()
+	if err != nil {
+		_ = t.Close(err)
+		return err
+	}
 	go func() {
 		for true {
-			if t.isClosed {
+			if t.isClosed.Load() {
 				return
 			}
 			time.Sleep(time.Second)
-			t.writeLock.Lock()
-			err := t.wsConn.WriteMessage(websocket.PingMessage, []byte("ping"))
-			t.writeLock.Unlock()
+			err := t.transport.Ping()
 			if err != nil {
-				t.triggerClose(err)
+				_ = t.Close(&CloseReason{Code: websocket.CloseAbnormalClosure, Message: err.Error(), Initiator: CloseInitiatorTransport, Err: err})
 				return
 			}
 			now := time.Now().Unix()
+			//IterCb持有分片读锁,不能在回调中删除,先收集超时的id再逐个取出
+			var expired []string
 			t.replyFuncMap.IterCb(func(key string, v reply) {
 				if now >= v.time {
-					t.replyFuncMap.Remove(key)
-					v.f(true, packet.Packet{})
+					expired = append(expired, key)
 				}
 			})
+			for _, key := range expired {
+				v, ok := t.replyFuncMap.Pop(key)
+				if ok {
+					v.f(true, packet.Packet{})
+				}
+			}
 		}
 	}()
 	for true {
 		p, err := t.Read()
+		if err != nil && t.rejectPacket(err) {
+			continue
+		}
 		if err != nil {
-			_ = t.Close(err)
-			return err
+			reason := readCloseReason(err)
+			_ = t.Close(reason)
+			return reason
 		} else {
 			if p.Method() == ChannelMethodOpen {
 				channelData, ok := t.channelMap.Get(strconv.FormatInt(int64(p.Id()), 32))
 				if ok {
 					channelData.onOpen()
 				} else {
-					t.channelAcceptChan <- p
+					t.dispatchChannel(p)
 				}
 			} else if p.Method() == ChannelMethodClose {
 				channelData, ok := t.channelMap.Get(strconv.FormatInt(int64(p.Id()), 32))
@@ -143,25 +196,59 @@ func (t *conn) StartHandler() error {
 					//}
 				}
 			} else {
-				reply, ok := t.replyFuncMap.Get(strconv.FormatInt(int64(p.Id()), 32))
-				if ok {
-					reply.f(false, p)
-				} else {
-					handle, ok := t.handleMap.Get(p.Method())
-					if ok {
-						if handle.isAsync {
-							go handle.handle(t, p)
-						} else {
-							handle.handle(t, p)
-						}
-					}
-				}
+				t.dispatchPacket(p)
 			}
 		}
 	}
 	return nil
 }
 
+// rejectPacket method包含非法字符时帧已完整读取,只拒绝这个packet而不关闭连接,兼容method命名不规范的旧版本对端
+func (t *conn) rejectPacket(err error) bool {
+	var decodeErr *packet.DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Err != packet.InvalidMethodError {
+		return false
+	}
+	logger.Warn("rpc reject packet: %s", err)
+	if decodeErr.Kind != packet.KindRequest && decodeErr.Kind != packet.KindLegacy {
+		return true
+	}
+	err = t.sendKind(packet.KindResponse, MethodError, decodeErr.Id, &RemoteError{Code: ErrorCodeBadRequest, Message: err.Error()})
+	if err != nil {
+		logger.Error(err)
+	}
+	return true
+}
+
+// dispatchPacket 回复帧只匹配等待回复的请求,请求和通知帧只匹配处理函数,旧版本的帧两者都尝试
+func (t *conn) dispatchPacket(p packet.Packet) {
+	if p.Kind() == packet.KindResponse || p.Kind() == packet.KindLegacy {
+		reply, ok := t.replyFuncMap.Pop(strconv.FormatInt(int64(p.Id()), 32))
+		if ok {
+			reply.f(false, p)
+			return
+		}
+		if p.Kind() == packet.KindResponse {
+			//超时后才到达的回复直接丢弃
+			return
+		}
+	}
+	handle, ok := t.handleMap.Get(p.Method())
+	if ok {
+		t.dispatch(handle, p)
+		return
+	}
+	if p.Kind() == packet.KindNotification || p.Method() == MethodError {
+		//通知不需要回复;错误回复本身不再回复,防止两端互相回复死循环
+		return
+	}
+	//未注册的method立即回复错误,避免对方一直等到超时
+	err := ReplyError(t, p, &RemoteError{Code: ErrorCodeMethodNotFound, Message: "method not found: " + p.Method()})
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
 func (t *conn) OpenChannel(method string, v any) (*Channel, error) {
 	openPacket, err := packet.CreatePacket(method, 0, v)
 	if err != nil {
@@ -177,11 +264,7 @@ func (t *conn) OpenChannel(method string, v any) (*Channel, error) {
 	if err != nil {
 		return nil, err
 	}
-	t.channelMap.Set(openChannel.idString(), openChannel)
-	go func() {
-		<-ctx.Done()
-		t.channelMap.Remove(openChannel.idString())
-	}()
+	t.registerChannel(openChannel)
 	return openChannel, nil
 }
 
@@ -190,6 +273,29 @@ func (t *conn) AcceptChannel() (packet.Packet, *Channel, error) {
 	if !ok {
 		return packet.Packet{}, nil, ConnClosedError
 	}
+	return t.acceptChannel(p)
+}
+
+// dispatchChannel 有注册对应method的channel处理函数时直接交给处理函数,否则等待AcceptChannel
+func (t *conn) dispatchChannel(p packet.Packet) {
+	subPacket, err := p.SubPacket()
+	if err == nil {
+		handle, ok := t.channelHandleMap.Get(subPacket.Method())
+		if ok {
+			//在读循环中同步注册channel,保证紧随其后的ChannelSend能找到对应channel
+			_, openChannel, err := t.acceptChannel(p)
+			if err != nil {
+				logger.Error(err)
+				return
+			}
+			go handle.handle(t, subPacket, openChannel)
+			return
+		}
+	}
+	t.channelAcceptChan <- p
+}
+
+func (t *conn) acceptChannel(p packet.Packet) (packet.Packet, *Channel, error) {
 	ctx := context.Background()
 	subPacket, err := p.SubPacket()
 	if err != nil {
@@ -198,11 +304,7 @@ func (t *conn) AcceptChannel() (packet.Packet, *Channel, error) {
 
 	openChannel, err := newChannel(t, p.Id(), subPacket.Method(), ctx)
 	if err == nil {
-		t.channelMap.Set(openChannel.idString(), openChannel)
-		go func() {
-			<-ctx.Done()
-			t.channelMap.Remove(openChannel.idString())
-		}()
+		t.registerChannel(openChannel)
 		err := t.SendSpecifyId(p.Method(), p.Id(), p.Bytes())
 		if err != nil {
 			logger.Error(err)
@@ -216,61 +318,59 @@ func (t *conn) AcceptChannel() (packet.Packet, *Channel, error) {
 	return p, openChannel, err
 }
 
+// registerChannel 登记channel并应用连接的默认空闲超时,channel关闭后自动移除
+func (t *conn) registerChannel(openChannel *Channel) {
+	t.channelMap.Set(openChannel.idString(), openChannel)
+	openChannel.SetIdleTimeout(time.Duration(t.idleTimeout.Load()))
+	go func() {
+		<-openChannel.GetContext().Done()
+		t.channelMap.Remove(openChannel.idString())
+	}()
+}
+
+// SetChannelIdleTimeout 设置之后创建的channel的默认空闲超时,避免对方遗忘的channel在连接存续期间一直占用,为0时不限制
+func (t *conn) SetChannelIdleTimeout(timeout time.Duration) {
+	t.idleTimeout.Store(int64(timeout))
+}
+
 func (t *conn) Read() (packet.Packet, error) {
 	var p packet.Packet
-	if t.isClosed {
+	if t.isClosed.Load() {
 		return p, ConnClosedError
 	}
-	msgType, b, err := t.wsConn.ReadMessage()
+	r, err := t.transport.ReadFrame()
 	if err != nil {
 		return p, err
 	}
-	switch msgType {
-	case websocket.BinaryMessage:
-		return packet.DecodePacket(b, true)
-	case websocket.PingMessage:
-		t.writeLock.Lock()
-		_ = t.wsConn.WriteMessage(websocket.PongMessage, []byte("pong"))
-		t.writeLock.Unlock()
-		return t.Read()
-	case websocket.PongMessage:
-		return t.Read()
-	case websocket.CloseMessage:
-		closed := errors.New("closed")
-		t.triggerClose(closed)
-		return packet.Packet{}, closed
-
-	}
-	return packet.Packet{}, errors.New("read failure")
+	return packet.ReadPacket(r, true, *t.packetLimits.Load())
 }
 
 func (t *conn) Send(method string, v any) (uint32, error) {
-	minus := int32(-1)
-	uMinus := uint32(minus)
-	atomic.AddUint32(&t.id, uMinus)
-	return t.id, t.SendSpecifyId(method, t.id, v)
+	id := t.allocId()
+	return id, t.sendKind(packet.KindNotification, method, id, v)
 }
 
 func (t *conn) SendWaitReply(method string, v any, timeout int64, f func(timeout bool, packet packet.Packet)) error {
-	minus := int32(-1)
-	uMinus := uint32(minus)
-	atomic.AddUint32(&t.id, uMinus)
-	err := t.SendSpecifyId(method, t.id, v)
-	if err == nil {
-		var expire int64 = math.MaxInt64
-		if timeout > 0 {
-			expire = time.Now().Unix() + timeout
-		}
-		t.replyFuncMap.Set(strconv.FormatInt(int64(t.id), 32), reply{
-			f:    f,
-			time: expire,
-		})
+	id := t.allocId()
+	key := strconv.FormatInt(int64(id), 32)
+	var expire int64 = math.MaxInt64
+	if timeout > 0 {
+		expire = time.Now().Unix() + timeout
+	}
+	//先登记回复函数再发送,避免回复早于登记到达
+	t.replyFuncMap.Set(key, reply{
+		f:    f,
+		time: expire,
+	})
+	err := t.sendKind(packet.KindRequest, method, id, v)
+	if err != nil {
+		t.replyFuncMap.Remove(key)
 	}
 	return err
 }
 
-func (t *conn) Reply(method string, v any, packet packet.Packet) error {
-	return t.SendSpecifyId(method, packet.Id(), v)
+func (t *conn) Reply(method string, v any, p packet.Packet) error {
+	return t.sendKind(packet.KindResponse, method, p.Id(), v)
 }
 
 func (t *conn) Session() cmap.ConcurrentMap[any] {
@@ -278,73 +378,101 @@ func (t *conn) Session() cmap.ConcurrentMap[any] {
 }
 
 func (t *conn) IsClosed() bool {
-	return t.isClosed
+	return t.isClosed.Load()
 }
 
+// Close 关闭连接,err为*CloseReason时按其中的关闭码关闭,否则根据错误类型选择关闭码
 func (t *conn) Close(err error) error {
-	if t.isClosed {
+	if t.isClosed.Load() {
 		return ConnClosedError
 	}
-	defer t.triggerClose(err)
-	defer func() {
-		t.channelMap.IterCb(func(k string, v *Channel) {
-			err := v.Close(CloseInterrupt, "rpc connection closed")
-			if err != nil {
-				logger.Error(err)
-			}
-		})
-		t.channelMap.Clear()
-	}()
-	msg := err.Error()
-	msgBytes := []byte(msg)
-	//ws关闭原因最大125字节，超过120字节截取并省略
-	if len(msgBytes) > 120 {
-		msgBytes = msgBytes[0:120]
-		//utf-8为非定长编码，按固定长度截取字节最后一个字编码可能被破坏需要删除，并且在最后添加省略号
-		msg = strings.ToValidUTF8(string(msgBytes), "") + ".."
+	//并发关闭时以第一次调用的原因为准,例如本端关闭后读循环收到对方回应的关闭帧
+	if !t.closing.CompareAndSwap(false, true) {
+		return ConnClosedError
+	}
+	reason := localCloseReason(err)
+	defer t.triggerClose(reason)
+	//在关闭帧之前通知对方关闭channel;连接已经断开时发送失败,对方关闭连接时也会关闭所有channel,不需要处理错误
+	for _, v := range t.channelMap.Items() {
+		_ = v.Close(CloseInterrupt, "rpc connection closed")
 	}
-	t.writeLock.Lock()
-	defer t.writeLock.Unlock()
-	return t.wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, msg))
+	t.channelMap.Clear()
+	if reason.Initiator == CloseInitiatorTransport {
+		//底层连接已经异常,直接断开而不是发送关闭帧
+		transport, ok := t.transport.(aborter)
+		if ok {
+			return transport.abort()
+		}
+	}
+	return t.transport.Close(reason.Code, reason.Message)
 }
 
 func (t *conn) HandleFuncAsync(method string, handle func(conn Conn, packet packet.Packet)) {
-	t.handleMap.Set(method, handleFunc{true, handle})
+	t.handleMap.Set(method, handleFunc{isAsync: true, handle: handle})
 }
 
 func (t *conn) HandleFunc(method string, handle func(conn Conn, packet packet.Packet)) {
-	t.handleMap.Set(method, handleFunc{false, handle})
+	t.handleMap.Set(method, handleFunc{isAsync: false, handle: handle})
+}
+
+// HandleChannel 注册channel处理函数,对方打开对应method的channel时自动接受并异步调用handle
+func (t *conn) HandleChannel(method string, handle func(conn Conn, packet packet.Packet, channel *Channel)) {
+	t.channelHandleMap.Set(method, channelHandleFunc{handle})
+}
+
+// Describe 记录method的编码方式和数据结构,用于反射查询
+func (t *conn) Describe(method string, schema Schema) {
+	t.schemaMap.Set(method, schema)
+}
+
+// SetPacketLimits 设置接收packet的解码限制,超出长度限制时连接会被关闭,method包含非法字符时只回复错误
+func (t *conn) SetPacketLimits(limits packet.Limits) {
+	t.packetLimits.Store(&limits)
 }
 
-func (t *conn) OnClose(f func(conn Conn, err error)) {
-	t.closeFunc = f
+// OnClose 注册关闭回调,err为*CloseReason,可以注册多个,返回的函数用于取消注册;连接已关闭时立即调用
+func (t *conn) OnClose(f func(conn Conn, err error)) func() {
+	return t.closeListeners.add(t, f)
+}
+
+// CloseReason 返回连接关闭的原因,未关闭时返回nil
+func (t *conn) CloseReason() *CloseReason {
+	return t.closeListeners.closeReason()
 }
 
 func (t *conn) Ctx() context.Context {
 	return t.ctx
 }
 
+// SendSpecifyId 按旧版本格式发送指定id的帧,对方先匹配等待回复的请求再匹配处理函数
 func (t *conn) SendSpecifyId(method string, id uint32, v any) error {
-	if t.isClosed {
+	return t.sendKind(packet.KindLegacy, method, id, v)
+}
+
+func (t *conn) sendKind(kind int, method string, id uint32, v any) error {
+	if t.isClosed.Load() {
 		return ConnClosedError
 	}
-	bytes, err := packet.Encode(method, id, v, true)
+	bytes, err := t.encode(t.kind(kind), method, id, v)
 	if err != nil {
 		return err
 	}
-	t.writeLock.Lock()
-	defer t.writeLock.Unlock()
-	return t.wsConn.WriteMessage(websocket.BinaryMessage, bytes)
+	return t.transport.WriteFrame(bytes)
 }
 
-func (t *conn) triggerClose(err error) {
-	if !t.isClosed {
-		t.isClosed = true
+func (t *conn) triggerClose(reason *CloseReason) {
+	//并发关闭时只有一方能触发关闭回调
+	if t.isClosed.CompareAndSwap(false, true) {
 		defer func() {
 			t.ctxCancel()
 		}()
-		if t.closeFunc != nil {
-			t.closeFunc(t, err)
+		//连接关闭后不会再收到回复,等待中的请求按超时处理
+		for key := range t.replyFuncMap.Items() {
+			reply, ok := t.replyFuncMap.Pop(key)
+			if ok {
+				reply.f(true, packet.Packet{})
+			}
 		}
+		t.closeListeners.fire(t, reason)
 	}
 }
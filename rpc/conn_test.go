@@ -0,0 +1,145 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestConnPair 通过httptest建立一对websocket连接,返回服务端和客户端的Conn,两端均已启动处理循环
+func newTestConnPair(t *testing.T, setup func(server Conn)) (Conn, Conn) {
+	return newConnPair(t, websocket.DefaultDialer, setup)
+}
+
+func newConnPair(t testing.TB, dialer *websocket.Dialer, setup func(server Conn)) (Conn, Conn) {
+	serverChan := make(chan Conn, 1)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serverConn, err := Accept(w, req, context.Background(), 1<<20)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if setup != nil {
+			setup(serverConn)
+		}
+		serverChan <- serverConn
+		_ = serverConn.StartHandler()
+	}))
+	t.Cleanup(httpServer.Close)
+
+	wsConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn := NewConn(wsConn, context.Background())
+	go func() {
+		_ = clientConn.StartHandler()
+	}()
+	serverConn := <-serverChan
+	t.Cleanup(func() {
+		_ = clientConn.Close(errors.New("test finished"))
+	})
+	return serverConn, clientConn
+}
+
+func TestReflect(t *testing.T) {
+	_, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFunc("Echo", func(conn Conn, p packet.Packet) {
+			_ = conn.Reply(p.Method(), p.Bytes(), p)
+		})
+		server.Describe("Echo", Schema{Codec: CodecRaw})
+		server.HandleChannel("Terminal", func(conn Conn, p packet.Packet, channel *Channel) {})
+	})
+
+	methods, err := Reflect(client, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]string)
+	for _, method := range methods {
+		kinds[method.Method] = method.Kind
+		if method.Method == "Echo" && (method.Schema == nil || method.Schema.Codec != CodecRaw) {
+			t.Errorf("unexpected schema of Echo: %+v", method.Schema)
+		}
+	}
+	if kinds["Echo"] != MethodKindHandle || kinds["Terminal"] != MethodKindChannel || kinds[MethodReflect] != MethodKindAsync {
+		t.Errorf("unexpected methods: %+v", methods)
+	}
+}
+
+func TestMethodNotFound(t *testing.T) {
+	_, client := newTestConnPair(t, nil)
+
+	// 超时时间足够长,如果没有立即回复错误测试会因超时失败
+	err := Call(client, "Missing", "", nil, 60)
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != ErrorCodeMethodNotFound {
+		t.Fatalf("expected method not found error, got %v", err)
+	}
+}
+
+func TestReplyCalledOnce(t *testing.T) {
+	_, client := newTestConnPair(t, func(server Conn) {
+		//重复回复同一个请求
+		server.HandleFunc("Echo", func(conn Conn, p packet.Packet) {
+			_ = conn.Reply(p.Method(), p.Bytes(), p)
+			_ = conn.Reply(p.Method(), p.Bytes(), p)
+		})
+	})
+
+	calls := make(chan bool, 4)
+	err := client.SendWaitReply("Echo", "hello", 60, func(timeout bool, p packet.Packet) {
+		calls <- timeout
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout := <-calls; timeout {
+		t.Fatal("unexpected timeout")
+	}
+	//收到回复后立即移除回复函数,之后的重复回复和超时检查都不会再次调用
+	if err = Call(client, "Echo", "hello", nil, 5); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.(*conn).replyFuncMap.Count(); n != 0 {
+		t.Errorf("expected no pending replies, got %d", n)
+	}
+	if len(calls) != 0 {
+		t.Errorf("reply function is called %d more times", len(calls))
+	}
+}
+
+func TestHandleChannel(t *testing.T) {
+	_, client := newTestConnPair(t, func(server Conn) {
+		server.HandleChannel("Echo", func(conn Conn, p packet.Packet, channel *Channel) {
+			for {
+				data, err := channel.Read()
+				if err != nil {
+					return
+				}
+				_ = channel.Send(data.Bytes())
+			}
+		})
+	})
+
+	channel, err := client.OpenChannel("Echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = channel.Send("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := channel.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != "hello" {
+		t.Errorf("expected hello, got %s", p.String())
+	}
+}
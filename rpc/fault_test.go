@@ -0,0 +1,320 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type faultPair struct {
+	server          Conn
+	client          Conn
+	serverTransport *FaultTransport
+	clientTransport *FaultTransport
+	serverClosed    chan error
+	clientClosed    chan error
+}
+
+// newFaultConnPair 建立一对websocket连接,两端的发送方向都包装了FaultTransport,初始不注入任何故障
+func newFaultConnPair(t *testing.T, setup func(server Conn)) *faultPair {
+	pair := &faultPair{serverClosed: make(chan error, 1), clientClosed: make(chan error, 1)}
+	ready := make(chan struct{})
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		wsConn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pair.serverTransport = NewFaultTransport(NewWebsocketTransport(wsConn), Faults{})
+		pair.server = NewTransportConn(pair.serverTransport, context.Background(), IdSpaceLower)
+		pair.server.OnClose(func(conn Conn, err error) {
+			pair.serverClosed <- err
+		})
+		if setup != nil {
+			setup(pair.server)
+		}
+		close(ready)
+		_ = pair.server.StartHandler()
+	}))
+	t.Cleanup(httpServer.Close)
+
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair.clientTransport = NewFaultTransport(NewWebsocketTransport(wsConn), Faults{})
+	pair.client = NewTransportConn(pair.clientTransport, context.Background(), IdSpaceUpper)
+	pair.client.OnClose(func(conn Conn, err error) {
+		pair.clientClosed <- err
+	})
+	go func() {
+		_ = pair.client.StartHandler()
+	}()
+	<-ready
+	t.Cleanup(func() {
+		_ = pair.client.Close(errors.New("test finished"))
+	})
+	return pair
+}
+
+func waitClosed(t *testing.T, closed chan error, name string) error {
+	select {
+	case err := <-closed:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s conn is not closed", name)
+		return nil
+	}
+}
+
+func echoSetup(server Conn) {
+	server.HandleFuncAsync("Echo", func(conn Conn, p packet.Packet) {
+		_ = conn.Reply(p.Method(), p.Bytes(), p)
+	})
+	server.HandleChannel("Echo", func(conn Conn, p packet.Packet, channel *Channel) {
+		for {
+			data, err := channel.Read()
+			if err != nil {
+				return
+			}
+			_ = channel.Send(data.Bytes())
+		}
+	})
+}
+
+// recordTransport 记录写入的帧,用于比较故障序列
+type recordTransport struct {
+	frames [][]byte
+}
+
+func (t *recordTransport) ReadFrame() (io.Reader, error) {
+	return nil, io.EOF
+}
+
+func (t *recordTransport) WriteFrame(frame []byte) error {
+	t.frames = append(t.frames, frame)
+	return nil
+}
+
+func (t *recordTransport) Ping() error {
+	return nil
+}
+
+func (t *recordTransport) Close(code int, reason string) error {
+	return nil
+}
+
+func TestFaultDeterministic(t *testing.T) {
+	run := func(seed int64) ([][]byte, FaultStats) {
+		inner := new(recordTransport)
+		transport := NewFaultTransport(inner, Faults{Seed: seed, DropRate: 0.2, ReorderRate: 0.2, DuplicateRate: 0.2, TruncateRate: 0.2})
+		defer transport.Close(websocket.CloseNormalClosure, "")
+		for i := 0; i < 200; i++ {
+			_ = transport.WriteFrame([]byte(fmt.Sprintf("frame-%d", i)))
+		}
+		return inner.frames, transport.Stats()
+	}
+	first, stats := run(42)
+	second, _ := run(42)
+	other, _ := run(43)
+	if stats.Dropped == 0 || stats.Reordered == 0 || stats.Duplicated == 0 || stats.Truncated == 0 {
+		t.Fatalf("expected all faults to be injected: %+v", stats)
+	}
+	equal := func(a, b [][]byte) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !bytes.Equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if !equal(first, second) {
+		t.Error("same seed produced different frames")
+	}
+	if equal(first, other) {
+		t.Error("different seeds produced the same frames")
+	}
+}
+
+func TestFaultLatencyKeepsChannelOrder(t *testing.T) {
+	pair := newFaultConnPair(t, echoSetup)
+	faults := Faults{Seed: 1, Latency: time.Millisecond, Jitter: 5 * time.Millisecond}
+	pair.clientTransport.SetFaults(faults)
+	pair.serverTransport.SetFaults(faults)
+
+	channel, err := pair.client.OpenChannel("Echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 100
+	go func() {
+		for i := 0; i < count; i++ {
+			_ = channel.Send(echo{N: i})
+		}
+	}()
+	for i := 0; i < count; i++ {
+		p, err := channel.ReadTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v echo
+		err = p.Data(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.N != i {
+			t.Fatalf("expected %d, got %d", i, v.N)
+		}
+	}
+}
+
+func TestFaultDropTimeout(t *testing.T) {
+	pair := newFaultConnPair(t, echoSetup)
+	pair.serverTransport.SetFaults(Faults{DropRate: 1})
+
+	start := time.Now()
+	err := Call(pair.client, "Echo", echo{N: 1}, nil, 1)
+	if !errors.Is(err, TimeoutError) {
+		t.Fatalf("expected TimeoutError, got %v", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("timeout took %s", time.Since(start))
+	}
+	if n := pair.client.(*conn).replyFuncMap.Count(); n != 0 {
+		t.Errorf("expected no pending replies, got %d", n)
+	}
+
+	//恢复网络后连接仍然可用
+	pair.serverTransport.SetFaults(Faults{})
+	err = Call(pair.client, "Echo", echo{N: 2}, nil, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFaultDuplicateAndReorder(t *testing.T) {
+	pair := newFaultConnPair(t, echoSetup)
+	faults := Faults{Seed: 7, DuplicateRate: 0.3, ReorderRate: 0.3}
+	pair.clientTransport.SetFaults(faults)
+	pair.serverTransport.SetFaults(faults)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var resp echo
+			err := Call(pair.client, "Echo", echo{N: i}, &resp, 5)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.N != i {
+				t.Errorf("expected %d, got %d", i, resp.N)
+			}
+		}(i)
+	}
+	wg.Wait()
+	stats := pair.serverTransport.Stats()
+	if stats.Duplicated == 0 || stats.Reordered == 0 {
+		t.Errorf("expected faults to be injected: %+v", stats)
+	}
+	if pair.client.IsClosed() || pair.server.IsClosed() {
+		t.Error("duplicated and reordered frames should not close the connection")
+	}
+}
+
+func TestFaultTruncateClosesConn(t *testing.T) {
+	pair := newFaultConnPair(t, echoSetup)
+	channel, err := pair.client.OpenChannel("Echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = channel.Send(echo{N: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = channel.ReadTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair.clientTransport.SetFaults(Faults{Seed: 3, TruncateRate: 1})
+	_ = channel.Send(echo{N: 2})
+	err = waitClosed(t, pair.serverClosed, "server")
+	if !errors.Is(err, packet.TruncatedError) {
+		t.Errorf("expected TruncatedError, got %v", err)
+	}
+	waitClosed(t, pair.clientClosed, "client")
+	_, err = channel.ReadTimeout(5 * time.Second)
+	if !errors.Is(err, ChannelClosedError) {
+		t.Errorf("expected ChannelClosedError, got %v", err)
+	}
+}
+
+func TestFaultDisconnect(t *testing.T) {
+	pair := newFaultConnPair(t, func(server Conn) {
+		echoSetup(server)
+		server.HandleFuncAsync("Hang", func(conn Conn, p packet.Packet) {
+			<-conn.Ctx().Done()
+		})
+	})
+	channel, err := pair.client.OpenChannel("Echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- Call(pair.client, "Hang", "", nil, 60)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_ = pair.clientTransport.Disconnect()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ConnClosedError) {
+			t.Errorf("expected ConnClosedError, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending call is not released after disconnect")
+	}
+	waitClosed(t, pair.clientClosed, "client")
+	waitClosed(t, pair.serverClosed, "server")
+	_, err = channel.ReadTimeout(5 * time.Second)
+	if !errors.Is(err, ChannelClosedError) {
+		t.Errorf("expected ChannelClosedError, got %v", err)
+	}
+	err = channel.Send(echo{N: 1})
+	if err == nil {
+		t.Error("expected send on a disconnected channel to fail")
+	}
+}
+
+func TestFaultDisconnectAfter(t *testing.T) {
+	pair := newFaultConnPair(t, nil)
+	pair.clientTransport.SetFaults(Faults{DisconnectAfter: 5})
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = pair.client.Send("Notify", echo{N: i})
+	}
+	if !errors.Is(err, DisconnectedError) {
+		t.Errorf("expected DisconnectedError, got %v", err)
+	}
+	waitClosed(t, pair.clientClosed, "client")
+	waitClosed(t, pair.serverClosed, "server")
+}
@@ -0,0 +1,234 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var DisconnectedError = errors.New("transport is disconnected by fault injection")
+
+// Faults 注入到发送方向的网络故障,概率取值0-1;相同Seed和相同的发送顺序会产生相同的故障序列
+type Faults struct {
+	Seed int64
+	// Latency 每个帧的固定延迟,Jitter为额外的随机延迟,延迟不会打乱帧的顺序
+	Latency time.Duration
+	Jitter  time.Duration
+	// DropRate 丢弃帧的概率
+	DropRate float64
+	// ReorderRate 帧被扣留到下一个帧之后发送的概率
+	ReorderRate float64
+	// DuplicateRate 帧被重复发送的概率
+	DuplicateRate float64
+	// TruncateRate 帧被截断的概率,对方解码失败后会关闭连接
+	TruncateRate float64
+	// DisconnectAfter 发送该数量的帧后直接断开底层连接,为0时不断开
+	DisconnectAfter int
+}
+
+// FaultStats 已注入的故障数量
+type FaultStats struct {
+	Written    int
+	Dropped    int
+	Reordered  int
+	Duplicated int
+	Truncated  int
+}
+
+type delayedFrame struct {
+	frame []byte
+	due   time.Time
+}
+
+// FaultTransport 在发送方向注入延迟、丢包、乱序、重复、截断和断线的Transport包装,用于测试连接在异常网络下的表现
+type FaultTransport struct {
+	inner        Transport
+	lock         sync.Mutex
+	faults       Faults
+	rng          *rand.Rand
+	stats        FaultStats
+	held         []byte
+	lastDue      time.Time
+	delayed      chan delayedFrame
+	disconnected atomic.Bool
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func NewFaultTransport(inner Transport, faults Faults) *FaultTransport {
+	v := &FaultTransport{
+		inner:   inner,
+		delayed: make(chan delayedFrame, 4096),
+		done:    make(chan struct{}),
+	}
+	v.SetFaults(faults)
+	go v.deliverLoop()
+	return v
+}
+
+// SetFaults 替换故障配置并按新的Seed重置随机序列,已发送的帧数保留用于DisconnectAfter计数
+func (t *FaultTransport) SetFaults(faults Faults) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.faults = faults
+	t.rng = rand.New(rand.NewSource(faults.Seed))
+}
+
+func (t *FaultTransport) Stats() FaultStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stats
+}
+
+func (t *FaultTransport) ReadFrame() (io.Reader, error) {
+	r, err := t.inner.ReadFrame()
+	if err != nil && t.disconnected.Load() {
+		return nil, DisconnectedError
+	}
+	return r, err
+}
+
+func (t *FaultTransport) hit(rate float64) bool {
+	return rate > 0 && t.rng.Float64() < rate
+}
+
+func (t *FaultTransport) WriteFrame(frame []byte) error {
+	t.lock.Lock()
+	if t.disconnected.Load() {
+		t.lock.Unlock()
+		return DisconnectedError
+	}
+	t.stats.Written++
+	if t.faults.DisconnectAfter > 0 && t.stats.Written > t.faults.DisconnectAfter {
+		t.lock.Unlock()
+		return t.Disconnect()
+	}
+	//每个帧固定按相同顺序消耗随机数,保证故障序列只取决于Seed和帧的顺序
+	drop := t.hit(t.faults.DropRate)
+	reorder := t.hit(t.faults.ReorderRate)
+	duplicate := t.hit(t.faults.DuplicateRate)
+	truncate := t.hit(t.faults.TruncateRate)
+	//至少保留一个字节,截断后的帧总是不完整的帧而不是空帧
+	cut := len(frame)
+	if len(frame) > 1 {
+		cut = 1 + t.rng.Intn(len(frame)-1)
+	}
+	var jitter time.Duration
+	if t.faults.Jitter > 0 {
+		jitter = time.Duration(t.rng.Int63n(int64(t.faults.Jitter)))
+	}
+	if drop {
+		t.stats.Dropped++
+		t.lock.Unlock()
+		return nil
+	}
+	if truncate {
+		t.stats.Truncated++
+		frame = frame[:cut]
+	}
+	var frames [][]byte
+	if reorder && t.held == nil {
+		t.stats.Reordered++
+		t.held = frame
+	} else {
+		frames = append(frames, frame)
+		if t.held != nil {
+			frames = append(frames, t.held)
+			t.held = nil
+		}
+	}
+	if duplicate {
+		t.stats.Duplicated++
+		frames = append(frames, frame)
+	}
+	err := t.send(frames, t.faults.Latency+jitter)
+	t.lock.Unlock()
+	return err
+}
+
+// send 发送或延迟发送帧,调用时需要持有lock,保证帧按决定的顺序到达底层传输
+func (t *FaultTransport) send(frames [][]byte, delay time.Duration) error {
+	if delay <= 0 {
+		for _, v := range frames {
+			err := t.inner.WriteFrame(v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	//延迟发送时保证到期时间单调递增,抖动不会改变帧的顺序
+	due := time.Now().Add(delay)
+	if due.Before(t.lastDue) {
+		due = t.lastDue
+	}
+	t.lastDue = due
+	for _, v := range frames {
+		select {
+		case t.delayed <- delayedFrame{frame: v, due: due}:
+		case <-t.done:
+			return DisconnectedError
+		}
+	}
+	return nil
+}
+
+func (t *FaultTransport) deliverLoop() {
+	for {
+		select {
+		case v := <-t.delayed:
+			time.Sleep(time.Until(v.due))
+			if t.disconnected.Load() {
+				continue
+			}
+			_ = t.inner.WriteFrame(v.frame)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Ping 同时发出被扣留的帧,避免最后一个帧因为后面没有其他帧而一直不发送
+func (t *FaultTransport) Ping() error {
+	if t.disconnected.Load() {
+		return DisconnectedError
+	}
+	t.lock.Lock()
+	held := t.held
+	t.held = nil
+	var err error
+	if held != nil {
+		err = t.send([][]byte{held}, t.faults.Latency)
+	}
+	t.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return t.inner.Ping()
+}
+
+func (t *FaultTransport) Close(code int, reason string) error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	return t.inner.Close(code, reason)
+}
+
+// Disconnect 模拟网络异常断开,不发送关闭帧直接断开底层连接
+func (t *FaultTransport) Disconnect() error {
+	t.disconnected.Store(true)
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	inner, ok := t.inner.(aborter)
+	if ok {
+		_ = inner.abort()
+	} else {
+		_ = t.inner.Close(websocket.CloseGoingAway, DisconnectedError.Error())
+	}
+	return DisconnectedError
+}
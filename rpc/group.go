@@ -0,0 +1,185 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/wonderivan/logger"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChannelGroupStats channel分组的诊断信息
+type ChannelGroupStats struct {
+	Id        uint32    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	Channels  []uint32  `json:"channels"`
+}
+
+// ChannelGroup 一组相关的channel,例如终端及其调整大小、上传的channel;
+// 任意一个channel关闭时其余channel以相同的关闭码和原因关闭,分组的ctx同时结束
+type ChannelGroup struct {
+	id        uint32
+	name      string
+	conn      *conn
+	ctx       context.Context
+	ctxCancel func()
+	createdAt time.Time
+	lock      sync.Mutex
+	channels  map[uint32]*Channel
+	closeInfo *CloseInfo
+}
+
+var ChannelGroupClosedError = errors.New("channel group is closed")
+
+var groupIdSerial atomic.Uint32
+
+// NewChannelGroup 创建channel分组,分组的ctx在连接关闭时结束
+func (t *conn) NewChannelGroup(name string) *ChannelGroup {
+	ctx, cancel := context.WithCancel(t.ctx)
+	group := &ChannelGroup{
+		id:        groupIdSerial.Add(1),
+		name:      name,
+		conn:      t,
+		ctx:       ctx,
+		ctxCancel: cancel,
+		createdAt: time.Now(),
+		channels:  make(map[uint32]*Channel),
+	}
+	t.groupMap.Set(group.idString(), group)
+	go func() {
+		<-ctx.Done()
+		group.Close(CloseInterrupt, "rpc connection closed")
+	}()
+	return group
+}
+
+func (t *ChannelGroup) idString() string {
+	return strconv.FormatInt(int64(t.id), 32)
+}
+
+func (t *ChannelGroup) Id() uint32 {
+	return t.id
+}
+
+func (t *ChannelGroup) Name() string {
+	return t.name
+}
+
+// Context 分组关闭时结束,可用于控制与分组相关的其他任务
+func (t *ChannelGroup) Context() context.Context {
+	return t.ctx
+}
+
+// OpenChannel 打开channel并加入分组
+func (t *ChannelGroup) OpenChannel(method string, v any) (*Channel, error) {
+	if t.IsClosed() {
+		return nil, ChannelGroupClosedError
+	}
+	openChannel, err := t.conn.OpenChannel(method, v)
+	if err != nil {
+		return nil, err
+	}
+	err = t.Add(openChannel)
+	if err != nil {
+		_ = openChannel.Close(CloseInterrupt, err.Error())
+		return nil, err
+	}
+	return openChannel, nil
+}
+
+// Add 将已有的channel加入分组,例如AcceptChannel或HandleChannel得到的channel
+func (t *ChannelGroup) Add(channel *Channel) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closeInfo != nil {
+		return ChannelGroupClosedError
+	}
+	if channel.IsClosed() {
+		return ChannelClosedError
+	}
+	if !channel.group.CompareAndSwap(nil, t) {
+		return fmt.Errorf("channel %d is already in group %s", channel.Id(), channel.group.Load().name)
+	}
+	t.channels[channel.Id()] = channel
+	go func() {
+		select {
+		case <-channel.GetContext().Done():
+			//成员关闭时其余成员使用相同的关闭原因
+			closeInfo := channel.CloseInfo()
+			if closeInfo == nil {
+				closeInfo = &CloseInfo{Code: CloseInterrupt, Reason: "channel closed"}
+			}
+			t.Close(closeInfo.Code, closeInfo.Reason)
+		case <-t.ctx.Done():
+		}
+	}()
+	return nil
+}
+
+func (t *ChannelGroup) IsClosed() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closeInfo != nil
+}
+
+// CloseInfo 返回分组关闭的关闭码和原因,未关闭时返回nil
+func (t *ChannelGroup) CloseInfo() *CloseInfo {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closeInfo
+}
+
+// Close 以相同的关闭码和原因关闭分组内的所有channel,只有第一次调用生效
+func (t *ChannelGroup) Close(code int, reason string) {
+	t.lock.Lock()
+	if t.closeInfo != nil {
+		t.lock.Unlock()
+		return
+	}
+	t.closeInfo = &CloseInfo{Code: code, Reason: reason}
+	channels := t.channels
+	t.lock.Unlock()
+
+	t.ctxCancel()
+	t.conn.groupMap.Remove(t.idString())
+	for _, channel := range channels {
+		err := channel.Close(code, reason)
+		if err != nil && !errors.Is(err, ConnClosedError) {
+			logger.Error(err)
+		}
+	}
+}
+
+// Channels 返回分组内仍未关闭的channel
+func (t *ChannelGroup) Channels() []*Channel {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	channels := make([]*Channel, 0, len(t.channels))
+	for _, channel := range t.channels {
+		if !channel.IsClosed() {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].createdAt.Before(channels[j].createdAt)
+	})
+	return channels
+}
+
+func (t *ChannelGroup) Stats() ChannelGroupStats {
+	stats := ChannelGroupStats{
+		Id:        t.id,
+		Name:      t.name,
+		CreatedAt: t.createdAt,
+		Channels:  []uint32{},
+	}
+	for _, channel := range t.Channels() {
+		stats.Channels = append(stats.Channels, channel.Id())
+	}
+	return stats
+}
@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func waitDone(t *testing.T, done <-chan struct{}, name string) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s is not done", name)
+	}
+}
+
+func TestChannelGroupMemberClose(t *testing.T) {
+	server, client := newTestConnPair(t, echoSetup)
+	group := client.NewChannelGroup("terminal")
+	var channels []*Channel
+	for i := 0; i < 3; i++ {
+		channel, err := group.OpenChannel("Echo", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels = append(channels, channel)
+	}
+
+	stats := client.Stats()
+	if len(stats.Groups) != 1 || stats.Groups[0].Name != "terminal" || len(stats.Groups[0].Channels) != 3 {
+		t.Fatalf("unexpected groups: %+v", stats.Groups)
+	}
+	for _, channelStats := range stats.OpenChannels {
+		if channelStats.Group != group.Id() {
+			t.Errorf("channel %d is not in group", channelStats.Id)
+		}
+	}
+
+	//一个成员关闭后其余成员以相同原因关闭
+	_ = channels[0].Close(CloseFailure, "terminal exited")
+	waitDone(t, group.Context().Done(), "group context")
+	for _, channel := range channels[1:] {
+		_, err := channel.ReadTimeout(5 * time.Second)
+		if !errors.Is(err, ChannelClosedError) {
+			t.Errorf("expected ChannelClosedError, got %v", err)
+		}
+		closeInfo := channel.CloseInfo()
+		if closeInfo == nil || closeInfo.Code != CloseFailure || closeInfo.Reason != "terminal exited" {
+			t.Errorf("unexpected close info: %+v", closeInfo)
+		}
+	}
+	if len(client.Stats().Groups) != 0 {
+		t.Error("closed group is still in stats")
+	}
+	deadline := time.Now().Add(time.Second)
+	for server.Stats().Channels != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := server.Stats().Channels; n != 0 {
+		t.Errorf("expected peer channels to be closed, got %d", n)
+	}
+}
+
+func TestChannelGroupClose(t *testing.T) {
+	_, client := newTestConnPair(t, echoSetup)
+	group := client.NewChannelGroup("upload")
+	first, err := group.OpenChannel("Echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := client.OpenChannel("Echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = group.Add(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.NewChannelGroup("other").Add(other)
+	if err == nil {
+		t.Error("expected adding a channel to a second group to fail")
+	}
+
+	group.Close(CloseNormal, "upload finished")
+	for _, channel := range []*Channel{first, other} {
+		if !channel.IsClosed() || channel.CloseInfo().Reason != "upload finished" {
+			t.Errorf("unexpected channel state: %+v", channel.CloseInfo())
+		}
+	}
+	_, err = group.OpenChannel("Echo", "")
+	if !errors.Is(err, ChannelGroupClosedError) {
+		t.Errorf("expected ChannelGroupClosedError, got %v", err)
+	}
+}
+
+func TestChannelGroupConnClose(t *testing.T) {
+	_, client := newTestConnPair(t, echoSetup)
+	group := client.NewChannelGroup("terminal")
+	channel, err := group.OpenChannel("Echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close(errors.New("bye"))
+	waitDone(t, group.Context().Done(), "group context")
+	if !channel.IsClosed() || group.CloseInfo() == nil {
+		t.Error("group is not closed with the connection")
+	}
+}
@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"math/rand"
+	"strconv"
+	"sync"
+)
+
+// MethodHello 内置的握手method,声明本端的id空间,收到对方的握手后才会在帧头中标明帧类型
+const MethodHello = "RpcHello"
+
+// IdSpaceUpper 0x80000000-0xffffffff,发起连接的一端使用,与旧版本从0xffffffff递减分配的方式兼容
+const IdSpaceUpper = 0
+
+// IdSpaceLower 1-0x7fffffff,接受连接的一端使用
+const IdSpaceLower = 1
+
+type hello struct {
+	IdSpace int    `json:"idSpace"`
+	Nonce   uint64 `json:"nonce"`
+}
+
+// idAllocator 在本端的id空间内递减分配id,到达下限后回绕到上限,并跳过仍在使用中的id
+type idAllocator struct {
+	lock  sync.Mutex
+	space int
+	next  uint32
+	nonce uint64
+}
+
+func newIdAllocator(space int) *idAllocator {
+	v := &idAllocator{nonce: rand.Uint64()}
+	v.reset(space)
+	return v
+}
+
+func idRange(space int) (uint32, uint32) {
+	if space == IdSpaceLower {
+		return 1, 0x7fffffff
+	}
+	return 0x80000000, 0xffffffff
+}
+
+func (t *idAllocator) reset(space int) {
+	t.space = space
+	_, t.next = idRange(space)
+}
+
+func (t *idAllocator) Space() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.space
+}
+
+func (t *idAllocator) alloc(inUse func(id uint32) bool) uint32 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	low, high := idRange(t.space)
+	for {
+		id := t.next
+		if id <= low {
+			t.next = high
+		} else {
+			t.next = id - 1
+		}
+		//整个空间都被占用几乎不可能出现,这里不做额外处理
+		if !inUse(id) {
+			return id
+		}
+	}
+}
+
+func (t *conn) allocId() uint32 {
+	return t.ids.alloc(func(id uint32) bool {
+		key := strconv.FormatInt(int64(id), 32)
+		return t.replyFuncMap.Has(key) || t.channelMap.Has(key)
+	})
+}
+
+func (t *conn) sendHello() error {
+	t.ids.lock.Lock()
+	v := hello{IdSpace: t.ids.space, Nonce: t.ids.nonce}
+	t.ids.lock.Unlock()
+	return t.sendKind(packet.KindLegacy, MethodHello, 0, v)
+}
+
+// onHello 双方声明了相同的id空间时,nonce较小的一方切换到另一个空间
+func (t *conn) onHello(conn Conn, p packet.Packet) {
+	var peer hello
+	err := p.Data(&peer)
+	if err != nil {
+		return
+	}
+	t.ids.lock.Lock()
+	if peer.IdSpace == t.ids.space && t.ids.nonce < peer.Nonce {
+		t.ids.reset(1 - t.ids.space)
+	}
+	t.ids.lock.Unlock()
+	t.peerHello.Store(true)
+}
+
+// kind 对方握手前按旧版本格式发送,旧版本不认识帧头中的类型标志
+func (t *conn) kind(kind int) int {
+	if t.peerHello.Load() {
+		return kind
+	}
+	return packet.KindLegacy
+}
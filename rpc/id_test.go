@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"testing"
+	"time"
+)
+
+func TestIdAllocatorWraparound(t *testing.T) {
+	ids := newIdAllocator(IdSpaceLower)
+	ids.next = 2
+	inUse := map[uint32]bool{0x7fffffff: true}
+	var allocated []uint32
+	for i := 0; i < 3; i++ {
+		allocated = append(allocated, ids.alloc(func(id uint32) bool { return inUse[id] }))
+	}
+	if allocated[0] != 2 || allocated[1] != 1 || allocated[2] != 0x7ffffffe {
+		t.Errorf("unexpected ids: %x", allocated)
+	}
+
+	ids = newIdAllocator(IdSpaceUpper)
+	ids.next = 0x80000000
+	if id := ids.alloc(func(id uint32) bool { return false }); id != 0x80000000 {
+		t.Errorf("unexpected id %x", id)
+	}
+	if id := ids.alloc(func(id uint32) bool { return false }); id != 0xffffffff {
+		t.Errorf("unexpected id %x after wraparound", id)
+	}
+}
+
+// TestRequestIdCollision 对方请求的id与本端等待回复的请求id相同时,不能被当作回复
+func TestRequestIdCollision(t *testing.T) {
+	handled := make(chan packet.Packet, 1)
+	server, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFunc("Echo", func(conn Conn, p packet.Packet) {
+			handled <- p
+		})
+	})
+	client.HandleFunc("Slow", func(conn Conn, p packet.Packet) {})
+	//等待双方握手完成
+	for !server.(*conn).peerHello.Load() || !client.(*conn).peerHello.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	replied := make(chan bool, 1)
+	err := server.SendWaitReply("Slow", "", 5, func(timeout bool, p packet.Packet) {
+		replied <- timeout
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingId := server.(*conn).ids.next + 1
+	err = client.(*conn).sendKind(packet.KindRequest, "Echo", pendingId, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-handled:
+		if p.Id() != pendingId || p.Kind() != packet.KindRequest {
+			t.Errorf("unexpected packet %d kind %d", p.Id(), p.Kind())
+		}
+	case <-replied:
+		t.Fatal("peer request was treated as a reply")
+	case <-time.After(3 * time.Second):
+		t.Fatal("request was not handled")
+	}
+	if server.(*conn).ids.Space() == client.(*conn).ids.Space() {
+		t.Error("both sides use the same id space")
+	}
+}
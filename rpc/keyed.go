@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultKeyedQueueSize 每个key等待处理的packet数量上限,method的Limit设置了QueueSize时使用QueueSize
+const defaultKeyedQueueSize = 256
+
+// keyedQueues 按key分组的处理队列,同一key的packet按到达顺序依次处理,不同key之间并行
+type keyedQueues struct {
+	lock    sync.Mutex
+	queues  map[string][]packet.Packet
+	pending atomic.Int64
+	//space 处理协程取出packet后通知等待队列空位的读循环
+	space chan struct{}
+}
+
+func newKeyedQueues() *keyedQueues {
+	return &keyedQueues{queues: make(map[string][]packet.Packet), space: make(chan struct{}, 1)}
+}
+
+// HandleFuncKeyed 注册按key有序的异步处理函数,key函数在读循环中调用,应尽量轻量;
+// 每个key的队列长度和队列满时的处理策略取自method的Limit,未设置时队列长度为defaultKeyedQueueSize并排队等待
+func (t *conn) HandleFuncKeyed(method string, key func(packet packet.Packet) string, handle func(conn Conn, packet packet.Packet)) {
+	t.handleMap.Set(method, handleFunc{isAsync: true, handle: handle, key: key, queues: newKeyedQueues()})
+}
+
+func (t *conn) enqueueKeyed(handle handleFunc, p packet.Packet, v *limiter, counter *methodCounter) {
+	key := handle.key(p)
+	queues := handle.queues
+	size := defaultKeyedQueueSize
+	policy := LimitPolicyQueue
+	if v != nil {
+		policy = v.limit.Policy
+		if v.limit.QueueSize > 0 {
+			size = v.limit.QueueSize
+		}
+	}
+	waiting := false
+	for {
+		queues.lock.Lock()
+		queue, running := queues.queues[key]
+		if len(queue) < size {
+			queues.pending.Add(1)
+			queues.queues[key] = append(queue, p)
+			queues.lock.Unlock()
+			if !running {
+				//每个活跃的key一个处理协程,队列处理完后退出,避免key过多时协程泄漏
+				go t.drainKeyed(handle, key)
+			}
+			return
+		}
+		queues.lock.Unlock()
+		if !waiting {
+			if !t.exceeded(policy, counter, p) {
+				return
+			}
+			waiting = true
+		}
+		select {
+		case <-queues.space:
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *conn) drainKeyed(handle handleFunc, key string) {
+	queues := handle.queues
+	for {
+		queues.lock.Lock()
+		queue := queues.queues[key]
+		if len(queue) == 0 {
+			delete(queues.queues, key)
+			queues.lock.Unlock()
+			return
+		}
+		p := queue[0]
+		queues.queues[key] = queue[1:]
+		queues.lock.Unlock()
+		queues.pending.Add(-1)
+		select {
+		case queues.space <- struct{}{}:
+		default:
+		}
+		if t.ctx.Err() != nil {
+			continue
+		}
+		t.runHandle(handle, p)
+	}
+}
+
+// KeyByJsonField 返回从json数据中取顶层字段作为key的函数,字段不存在或解析失败时key为空字符串
+func KeyByJsonField(field string) func(packet packet.Packet) string {
+	return func(p packet.Packet) string {
+		var data map[string]json.RawMessage
+		if p.Data(&data) != nil {
+			return ""
+		}
+		raw, ok := data[field]
+		if !ok {
+			return ""
+		}
+		var str string
+		if json.Unmarshal(raw, &str) == nil {
+			return str
+		}
+		return string(raw)
+	}
+}
@@ -0,0 +1,113 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"sync"
+	"testing"
+	"time"
+)
+
+type keystroke struct {
+	Session string `json:"session"`
+	Seq     int    `json:"seq"`
+}
+
+func TestHandleFuncKeyed(t *testing.T) {
+	lock := new(sync.Mutex)
+	received := make(map[string][]int)
+	wg := new(sync.WaitGroup)
+	wg.Add(40)
+	_, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFuncKeyed("Input", KeyByJsonField("session"), func(conn Conn, p packet.Packet) {
+			defer wg.Done()
+			var v keystroke
+			if err := p.Data(&v); err != nil {
+				t.Error(err)
+				return
+			}
+			//先到的packet处理得更慢,没有按key排队时顺序会被打乱
+			time.Sleep(time.Duration(20-v.Seq) * time.Millisecond)
+			lock.Lock()
+			received[v.Session] = append(received[v.Session], v.Seq)
+			lock.Unlock()
+		})
+	})
+
+	for i := 0; i < 20; i++ {
+		for _, session := range []string{"a", "b"} {
+			_, err := client.Send("Input", keystroke{session, i})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+	for session, seqs := range received {
+		for i, seq := range seqs {
+			if seq != i {
+				t.Fatalf("session %s received out of order: %v", session, seqs)
+			}
+		}
+	}
+}
+
+func TestHandleFuncKeyedQueueLimit(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFuncKeyed("Input", KeyByJsonField("session"), func(conn Conn, p packet.Packet) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			_ = conn.Reply(p.Method(), "", p)
+		})
+		server.SetMethodLimit("Input", Limit{QueueSize: 2, Policy: LimitPolicyReject})
+	})
+
+	results := make(chan error, 5)
+	call := func(seq int) {
+		results <- Call(client, "Input", keystroke{"a", seq}, nil, 5)
+	}
+	go call(0)
+	<-started
+	//第一个请求正在处理,队列只能再容纳2个,其余的被拒绝
+	for i := 1; i < 5; i++ {
+		go call(i)
+	}
+	rejected := 0
+	for i := 0; i < 2; i++ {
+		err := <-results
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) && remoteErr.Code == ErrorCodeLimitExceeded {
+			rejected++
+		}
+	}
+	if rejected != 2 {
+		t.Errorf("expected 2 rejected calls, got %d", rejected)
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+
+	//队列处理完后移除key,处理协程退出
+	handle, _ := server.(*conn).handleMap.Get("Input")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		handle.queues.lock.Lock()
+		n := len(handle.queues.queues)
+		handle.queues.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d keys are still queued", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,301 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/wonderivan/logger"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitPolicyQueue 超出限制时排队等待,会阻塞读循环从而对对方形成背压
+const LimitPolicyQueue = 0
+
+// LimitPolicyReject 超出限制时立即回复ErrorCodeLimitExceeded错误
+const LimitPolicyReject = 1
+
+// LimitPolicyClose 超出限制时直接关闭连接
+const LimitPolicyClose = 2
+
+var LimitExceededError = errors.New("rpc limit exceeded")
+
+// Limit 请求处理限制,Rate为每秒允许的请求数(0为不限制),Burst为令牌桶容量,
+// MaxInFlight为同时处理的异步请求数(0为不限制,只对HandleFuncAsync注册的method生效,HandleFuncKeyed按key有序处理不受其限制),
+// QueueSize为等待处理的请求队列长度(HandleFuncKeyed为每个key的队列长度),Policy为超出限制时的处理策略
+type Limit struct {
+	Rate        float64 `json:"rate"`
+	Burst       int     `json:"burst"`
+	MaxInFlight int     `json:"maxInFlight"`
+	QueueSize   int     `json:"queueSize"`
+	Policy      int     `json:"policy"`
+}
+
+type limiter struct {
+	limit  Limit
+	bucket *tokenBucket
+	queue  chan queuedPacket
+	//space worker取出请求后通知排队等待的dispatch
+	space   chan struct{}
+	lock    sync.Mutex
+	stopped bool
+	stop    chan struct{}
+}
+
+type queuedPacket struct {
+	handle handleFunc
+	packet packet.Packet
+}
+
+type methodCounter struct {
+	received atomic.Uint64
+	rejected atomic.Uint64
+	inFlight atomic.Int64
+}
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = int(rate)
+		if burst <= 0 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve 取一个令牌,返回需要等待的时间,为0表示立即可用;wait为false时令牌不足不会预支
+func (t *tokenBucket) reserve(wait bool) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+	if t.tokens >= 1 {
+		t.tokens--
+		return 0
+	}
+	delay := time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+	if wait {
+		t.tokens--
+	}
+	return delay
+}
+
+func newLimiter(limit Limit) *limiter {
+	v := &limiter{limit: limit, stop: make(chan struct{})}
+	if limit.Rate > 0 {
+		v.bucket = newTokenBucket(limit.Rate, limit.Burst)
+	}
+	if limit.MaxInFlight > 0 {
+		v.queue = make(chan queuedPacket, limit.QueueSize)
+		v.space = make(chan struct{}, 1)
+	}
+	return v
+}
+
+// offer 不阻塞地放入队列,stopped为true表示limiter已被替换,需要放入新的limiter;
+// 与close使用同一个锁,保证停止后不会再有请求放入没有worker处理的队列
+func (t *limiter) offer(item queuedPacket) (ok bool, stopped bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.stopped {
+		return false, true
+	}
+	select {
+	case t.queue <- item:
+		return true, false
+	default:
+		return false, false
+	}
+}
+
+func (t *limiter) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.stopped = true
+	close(t.stop)
+}
+
+// SetLimit 设置整个连接的请求限制,内置的RpcHello、RpcCompression和RpcReflect不受连接和method的限制
+func (t *conn) SetLimit(limit Limit) {
+	t.connLimiter.Store(newLimiter(limit))
+}
+
+func (t *conn) SetMethodLimit(method string, limit Limit) {
+	v := newLimiter(limit)
+	for i := 0; i < limit.MaxInFlight; i++ {
+		go t.worker(v)
+	}
+	old, ok := t.limiterMap.Get(method)
+	t.limiterMap.Set(method, v)
+	if ok {
+		old.close()
+	}
+}
+
+// worker 处理限制了并发数的method队列,limiter被替换后处理完剩余请求再退出
+func (t *conn) worker(v *limiter) {
+	for {
+		select {
+		case item := <-v.queue:
+			select {
+			case v.space <- struct{}{}:
+			default:
+			}
+			t.runHandle(item.handle, item.packet)
+		case <-v.stop:
+			for {
+				select {
+				case item := <-v.queue:
+					t.runHandle(item.handle, item.packet)
+				default:
+					return
+				}
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *conn) counter(method string) *methodCounter {
+	return t.counterMap.Upsert(method, nil, func(exist bool, valueInMap *methodCounter, newValue *methodCounter) *methodCounter {
+		if exist {
+			return valueInMap
+		}
+		return new(methodCounter)
+	})
+}
+
+// dispatch 按连接和method的限制调用handle
+func (t *conn) dispatch(handle handleFunc, p packet.Packet) {
+	counter := t.counter(p.Method())
+	counter.received.Add(1)
+	if builtinMethod(p.Method()) {
+		//内置的协商和反射请求不受限制,避免握手被拒绝或者阻塞在用户请求之后
+		t.run(handle, p)
+		return
+	}
+	if !t.takeToken(t.connLimiter.Load(), counter, p) {
+		return
+	}
+	methodLimiter, _ := t.limiterMap.Get(p.Method())
+	if !t.takeToken(methodLimiter, counter, p) {
+		return
+	}
+	if handle.key != nil {
+		t.enqueueKeyed(handle, p, methodLimiter, counter)
+		return
+	}
+	if handle.isAsync && t.enqueue(queuedPacket{handle, p}, counter) {
+		return
+	}
+	t.run(handle, p)
+}
+
+func (t *conn) run(handle handleFunc, p packet.Packet) {
+	if handle.isAsync {
+		go t.runHandle(handle, p)
+	} else {
+		t.runHandle(handle, p)
+	}
+}
+
+func builtinMethod(method string) bool {
+	return method == MethodHello || method == MethodCompression || method == MethodReflect
+}
+
+// enqueue 放入method的并发队列,返回false表示method没有限制并发数;
+// 排队等待期间limiter被替换时改为放入新的limiter,不会阻塞在已经没有worker的旧队列上
+func (t *conn) enqueue(item queuedPacket, counter *methodCounter) bool {
+	waiting := false
+	for {
+		v, _ := t.limiterMap.Get(item.packet.Method())
+		if v == nil || v.queue == nil {
+			return false
+		}
+		ok, stopped := v.offer(item)
+		if ok {
+			return true
+		}
+		if stopped {
+			continue
+		}
+		if !waiting {
+			if !t.exceeded(v.limit.Policy, counter, item.packet) {
+				return true
+			}
+			waiting = true
+		}
+		select {
+		case <-v.space:
+		case <-v.stop:
+		case <-t.ctx.Done():
+			return true
+		}
+	}
+}
+
+func (t *conn) takeToken(v *limiter, counter *methodCounter, p packet.Packet) bool {
+	if v == nil || v.bucket == nil {
+		return true
+	}
+	wait := v.limit.Policy == LimitPolicyQueue
+	delay := v.bucket.reserve(wait)
+	if delay == 0 {
+		return true
+	}
+	if !t.exceeded(v.limit.Policy, counter, p) {
+		return false
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-t.ctx.Done():
+		return false
+	}
+}
+
+// exceeded 执行超出限制时的策略,返回true表示需要排队等待
+func (t *conn) exceeded(policy int, counter *methodCounter, p packet.Packet) bool {
+	switch policy {
+	case LimitPolicyReject:
+		counter.rejected.Add(1)
+		if p.Kind() == packet.KindNotification {
+			return false
+		}
+		err := ReplyError(t, p, &RemoteError{Code: ErrorCodeLimitExceeded, Message: LimitExceededError.Error()})
+		if err != nil {
+			logger.Error(err)
+		}
+		return false
+	case LimitPolicyClose:
+		counter.rejected.Add(1)
+		_ = t.Close(LimitExceededError)
+		return false
+	}
+	return true
+}
+
+func (t *conn) runHandle(handle handleFunc, p packet.Packet) {
+	counter := t.counter(p.Method())
+	counter.inFlight.Add(1)
+	defer counter.inFlight.Add(-1)
+	handle.handle(t, p)
+}
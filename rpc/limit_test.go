@@ -0,0 +1,150 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitReject(t *testing.T) {
+	server, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFunc("Echo", func(conn Conn, p packet.Packet) {
+			_ = conn.Reply(p.Method(), p.Bytes(), p)
+		})
+		server.SetMethodLimit("Echo", Limit{Rate: 1, Burst: 2, Policy: LimitPolicyReject})
+	})
+
+	rejected := 0
+	for i := 0; i < 5; i++ {
+		err := Call(client, "Echo", "hello", nil, 5)
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) && remoteErr.Code == ErrorCodeLimitExceeded {
+			rejected++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rejected < 2 {
+		t.Errorf("expected at least 2 rejected calls, got %d", rejected)
+	}
+	stats := methodStats(server, "Echo")
+	if stats.Received != 5 || stats.Rejected != uint64(rejected) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestLimitSkipsBuiltinMethods(t *testing.T) {
+	server, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFunc("Echo", func(conn Conn, p packet.Packet) {
+			_ = conn.Reply(p.Method(), p.Bytes(), p)
+		})
+		server.SetLimit(Limit{Rate: 0.001, Burst: 1, Policy: LimitPolicyClose})
+	})
+
+	if err := client.SetCompression(packet.GzipName, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := Reflect(client, 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitNegotiated(t, server)
+	//内置method没有消耗令牌
+	if err := Call(client, "Echo", "hello", nil, 5); err != nil {
+		t.Fatal(err)
+	}
+	if server.IsClosed() {
+		t.Error("connection is closed by builtin methods")
+	}
+}
+
+func methodStats(conn Conn, method string) MethodStats {
+	for _, stats := range conn.Stats().Methods {
+		if stats.Method == method {
+			return stats
+		}
+	}
+	return MethodStats{Method: method}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	var inFlight, maxInFlight int64
+	server, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFuncAsync("Slow", func(conn Conn, p packet.Packet) {
+			current := atomic.AddInt64(&inFlight, 1)
+			for {
+				last := atomic.LoadInt64(&maxInFlight)
+				if current <= last || atomic.CompareAndSwapInt64(&maxInFlight, last, current) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt64(&inFlight, -1)
+			_ = conn.Reply(p.Method(), "", p)
+		})
+		server.SetMethodLimit("Slow", Limit{MaxInFlight: 2, QueueSize: 16, Policy: LimitPolicyQueue})
+	})
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := Call(client, "Slow", "", nil, 10)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxInFlight != 2 {
+		t.Errorf("expected at most 2 concurrent handlers, got %d", maxInFlight)
+	}
+	if stats := methodStats(server, "Slow"); stats.Received != 8 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestMethodLimitSwapInFlight(t *testing.T) {
+	var handled int64
+	server, client := newTestConnPair(t, func(server Conn) {
+		server.HandleFuncAsync("Slow", func(conn Conn, p packet.Packet) {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&handled, 1)
+			_ = conn.Reply(p.Method(), "", p)
+		})
+		server.SetMethodLimit("Slow", Limit{MaxInFlight: 1, QueueSize: 1, Policy: LimitPolicyQueue})
+	})
+
+	//请求排队时不断替换限制,排队中的请求都要被处理,读循环也不能阻塞在旧的队列上
+	done := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			server.SetMethodLimit("Slow", Limit{MaxInFlight: 1 + i%3, QueueSize: 1, Policy: LimitPolicyQueue})
+		}
+	}()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := Call(client, "Slow", "", nil, 5); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	if handled != 200 {
+		t.Errorf("expected 200 handled requests, got %d", handled)
+	}
+}
@@ -0,0 +1,135 @@
+package packet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MaxDecompressedSize 解压后的数据最大长度,防止压缩炸弹
+var MaxDecompressedSize = 64 << 20
+
+var DecompressedTooLargeError = errors.New("decompressed data is too large")
+
+// Compressor 压缩算法,Id写在压缩数据的第一个字节用于解压时识别算法
+type Compressor interface {
+	Id() byte
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var compressorLock = new(sync.RWMutex)
+var compressorMap = make(map[byte]Compressor)
+
+// RegisterCompressor 注册压缩算法,相同Id的算法会被覆盖
+func RegisterCompressor(compressor Compressor) {
+	compressorLock.Lock()
+	defer compressorLock.Unlock()
+	compressorMap[compressor.Id()] = compressor
+}
+
+func GetCompressor(name string) (Compressor, bool) {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	for _, compressor := range compressorMap {
+		if compressor.Name() == name {
+			return compressor, true
+		}
+	}
+	return nil, false
+}
+
+// CompressorNames 已注册的全部压缩算法名称
+func CompressorNames() []string {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	names := make([]string, 0, len(compressorMap))
+	for _, compressor := range compressorMap {
+		names = append(names, compressor.Name())
+	}
+	return names
+}
+
+func compress(data []byte, compressor Compressor) ([]byte, error) {
+	compressed, err := compressor.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{compressor.Id()}, compressed...), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("compressed data is empty")
+	}
+	compressorLock.RLock()
+	compressor, ok := compressorMap[data[0]]
+	compressorLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported compressor %d", data[0])
+	}
+	return compressor.Decompress(data[1:])
+}
+
+const GzipName = "gzip"
+
+type gzipCompressor struct {
+	writerPool sync.Pool
+}
+
+// Gzip 默认注册的gzip压缩,使用BestSpeed降低小包延迟;
+// 标准库没有zstd实现,为了不引入cgo或额外的依赖只内置gzip,需要zstd时可以用RegisterCompressor注册,双方协商后生效
+var Gzip Compressor = &gzipCompressor{
+	writerPool: sync.Pool{New: func() any {
+		writer, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return writer
+	}},
+}
+
+func init() {
+	RegisterCompressor(Gzip)
+}
+
+func (t *gzipCompressor) Id() byte {
+	return 1
+}
+
+func (t *gzipCompressor) Name() string {
+	return GzipName
+}
+
+func (t *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	writer := t.writerPool.Get().(*gzip.Writer)
+	defer t.writerPool.Put(writer)
+	writer.Reset(buf)
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	result, err := io.ReadAll(io.LimitReader(reader, int64(MaxDecompressedSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(result) > MaxDecompressedSize {
+		return nil, DecompressedTooLargeError
+	}
+	return result, nil
+}
@@ -0,0 +1,278 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const headerLen = 10
+
+var TruncatedError = errors.New("packet is truncated")
+var MethodTooLongError = errors.New("packet method is too long")
+var DataTooLargeError = errors.New("packet data is too large")
+var InvalidMethodError = errors.New("packet method contains invalid characters")
+var UnknownFlagsError = errors.New("packet header contains unknown flags")
+
+// DecodeError 解码失败的详细信息,可通过errors.Is判断具体的错误类型;
+// InvalidMethodError时帧已完整读取,Id和Kind为该帧的id和类型,可以只拒绝这个packet
+type DecodeError struct {
+	Err    error
+	Method string
+	Id     uint32
+	Kind   int
+	Value  int
+	Limit  int
+}
+
+func (t *DecodeError) Error() string {
+	if t.Limit > 0 {
+		return fmt.Sprintf("%s: %d exceeds limit %d", t.Err.Error(), t.Value, t.Limit)
+	}
+	if t.Method != "" {
+		return fmt.Sprintf("%s: %q", t.Err.Error(), t.Method)
+	}
+	return t.Err.Error()
+}
+
+func (t *DecodeError) Unwrap() error {
+	return t.Err
+}
+
+// Limits 解码限制,字段为0或nil时使用DefaultLimits中的对应限制,MaxMethodLen和MaxDataLen小于0时不限制
+type Limits struct {
+	MaxMethodLen      int
+	MaxDataLen        int
+	AllowedMethodChar func(c byte) bool
+}
+
+// DefaultLimits rpc连接默认使用的解码限制
+var DefaultLimits = Limits{
+	MaxMethodLen:      128,
+	MaxDataLen:        64 << 20,
+	AllowedMethodChar: IsMethodChar,
+}
+
+// unlimited 不做任何限制,用于兼容DecodePacket
+var unlimited = Limits{MaxMethodLen: -1, MaxDataLen: -1, AllowedMethodChar: func(c byte) bool { return true }}
+
+// withDefaults 将未设置的字段替换为DefaultLimits中的值,避免零值Limits按头部声明的长度分配内存
+func (t Limits) withDefaults() Limits {
+	if t.MaxMethodLen == 0 {
+		t.MaxMethodLen = DefaultLimits.MaxMethodLen
+	}
+	if t.MaxDataLen == 0 {
+		t.MaxDataLen = DefaultLimits.MaxDataLen
+	}
+	if t.AllowedMethodChar == nil {
+		t.AllowedMethodChar = DefaultLimits.AllowedMethodChar
+	}
+	return t
+}
+
+// IsMethodChar method名称允许的字符:字母、数字以及_ . - / :
+func IsMethodChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '_' || c == '.' || c == '-' || c == '/' || c == ':'
+}
+
+type header struct {
+	flags     uint16
+	methodLen int
+	dataLen   int
+	id        uint32
+}
+
+func xor(b []byte, offset int) {
+	for i := range b {
+		b[i] ^= byte((offset + i) & 0xff)
+	}
+}
+
+func (t Limits) checkHeader(h header) error {
+	if h.flags&^(FlagCompressed|kindMask) != 0 {
+		return &DecodeError{Err: UnknownFlagsError, Value: int(h.flags)}
+	}
+	if t.MaxMethodLen > 0 && h.methodLen > t.MaxMethodLen {
+		return &DecodeError{Err: MethodTooLongError, Value: h.methodLen, Limit: t.MaxMethodLen}
+	}
+	if t.MaxDataLen > 0 && h.dataLen > t.MaxDataLen {
+		return &DecodeError{Err: DataTooLargeError, Value: h.dataLen, Limit: t.MaxDataLen}
+	}
+	return nil
+}
+
+func (t Limits) checkMethod(h header, method []byte) error {
+	for _, c := range method {
+		if !t.AllowedMethodChar(c) {
+			return &DecodeError{Err: InvalidMethodError, Method: string(method), Id: h.id, Kind: int(h.flags&kindMask) >> kindShift}
+		}
+	}
+	return nil
+}
+
+func parseHeader(b []byte) header {
+	methodLen := binary.BigEndian.Uint16(b[0:2])
+	return header{
+		flags:     methodLen &^ methodLenMask,
+		methodLen: int(methodLen & methodLenMask),
+		dataLen:   int(binary.BigEndian.Uint32(b[2:6])),
+		id:        binary.BigEndian.Uint32(b[6:10]),
+	}
+}
+
+// build 由已去除异或的method和data构造packet,data直接引用不拷贝
+func build(h header, method []byte, data []byte) (Packet, error) {
+	packet := Packet{method: string(method), mId: h.id, mBytes: data, kind: int(h.flags&kindMask) >> kindShift}
+	if h.flags&FlagCompressed != 0 {
+		decompressed, err := decompress(data)
+		if err != nil {
+			return Packet{}, err
+		}
+		packet.mBytes = decompressed
+		packet.compressed = true
+	}
+	return packet, nil
+}
+
+// ReadPacket 从r中读取一个完整的packet,在分配内存前校验头部长度,返回的packet独占自己的内存;
+// 在帧开始处读到结尾时返回io.EOF,帧中途结束时返回TruncatedError
+func ReadPacket(r io.Reader, isXor bool, limits Limits) (Packet, error) {
+	limits = limits.withDefaults()
+	var headerBytes [headerLen]byte
+	h, err := readHeader(r, headerBytes[:], isXor, limits)
+	if err != nil {
+		return Packet{}, err
+	}
+	body := make([]byte, h.methodLen+h.dataLen)
+	return readBody(r, h, body, isXor, limits)
+}
+
+func readHeader(r io.Reader, b []byte, isXor bool, limits Limits) (header, error) {
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return header{}, &DecodeError{Err: TruncatedError}
+		}
+		return header{}, err
+	}
+	if isXor {
+		xor(b, 0)
+	}
+	h := parseHeader(b)
+	return h, limits.checkHeader(h)
+}
+
+func readBody(r io.Reader, h header, body []byte, isXor bool, limits Limits) (Packet, error) {
+	_, err := io.ReadFull(r, body)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Packet{}, &DecodeError{Err: TruncatedError}
+		}
+		return Packet{}, err
+	}
+	if isXor {
+		xor(body, headerLen)
+	}
+	method := body[:h.methodLen]
+	err = limits.checkMethod(h, method)
+	if err != nil {
+		return Packet{}, err
+	}
+	return build(h, method, body[h.methodLen:])
+}
+
+// Decode 校验限制并解码完整的帧,不修改bytes;不需要异或时packet数据直接引用bytes
+func Decode(bytes []byte, isXor bool, limits Limits) (Packet, error) {
+	if len(bytes) < headerLen {
+		return Packet{}, &DecodeError{Err: TruncatedError}
+	}
+	limits = limits.withDefaults()
+	var headerBytes [headerLen]byte
+	copy(headerBytes[:], bytes)
+	if isXor {
+		xor(headerBytes[:], 0)
+	}
+	h := parseHeader(headerBytes[:])
+	err := limits.checkHeader(h)
+	if err != nil {
+		return Packet{}, err
+	}
+	end := headerLen + h.methodLen + h.dataLen
+	if end > len(bytes) {
+		return Packet{}, &DecodeError{Err: TruncatedError}
+	}
+	body := bytes[headerLen:end]
+	if isXor {
+		body = append([]byte(nil), body...)
+		xor(body, headerLen)
+	}
+	method := body[:h.methodLen]
+	err = limits.checkMethod(h, method)
+	if err != nil {
+		return Packet{}, err
+	}
+	return build(h, method, body[h.methodLen:])
+}
+
+var bufferPool = sync.Pool{New: func() any {
+	b := make([]byte, 0, 4096)
+	return &b
+}}
+
+// maxPooledBuffer 超过该大小的缓冲区不放回池中,避免偶发的大包长期占用内存
+const maxPooledBuffer = 1 << 20
+
+// Decoder 从字节流中连续解码packet,复用内部缓冲区;
+// Decode返回的packet数据只在下一次调用Decode或Release之前有效,需要保留时使用Packet.Clone
+type Decoder struct {
+	r      io.Reader
+	isXor  bool
+	limits Limits
+	buf    *[]byte
+	header [headerLen]byte
+}
+
+func NewDecoder(r io.Reader, isXor bool, limits Limits) *Decoder {
+	return &Decoder{
+		r:      r,
+		isXor:  isXor,
+		limits: limits.withDefaults(),
+		buf:    bufferPool.Get().(*[]byte),
+	}
+}
+
+func (t *Decoder) Decode() (Packet, error) {
+	if t.buf == nil {
+		return Packet{}, errors.New("decoder is released")
+	}
+	h, err := readHeader(t.r, t.header[:], t.isXor, t.limits)
+	if err != nil {
+		return Packet{}, err
+	}
+	size := h.methodLen + h.dataLen
+	if cap(*t.buf) < size {
+		*t.buf = make([]byte, size)
+	}
+	return readBody(t.r, h, (*t.buf)[:size], t.isXor, t.limits)
+}
+
+// Release 将缓冲区归还到池中,之后不能再使用Decoder以及其解码出的packet
+func (t *Decoder) Release() {
+	if t.buf == nil {
+		return
+	}
+	if cap(*t.buf) <= maxPooledBuffer {
+		*t.buf = (*t.buf)[:0]
+		bufferPool.Put(t.buf)
+	}
+	t.buf = nil
+}
+
+// Clone 拷贝packet数据,用于保留Decoder解码出的packet
+func (t Packet) Clone() Packet {
+	t.mBytes = append([]byte(nil), t.mBytes...)
+	return t
+}
@@ -3,14 +3,36 @@ package packet
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/xiwh/hexhub-agent-plugin/util/buf"
 	"google.golang.org/protobuf/proto"
 )
 
+// 头部method长度字段的高4位为标志位,低12位为method长度
+const methodLenMask = 0x0fff
+
+// FlagCompressed 数据经过压缩,数据第一个字节为压缩算法Id
+const FlagCompressed = 0x8000
+
+// 头部标志位中第13、14位为帧类型
+const kindShift = 13
+const kindMask = 0x3 << kindShift
+
+// KindLegacy 未标明类型的帧,旧版本对端发出的帧都是该类型,按先匹配回复再匹配处理函数的方式处理
+const KindLegacy = 0
+const KindRequest = 1
+const KindResponse = 2
+const KindNotification = 3
+
+// MaxMethodLen method名称最大字节数
+const MaxMethodLen = methodLenMask
+
 type Packet struct {
-	method string
-	mId    uint32
-	mBytes []byte
+	method     string
+	mId        uint32
+	mBytes     []byte
+	compressed bool
+	kind       int
 }
 
 func (t Packet) Len() int {
@@ -25,6 +47,22 @@ func (t Packet) Id() uint32 {
 	return t.mId
 }
 
+// Kind 帧类型,KindLegacy、KindRequest、KindResponse或KindNotification
+func (t Packet) Kind() int {
+	return t.kind
+}
+
+// WithKind 返回指定帧类型的packet副本
+func (t Packet) WithKind(kind int) Packet {
+	t.kind = kind & (kindMask >> kindShift)
+	return t
+}
+
+// Compressed 传输时是否经过压缩,Bytes返回的始终是解压后的数据
+func (t Packet) Compressed() bool {
+	return t.compressed
+}
+
 func (t Packet) String() string {
 	return string(t.mBytes)
 }
@@ -45,37 +83,9 @@ func (t Packet) ProtoData(v proto.Message) error {
 	return proto.Unmarshal(t.mBytes, v)
 }
 
+// DecodePacket 解码完整的帧,不做长度和字符限制,不会修改bytes
 func DecodePacket(bytes []byte, isXor bool) (packet Packet, err error) {
-	if isXor {
-		for i, mByte := range bytes {
-			bytes[i] = mByte ^ byte(i&0xff)
-		}
-	}
-	b := buf.Create(bytes)
-	methodLen, _, err := b.ReadUInt16()
-	if err != nil {
-		return packet, err
-	}
-	dataLen, _, err := b.ReadUInt32()
-	if err != nil {
-		return packet, err
-	}
-	id, _, err := b.ReadUInt32()
-	if err != nil {
-		return packet, err
-	}
-	method, _, err := b.ReadString(int(methodLen))
-	if err != nil {
-		return packet, err
-	}
-	dataBytes, _, err := b.ReadBytes(int(dataLen))
-	if err != nil {
-		return packet, err
-	}
-	packet.mBytes = dataBytes
-	packet.mId = id
-	packet.method = method
-	return packet, err
+	return Decode(bytes, isXor, unlimited)
 }
 
 func CreatePacket(method string, id uint32, v any) (Packet, error) {
@@ -115,17 +125,46 @@ func Encode(method string, id uint32, v any, isXor bool) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(method) > MaxMethodLen {
+		return nil, fmt.Errorf("method name exceeds %d bytes", MaxMethodLen)
+	}
 	return EncodePacket(packet, isXor), nil
 }
 
+// EncodeCompressed 数据长度达到threshold时使用compressor压缩,压缩后没有变小则按原数据编码
+func EncodeCompressed(packet Packet, isXor bool, compressor Compressor, threshold int) ([]byte, error) {
+	if len(packet.method) > MaxMethodLen {
+		return nil, fmt.Errorf("method name exceeds %d bytes", MaxMethodLen)
+	}
+	if compressor == nil || threshold <= 0 || len(packet.mBytes) < threshold {
+		return EncodePacket(packet, isXor), nil
+	}
+	compressed, err := compress(packet.mBytes, compressor)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(packet.mBytes) {
+		return EncodePacket(packet, isXor), nil
+	}
+	return encode(packet.method, packet.mId, compressed, packet.flags()|FlagCompressed, isXor), nil
+}
+
 func EncodePacket(packet Packet, isXor bool) []byte {
-	data := buf.CreateBySize(10 + len(packet.mBytes))
-	methodBytes := []byte(packet.method)
-	data.WriteUInt16(uint16(len(methodBytes)))
-	data.WriteUInt32(uint32(len(packet.mBytes)))
-	data.WriteUInt32(packet.mId)
+	return encode(packet.method, packet.mId, packet.mBytes, packet.flags(), isXor)
+}
+
+func (t Packet) flags() uint16 {
+	return uint16(t.kind<<kindShift) & kindMask
+}
+
+func encode(method string, id uint32, dataBytes []byte, flags uint16, isXor bool) []byte {
+	methodBytes := []byte(method)
+	data := buf.CreateBySize(10 + len(methodBytes) + len(dataBytes))
+	data.WriteUInt16(uint16(len(methodBytes))&methodLenMask | flags)
+	data.WriteUInt32(uint32(len(dataBytes)))
+	data.WriteUInt32(id)
 	data.WriteBytes(methodBytes)
-	data.WriteBytes(packet.mBytes)
+	data.WriteBytes(dataBytes)
 	result := data.Bytes()
 	if isXor {
 		for i, mByte := range result {
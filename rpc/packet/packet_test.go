@@ -0,0 +1,142 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecodeLimits(t *testing.T) {
+	encoded := EncodePacket(Packet{method: "Echo", mId: 1, mBytes: make([]byte, 100)}, true)
+	limits := Limits{MaxMethodLen: 8, MaxDataLen: 64, AllowedMethodChar: IsMethodChar}
+	_, err := Decode(encoded, true, limits)
+	if !errors.Is(err, DataTooLargeError) {
+		t.Errorf("expected DataTooLargeError, got %v", err)
+	}
+	_, err = ReadPacket(bytes.NewReader(encoded), true, limits)
+	if !errors.Is(err, DataTooLargeError) {
+		t.Errorf("expected DataTooLargeError, got %v", err)
+	}
+
+	//零值Limits使用默认限制,不按头部声明的长度分配内存
+	_, err = ReadPacket(bytes.NewReader([]byte{0, 4, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}), false, Limits{})
+	var limitErr *DecodeError
+	if !errors.As(err, &limitErr) || limitErr.Err != DataTooLargeError || limitErr.Limit != DefaultLimits.MaxDataLen {
+		t.Errorf("expected default data limit, got %v", err)
+	}
+
+	encoded = EncodePacket(Packet{method: "Echo Me", mId: 1}, false)
+	_, err = Decode(encoded, false, limits)
+	if !errors.Is(err, InvalidMethodError) {
+		t.Errorf("expected InvalidMethodError, got %v", err)
+	}
+
+	encoded = EncodePacket(Packet{method: strings.Repeat("a", 9), mId: 1}, false)
+	_, err = Decode(encoded, false, limits)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Err != MethodTooLongError || decodeErr.Value != 9 {
+		t.Errorf("expected MethodTooLongError, got %v", err)
+	}
+
+	encoded = EncodePacket(Packet{method: "Echo", mId: 1, mBytes: []byte("hello")}, true)
+	_, err = ReadPacket(bytes.NewReader(encoded[:len(encoded)-1]), true, limits)
+	if !errors.Is(err, TruncatedError) {
+		t.Errorf("expected TruncatedError, got %v", err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	stream := new(bytes.Buffer)
+	for _, data := range []string{"first", strings.Repeat("second", 1024), "third"} {
+		stream.Write(EncodePacket(Packet{method: "Data", mId: 7, mBytes: []byte(data)}, true))
+	}
+	decoder := NewDecoder(stream, true, DefaultLimits)
+	defer decoder.Release()
+	var received []string
+	for {
+		p, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Method() != "Data" || p.Id() != 7 {
+			t.Fatalf("unexpected packet %s %d", p.Method(), p.Id())
+		}
+		received = append(received, p.String())
+	}
+	if len(received) != 3 || received[0] != "first" || received[2] != "third" {
+		t.Errorf("unexpected packets: %d", len(received))
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("ChannelOpen", uint32(0xffffffff), []byte(`{"code":0}`), true, false, KindLegacy)
+	f.Add("", uint32(0), []byte{}, false, false, KindRequest)
+	f.Add("Data", uint32(1), bytes.Repeat([]byte("terminal output "), 512), true, true, KindNotification)
+	f.Fuzz(func(t *testing.T, method string, id uint32, data []byte, isXor bool, compressed bool, kind int) {
+		if len(method) > MaxMethodLen {
+			return
+		}
+		p := Packet{method: method, mId: id, mBytes: data}.WithKind(kind)
+		var encoded []byte
+		if compressed {
+			var err error
+			encoded, err = EncodeCompressed(p, isXor, Gzip, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			encoded = EncodePacket(p, isXor)
+		}
+		original := append([]byte(nil), encoded...)
+
+		decoded, err := DecodePacket(encoded, isXor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, original) {
+			t.Fatal("DecodePacket modified its input")
+		}
+		if decoded.Method() != method || decoded.Id() != id || decoded.Kind() != p.Kind() || !bytes.Equal(decoded.Bytes(), data) {
+			t.Fatalf("round trip mismatch: %q %d", decoded.Method(), decoded.Id())
+		}
+
+		streamed, err := ReadPacket(bytes.NewReader(encoded), isXor, unlimited)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if streamed.Method() != method || streamed.Id() != id || !bytes.Equal(streamed.Bytes(), data) {
+			t.Fatalf("streamed round trip mismatch: %q %d", streamed.Method(), streamed.Id())
+		}
+	})
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(EncodePacket(Packet{method: "Echo", mId: 3, mBytes: []byte("hello")}, true), true)
+	f.Add([]byte{0x80, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}, false)
+	f.Add([]byte{0, 4, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, false)
+	f.Fuzz(func(t *testing.T, encoded []byte, isXor bool) {
+		original := append([]byte(nil), encoded...)
+		decoded, err := Decode(encoded, isXor, DefaultLimits)
+		if !bytes.Equal(encoded, original) {
+			t.Fatal("Decode modified its input")
+		}
+		streamed, streamErr := ReadPacket(bytes.NewReader(encoded), isXor, DefaultLimits)
+		if (err == nil) != (streamErr == nil) {
+			t.Fatalf("Decode and ReadPacket disagree: %v, %v", err, streamErr)
+		}
+		if err != nil {
+			return
+		}
+		if decoded.Method() != streamed.Method() || decoded.Id() != streamed.Id() || !bytes.Equal(decoded.Bytes(), streamed.Bytes()) {
+			t.Fatal("Decode and ReadPacket decoded different packets")
+		}
+		if len(decoded.Method()) > DefaultLimits.MaxMethodLen {
+			t.Fatalf("method length %d exceeds limit", len(decoded.Method()))
+		}
+	})
+}
@@ -0,0 +1,394 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// http轮询传输协议,所有请求都带有transport和action参数:
+//
+//	POST ?transport=polling&action=open                        创建会话,返回{"sessionId","pollWait"}
+//	POST ?transport=polling&action=send&session=&seq=&ack=     发送帧,seq为第一个帧的序号,ack为已收到的下行帧数量
+//	GET  ?transport=polling&action=poll&session=&ack=          长轮询下行帧,响应头Rpc-Seq为第一个帧的序号,无数据时返回204
+//	GET  ?transport=sse&action=stream&session=&ack=            以SSE推送下行帧,事件id为帧序号,数据为base64编码的帧
+//	POST ?transport=polling&action=close&session=              关闭会话,请求体为CloseInfo
+//
+// 帧在请求体和轮询响应体中以4字节长度前缀依次排列,会话关闭后轮询返回410和CloseInfo
+const (
+	pollActionOpen   = "open"
+	pollActionSend   = "send"
+	pollActionPoll   = "poll"
+	pollActionStream = "stream"
+	pollActionClose  = "close"
+)
+
+const pollSeqHeader = "Rpc-Seq"
+
+// maxPollResponse 单次轮询响应的最大字节数,剩余的帧在下次轮询中返回
+const maxPollResponse = 1 << 20
+
+var SessionClosedError = errors.New("rpc session is closed")
+
+// pollSession 服务端的轮询会话,上行帧按序号去重保证有序,下行帧保留到客户端确认后才删除
+type pollSession struct {
+	id         string
+	inbound    chan []byte
+	inLock     sync.Mutex
+	inSeq      uint64
+	lock       sync.Mutex
+	outbound   [][]byte
+	outSeq     uint64
+	notify     chan struct{}
+	lastSeen   time.Time
+	timeout    time.Duration
+	closeInfo  *CloseInfo
+	done       chan struct{}
+	remoteDone bool
+}
+
+func newPollSession(id string, timeout time.Duration) *pollSession {
+	return &pollSession{
+		id:       id,
+		inbound:  make(chan []byte, 256),
+		notify:   make(chan struct{}),
+		lastSeen: time.Now(),
+		timeout:  timeout,
+		done:     make(chan struct{}),
+	}
+}
+
+func (t *pollSession) ReadFrame() (io.Reader, error) {
+	//优先读取已到达的帧,保证关闭前收到的帧都能被处理
+	select {
+	case frame := <-t.inbound:
+		return bytes.NewReader(frame), nil
+	default:
+	}
+	select {
+	case frame := <-t.inbound:
+		return bytes.NewReader(frame), nil
+	case <-t.done:
+		return nil, t.closedError()
+	}
+}
+
+func (t *pollSession) closedError() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closeInfo != nil && t.remoteDone {
+		return remoteCloseReason(*t.closeInfo)
+	}
+	return SessionClosedError
+}
+
+func (t *pollSession) WriteFrame(frame []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closeInfo != nil {
+		return SessionClosedError
+	}
+	t.outbound = append(t.outbound, frame)
+	t.signal()
+	return nil
+}
+
+// signal 唤醒所有等待下行帧的轮询,调用时需要持有lock
+func (t *pollSession) signal() {
+	close(t.notify)
+	t.notify = make(chan struct{})
+}
+
+func (t *pollSession) Ping() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if time.Since(t.lastSeen) > t.timeout {
+		return fmt.Errorf("%w: session %s timeout", SessionClosedError, t.id)
+	}
+	return nil
+}
+
+func (t *pollSession) Close(code int, reason string) error {
+	return t.close(CloseInfo{Code: code, Reason: reason}, false)
+}
+
+func (t *pollSession) close(info CloseInfo, remote bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closeInfo != nil {
+		return SessionClosedError
+	}
+	t.closeInfo = &info
+	t.remoteDone = remote
+	t.signal()
+	close(t.done)
+	return nil
+}
+
+// ack 删除客户端已确认收到的下行帧,调用时需要持有lock
+func (t *pollSession) ack(ack uint64) {
+	if ack <= t.outSeq {
+		return
+	}
+	n := ack - t.outSeq
+	if n > uint64(len(t.outbound)) {
+		n = uint64(len(t.outbound))
+	}
+	t.outbound = t.outbound[n:]
+	t.outSeq += n
+}
+
+func (t *pollSession) touch(ack uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.lastSeen = time.Now()
+	t.ack(ack)
+}
+
+// pending 返回从cursor开始未确认的帧
+func (t *pollSession) pending(cursor uint64) ([][]byte, uint64, *CloseInfo, chan struct{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if cursor < t.outSeq {
+		cursor = t.outSeq
+	}
+	start := cursor - t.outSeq
+	if start > uint64(len(t.outbound)) {
+		start = uint64(len(t.outbound))
+	}
+	return t.outbound[start:], cursor, t.closeInfo, t.notify
+}
+
+// receive 按序号接收上行帧,重复的帧忽略,序号不连续时返回错误让客户端重试
+func (t *pollSession) receive(seq uint64, frames [][]byte) error {
+	t.inLock.Lock()
+	defer t.inLock.Unlock()
+	if seq > t.inSeq {
+		return fmt.Errorf("expected seq %d, got %d", t.inSeq, seq)
+	}
+	skip := t.inSeq - seq
+	for i, frame := range frames {
+		if uint64(i) < skip {
+			continue
+		}
+		select {
+		case t.inbound <- frame:
+			t.inSeq++
+		case <-t.done:
+			return SessionClosedError
+		}
+	}
+	return nil
+}
+
+func writeFrames(w io.Writer, frames [][]byte) error {
+	var size [4]byte
+	for _, frame := range frames {
+		binary.BigEndian.PutUint32(size[:], uint32(len(frame)))
+		_, err := w.Write(size[:])
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(frame)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFrames(r io.Reader, limit int64) ([][]byte, error) {
+	var frames [][]byte
+	var size [4]byte
+	for {
+		_, err := io.ReadFull(r, size[:])
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		n := int64(binary.BigEndian.Uint32(size[:]))
+		if limit > 0 && n > limit {
+			return nil, fmt.Errorf("frame size %d exceeds limit %d", n, limit)
+		}
+		frame := make([]byte, n)
+		_, err = io.ReadFull(r, frame)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func queryUint(req *http.Request, name string) uint64 {
+	v, _ := strconv.ParseUint(req.URL.Query().Get(name), 10, 64)
+	return v
+}
+
+func (t *Server) servePoll(w http.ResponseWriter, req *http.Request, action string, sse bool) {
+	if action == pollActionOpen {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		t.openSession(w)
+		return
+	}
+	session, ok := t.sessions.Get(req.URL.Query().Get("session"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch action {
+	case pollActionSend:
+		t.pollSend(w, req, session)
+	case pollActionPoll:
+		t.pollReceive(w, req, session)
+	case pollActionStream:
+		if !sse {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		t.streamReceive(w, req, session)
+	case pollActionClose:
+		var info CloseInfo
+		_ = json.NewDecoder(io.LimitReader(req.Body, 4096)).Decode(&info)
+		_ = session.close(info, true)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (t *Server) pollSend(w http.ResponseWriter, req *http.Request, session *pollSession) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session.touch(queryUint(req, "ack"))
+	frames, err := readFrames(io.LimitReader(req.Body, t.ReadLimit+4), t.ReadLimit)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = session.receive(queryUint(req, "seq"), frames)
+	if errors.Is(err, SessionClosedError) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *Server) pollReceive(w http.ResponseWriter, req *http.Request, session *pollSession) {
+	ack := queryUint(req, "ack")
+	session.touch(ack)
+	timer := time.NewTimer(t.PollWait)
+	defer timer.Stop()
+	for {
+		frames, seq, closeInfo, notify := session.pending(ack)
+		if len(frames) > 0 {
+			size := 0
+			for i, frame := range frames {
+				size += len(frame) + 4
+				if size > maxPollResponse && i > 0 {
+					frames = frames[:i]
+					break
+				}
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set(pollSeqHeader, strconv.FormatUint(seq, 10))
+			w.WriteHeader(http.StatusOK)
+			_ = writeFrames(w, frames)
+			return
+		}
+		if closeInfo != nil {
+			writeCloseInfo(w, *closeInfo)
+			return
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func (t *Server) streamReceive(w http.ResponseWriter, req *http.Request, session *pollSession) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	cursor := queryUint(req, "ack")
+	lastEventId := req.Header.Get("Last-Event-ID")
+	if lastEventId != "" {
+		v, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err == nil {
+			cursor = v + 1
+		}
+	}
+	session.touch(cursor)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(t.PollWait)
+	defer keepalive.Stop()
+	for {
+		frames, seq, closeInfo, notify := session.pending(cursor)
+		for _, frame := range frames {
+			_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", seq, base64.StdEncoding.EncodeToString(frame))
+			if err != nil {
+				return
+			}
+			seq++
+		}
+		cursor = seq
+		if len(frames) == 0 && closeInfo != nil {
+			data, _ := json.Marshal(closeInfo)
+			_, _ = fmt.Fprintf(w, "event: close\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-notify:
+		case <-keepalive.C:
+			session.touch(0)
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func remoteCloseReason(info CloseInfo) *CloseReason {
+	return &CloseReason{Code: info.Code, Message: info.Reason, Initiator: CloseInitiatorRemote, Err: SessionClosedError}
+}
+
+func writeCloseInfo(w http.ResponseWriter, info CloseInfo) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	_ = json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,401 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pollMaxRetry 请求连续失败超过该次数后认为连接断开
+const pollMaxRetry = 5
+
+// pollClient 客户端的轮询传输,上行帧逐个按序号发送,失败重试时由服务端去重
+type pollClient struct {
+	ctx       context.Context
+	cancel    func()
+	client    *http.Client
+	endpoint  *url.URL
+	transport string
+	session   string
+	pollWait  time.Duration
+	inbound   chan []byte
+	writeLock sync.Mutex
+	sendSeq   uint64
+	lastPost  time.Time
+	lastAck   uint64
+	recvSeq   atomic.Uint64
+	closeLock sync.Mutex
+	closeErr  error
+	done      chan struct{}
+}
+
+// DialPolling 通过http轮询连接Server,sse为true时下行使用SSE;返回的连接与NewConn一样需要调用StartHandler
+func DialPolling(ctx context.Context, endpoint string, client *http.Client, sse bool) (Conn, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	transport := TransportPolling
+	if sse {
+		transport = TransportSSE
+	}
+	pollCtx, cancel := context.WithCancel(ctx)
+	v := &pollClient{
+		ctx:       pollCtx,
+		cancel:    cancel,
+		client:    client,
+		endpoint:  u,
+		transport: transport,
+		inbound:   make(chan []byte, 256),
+		done:      make(chan struct{}),
+	}
+	resp, err := v.request(http.MethodPost, pollActionOpen, nil, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		return nil, fmt.Errorf("open rpc session failure: %s", resp.Status)
+	}
+	var result openResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	v.session = result.SessionId
+	v.pollWait = time.Duration(result.PollWait) * time.Millisecond
+	v.lastPost = time.Now()
+	if sse {
+		go v.streamLoop()
+	} else {
+		go v.pollLoop()
+	}
+	return NewTransportConn(v, ctx, IdSpaceUpper), nil
+}
+
+func (t *pollClient) request(method string, action string, query url.Values, body []byte) (*http.Response, error) {
+	u := *t.endpoint
+	q := u.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("transport", t.transport)
+	q.Set("action", action)
+	if t.session != "" {
+		q.Set("session", t.session)
+	}
+	u.RawQuery = q.Encode()
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(t.ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	return t.client.Do(req)
+}
+
+func backoff(failures int) time.Duration {
+	return time.Duration(failures*failures) * 100 * time.Millisecond
+}
+
+// closeWith 记录关闭原因并结束读取,只有第一次调用生效
+func (t *pollClient) closeWith(err error) bool {
+	t.closeLock.Lock()
+	defer t.closeLock.Unlock()
+	if t.closeErr != nil {
+		return false
+	}
+	t.closeErr = err
+	close(t.done)
+	t.cancel()
+	return true
+}
+
+func (t *pollClient) closedError() error {
+	t.closeLock.Lock()
+	defer t.closeLock.Unlock()
+	return t.closeErr
+}
+
+func remoteClosed(body io.Reader) error {
+	var info CloseInfo
+	err := json.NewDecoder(io.LimitReader(body, 4096)).Decode(&info)
+	if err != nil {
+		return SessionClosedError
+	}
+	return remoteCloseReason(info)
+}
+
+// deliver 按序号投递下行帧,已收到的帧忽略
+func (t *pollClient) deliver(seq uint64, frame []byte) bool {
+	if seq != t.recvSeq.Load() {
+		return true
+	}
+	select {
+	case t.inbound <- frame:
+		t.recvSeq.Add(1)
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+func (t *pollClient) pollLoop() {
+	failures := 0
+	for {
+		err := t.poll()
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if t.ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, SessionClosedError) {
+			t.closeWith(err)
+			return
+		}
+		failures++
+		if failures > pollMaxRetry {
+			t.closeWith(err)
+			return
+		}
+		time.Sleep(backoff(failures))
+	}
+}
+
+func (t *pollClient) poll() error {
+	resp, err := t.request(http.MethodGet, pollActionPoll, url.Values{"ack": {strconv.FormatUint(t.recvSeq.Load(), 10)}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		seq, err := strconv.ParseUint(resp.Header.Get(pollSeqHeader), 10, 64)
+		if err != nil {
+			return err
+		}
+		frames, err := readFrames(resp.Body, 0)
+		if err != nil {
+			return err
+		}
+		for i, frame := range frames {
+			if !t.deliver(seq+uint64(i), frame) {
+				return nil
+			}
+		}
+		return nil
+	case http.StatusNoContent:
+		return nil
+	case http.StatusGone:
+		return remoteClosed(resp.Body)
+	case http.StatusNotFound:
+		return SessionClosedError
+	default:
+		return fmt.Errorf("poll rpc session failure: %s", resp.Status)
+	}
+}
+
+func (t *pollClient) streamLoop() {
+	failures := 0
+	for {
+		received, err := t.stream()
+		if received {
+			failures = 0
+		}
+		if t.ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, SessionClosedError) {
+			t.closeWith(err)
+			return
+		}
+		failures++
+		if failures > pollMaxRetry {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			t.closeWith(err)
+			return
+		}
+		time.Sleep(backoff(failures))
+	}
+}
+
+// stream 读取一次SSE连接直到断开,received表示期间是否收到过事件
+func (t *pollClient) stream() (received bool, err error) {
+	resp, err := t.request(http.MethodGet, pollActionStream, url.Values{"ack": {strconv.FormatUint(t.recvSeq.Load(), 10)}}, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return false, remoteClosed(resp.Body)
+	case http.StatusNotFound:
+		return false, SessionClosedError
+	default:
+		return false, fmt.Errorf("stream rpc session failure: %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 4096), 128<<20)
+	var event, id, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			if strings.HasPrefix(line, ":") {
+				received = true
+				continue
+			}
+			name, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch name {
+			case "event":
+				event = value
+			case "id":
+				id = value
+			case "data":
+				data += value
+			}
+			continue
+		}
+		received = true
+		if event == "close" {
+			var info CloseInfo
+			_ = json.Unmarshal([]byte(data), &info)
+			return received, remoteCloseReason(info)
+		}
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return received, err
+		}
+		frame, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return received, err
+		}
+		if !t.deliver(seq, frame) {
+			return received, nil
+		}
+		event, id, data = "", "", ""
+	}
+	return received, scanner.Err()
+}
+
+func (t *pollClient) ReadFrame() (io.Reader, error) {
+	select {
+	case frame := <-t.inbound:
+		return bytes.NewReader(frame), nil
+	default:
+	}
+	select {
+	case frame := <-t.inbound:
+		return bytes.NewReader(frame), nil
+	case <-t.done:
+		return nil, t.closedError()
+	}
+}
+
+// post 按当前序号发送帧,网络错误或服务端错误时重试,帧为空时只用于保活和确认
+func (t *pollClient) post(frames [][]byte) error {
+	body := new(bytes.Buffer)
+	err := writeFrames(body, frames)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for failures := 0; failures <= pollMaxRetry; failures++ {
+		if failures > 0 {
+			time.Sleep(backoff(failures))
+		}
+		ack := t.recvSeq.Load()
+		query := url.Values{
+			"seq": {strconv.FormatUint(t.sendSeq, 10)},
+			"ack": {strconv.FormatUint(ack, 10)},
+		}
+		resp, err := t.request(http.MethodPost, pollActionSend, query, body.Bytes())
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return t.closedError()
+			}
+			lastErr = err
+			continue
+		}
+		_ = resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNoContent:
+			t.sendSeq += uint64(len(frames))
+			t.lastPost = time.Now()
+			t.lastAck = ack
+			return nil
+		case resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound:
+			return SessionClosedError
+		case resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("send rpc frame failure: %s", resp.Status)
+		default:
+			return fmt.Errorf("send rpc frame failure: %s", resp.Status)
+		}
+	}
+	return lastErr
+}
+
+func (t *pollClient) WriteFrame(frame []byte) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if err := t.closedError(); err != nil {
+		return err
+	}
+	return t.post([][]byte{frame})
+}
+
+// Ping SSE模式下需要单独上报确认序号,两种模式在长时间没有上行请求时都发送空请求保活
+func (t *pollClient) Ping() error {
+	if err := t.closedError(); err != nil {
+		return err
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	acked := t.transport == TransportPolling || t.lastAck == t.recvSeq.Load()
+	if acked && time.Since(t.lastPost) < t.pollWait/2 {
+		return nil
+	}
+	return t.post(nil)
+}
+
+func (t *pollClient) Close(code int, reason string) error {
+	if err := t.closedError(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(CloseInfo{Code: code, Reason: reason})
+	if err != nil {
+		return err
+	}
+	//关闭请求尽力发送,无论是否成功都结束本地会话
+	resp, err := t.request(http.MethodPost, pollActionClose, nil, data)
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+	t.closeWith(SessionClosedError)
+	return err
+}
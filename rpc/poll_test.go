@@ -0,0 +1,134 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newPollConnPair 通过httptest上的Server建立一对轮询连接
+func newPollConnPair(t *testing.T, sse bool, setup func(server Conn)) (Conn, Conn) {
+	serverChan := make(chan Conn, 1)
+	server := NewServer(context.Background(), func(conn Conn) {
+		if setup != nil {
+			setup(conn)
+		}
+		serverChan <- conn
+	}, TransportPolling, TransportSSE)
+	server.PollWait = 200 * time.Millisecond
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client, err := DialPolling(context.Background(), httpServer.URL, httpServer.Client(), sse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = client.StartHandler()
+	}()
+	serverConn := <-serverChan
+	t.Cleanup(func() {
+		_ = client.Close(errors.New("test finished"))
+	})
+	return serverConn, client
+}
+
+func TestPollingTransport(t *testing.T) {
+	for _, sse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sse=%v", sse), func(t *testing.T) {
+			testPollingTransport(t, sse)
+		})
+	}
+}
+
+type echo struct {
+	N int `json:"n"`
+}
+
+func testPollingTransport(t *testing.T, sse bool) {
+	const count = 100
+	server, client := newPollConnPair(t, sse, func(server Conn) {
+		server.HandleFuncAsync("Echo", func(conn Conn, p packet.Packet) {
+			_ = conn.Reply(p.Method(), p.Bytes(), p)
+		})
+		server.HandleFunc("Start", func(conn Conn, p packet.Packet) {
+			for i := 0; i < count; i++ {
+				_, _ = conn.Send("Seq", strconv.Itoa(i))
+			}
+		})
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var resp echo
+			err := Call(client, "Echo", echo{N: i}, &resp, 5)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.N != i {
+				t.Errorf("expected %d, got %d", i, resp.N)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	received := make(chan string, count)
+	client.HandleFunc("Seq", func(conn Conn, p packet.Packet) {
+		received <- p.String()
+	})
+	_, err := client.Send("Start", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case v := <-received:
+			if v != strconv.Itoa(i) {
+				t.Fatalf("expected %d, got %s", i, v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for packet %d", i)
+		}
+	}
+
+	closed := make(chan error, 1)
+	server.OnClose(func(conn Conn, err error) {
+		closed <- err
+	})
+	_ = client.Close(errors.New("bye"))
+	select {
+	case err := <-closed:
+		if !errors.Is(err, SessionClosedError) {
+			t.Errorf("expected SessionClosedError, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server conn is not closed")
+	}
+}
+
+func TestPollingServerClose(t *testing.T) {
+	server, client := newPollConnPair(t, false, nil)
+	closed := make(chan error, 1)
+	client.OnClose(func(conn Conn, err error) {
+		closed <- err
+	})
+	_ = server.Close(errors.New("shutdown"))
+	select {
+	case err := <-closed:
+		if !errors.Is(err, SessionClosedError) {
+			t.Errorf("expected SessionClosedError, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client conn is not closed")
+	}
+}
@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"sort"
+)
+
+// MethodReflect 内置的反射method,回复当前连接注册的全部method
+const MethodReflect = "RpcReflect"
+
+const CodecJson = "json"
+const CodecProto = "proto"
+const CodecRaw = "raw"
+
+const MethodKindHandle = "handle"
+const MethodKindAsync = "async"
+const MethodKindKeyed = "keyed"
+const MethodKindChannel = "channel"
+
+// Schema method请求和回复的编码方式及数据结构名称,由注册方通过Describe提供
+type Schema struct {
+	Codec    string `json:"codec"`
+	Request  string `json:"request,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+type MethodInfo struct {
+	Method string  `json:"method"`
+	Kind   string  `json:"kind"`
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+func (t *conn) Methods() []MethodInfo {
+	methods := make([]MethodInfo, 0, t.handleMap.Count()+t.channelHandleMap.Count())
+	t.handleMap.IterCb(func(method string, v handleFunc) {
+		kind := MethodKindHandle
+		if v.key != nil {
+			kind = MethodKindKeyed
+		} else if v.isAsync {
+			kind = MethodKindAsync
+		}
+		methods = append(methods, t.methodInfo(method, kind))
+	})
+	t.channelHandleMap.IterCb(func(method string, v channelHandleFunc) {
+		methods = append(methods, t.methodInfo(method, MethodKindChannel))
+	})
+	sort.Slice(methods, func(i, j int) bool {
+		if methods[i].Method == methods[j].Method {
+			return methods[i].Kind < methods[j].Kind
+		}
+		return methods[i].Method < methods[j].Method
+	})
+	return methods
+}
+
+func (t *conn) methodInfo(method string, kind string) MethodInfo {
+	info := MethodInfo{Method: method, Kind: kind}
+	schema, ok := t.schemaMap.Get(method)
+	if ok {
+		info.Schema = &schema
+	}
+	return info
+}
+
+func reflectHandle(conn Conn, p packet.Packet) {
+	_ = conn.Reply(p.Method(), conn.Methods(), p)
+}
+
+// Reflect 查询对方注册的全部method,timeout单位为秒
+func Reflect(conn Conn, timeout int64) ([]MethodInfo, error) {
+	var methods []MethodInfo
+	err := Call(conn, MethodReflect, "", &methods, timeout)
+	return methods, err
+}
@@ -20,5 +20,5 @@ func Accept(w http.ResponseWriter, req *http.Request, ctx context.Context, readL
 	}
 	wsConn.SetReadLimit(readLimit)
 
-	return NewConn(wsConn, ctx), err
+	return NewTransportConn(NewWebsocketTransport(wsConn), ctx, IdSpaceLower), err
 }
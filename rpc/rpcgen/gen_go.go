@@ -0,0 +1,158 @@
+package rpcgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strings"
+	"unicode"
+)
+
+var goScalarTypes = map[string]string{
+	"double":   "float64",
+	"float":    "float32",
+	"int32":    "int32",
+	"sint32":   "int32",
+	"sfixed32": "int32",
+	"int64":    "int64",
+	"sint64":   "int64",
+	"sfixed64": "int64",
+	"uint32":   "uint32",
+	"fixed32":  "uint32",
+	"uint64":   "uint64",
+	"fixed64":  "uint64",
+	"bool":     "bool",
+	"string":   "string",
+	"bytes":    "[]byte",
+}
+
+// GenerateGo 生成message结构体、method常量、客户端存根以及服务端注册函数
+func GenerateGo(file *File, goPackage string, source string) ([]byte, error) {
+	if goPackage == "" {
+		goPackage = file.Package
+	}
+	if goPackage == "" {
+		return nil, fmt.Errorf("go package name is required")
+	}
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "// Code generated by rpcgen from %s. DO NOT EDIT.\n\n", source)
+	fmt.Fprintf(b, "package %s\n\n", goPackage)
+	if len(file.Services) > 0 {
+		b.WriteString("import (\n")
+		b.WriteString("\t\"github.com/xiwh/hexhub-agent-plugin/rpc\"\n")
+		b.WriteString("\t\"github.com/xiwh/hexhub-agent-plugin/rpc/packet\"\n")
+		b.WriteString(")\n\n")
+	}
+
+	for _, enum := range file.Enums {
+		fmt.Fprintf(b, "type %s int32\n\n", enum.Name)
+		b.WriteString("const (\n")
+		for _, value := range enum.Values {
+			fmt.Fprintf(b, "\t%s_%s %s = %d\n", enum.Name, value.Name, enum.Name, value.Number)
+		}
+		b.WriteString(")\n\n")
+	}
+
+	for _, msg := range file.Messages {
+		fmt.Fprintf(b, "type %s struct {\n", msg.Name)
+		for _, field := range msg.Fields {
+			fmt.Fprintf(b, "\t%s %s `json:\"%s,omitempty\"`\n", goName(field.Name), goFieldType(file, field), jsonName(field.Name))
+		}
+		b.WriteString("}\n\n")
+	}
+
+	for _, service := range file.Services {
+		b.WriteString("const (\n")
+		for _, method := range service.Methods {
+			fmt.Fprintf(b, "\t%sMethod%s = %q\n", service.Name, method.Name, method.Name)
+		}
+		b.WriteString(")\n\n")
+
+		clientName := service.Name + "Client"
+		fmt.Fprintf(b, "type %s struct {\n\tconn    rpc.Conn\n\ttimeout int64\n}\n\n", clientName)
+		fmt.Fprintf(b, "// New%s timeout为每次调用等待回复的秒数\n", clientName)
+		fmt.Fprintf(b, "func New%s(conn rpc.Conn, timeout int64) *%s {\n\treturn &%s{conn: conn, timeout: timeout}\n}\n\n", clientName, clientName, clientName)
+		for _, method := range service.Methods {
+			fmt.Fprintf(b, "func (t *%s) %s(req *%s) (*%s, error) {\n", clientName, method.Name, method.Request, method.Response)
+			fmt.Fprintf(b, "\tresp := new(%s)\n", method.Response)
+			fmt.Fprintf(b, "\terr := rpc.Call(t.conn, %sMethod%s, req, resp, t.timeout)\n", service.Name, method.Name)
+			b.WriteString("\tif err != nil {\n\t\treturn nil, err\n\t}\n\treturn resp, nil\n}\n\n")
+		}
+
+		serverName := service.Name + "Server"
+		fmt.Fprintf(b, "type %s interface {\n", serverName)
+		for _, method := range service.Methods {
+			fmt.Fprintf(b, "\t%s(conn rpc.Conn, req *%s) (*%s, error)\n", method.Name, method.Request, method.Response)
+		}
+		b.WriteString("}\n\n")
+
+		fmt.Fprintf(b, "// Register%s 在conn上注册%s的全部method,每个请求异步处理\n", serverName, service.Name)
+		fmt.Fprintf(b, "func Register%s(conn rpc.Conn, server %s) {\n", serverName, serverName)
+		for _, method := range service.Methods {
+			fmt.Fprintf(b, "\tconn.HandleFuncAsync(%sMethod%s, func(conn rpc.Conn, p packet.Packet) {\n", service.Name, method.Name)
+			fmt.Fprintf(b, "\t\treq := new(%s)\n", method.Request)
+			b.WriteString("\t\terr := rpc.Unmarshal(p, req)\n")
+			b.WriteString("\t\tif err != nil {\n\t\t\t_ = rpc.ReplyError(conn, p, &rpc.RemoteError{Code: rpc.ErrorCodeBadRequest, Message: err.Error()})\n\t\t\treturn\n\t\t}\n")
+			fmt.Fprintf(b, "\t\tresp, err := server.%s(conn, req)\n", method.Name)
+			b.WriteString("\t\tif err != nil {\n\t\t\t_ = rpc.ReplyError(conn, p, err)\n\t\t\treturn\n\t\t}\n")
+			b.WriteString("\t\t_ = conn.Reply(p.Method(), resp, p)\n")
+			b.WriteString("\t})\n")
+			fmt.Fprintf(b, "\tconn.Describe(%sMethod%s, rpc.Schema{Codec: rpc.CodecJson, Request: %q, Response: %q})\n", service.Name, method.Name, method.Request, method.Response)
+		}
+		b.WriteString("}\n\n")
+	}
+	return format.Source(b.Bytes())
+}
+
+func goFieldType(file *File, field *Field) string {
+	valueType := goType(file, field.Type)
+	if field.IsMap {
+		return fmt.Sprintf("map[%s]%s", goType(file, field.KeyType), valueType)
+	}
+	if field.Repeated {
+		return "[]" + valueType
+	}
+	return valueType
+}
+
+func goType(file *File, protoType string) string {
+	if v, ok := goScalarTypes[protoType]; ok {
+		return v
+	}
+	if file.isEnum(protoType) {
+		return protoType
+	}
+	return "*" + protoType
+}
+
+// goName snake_case转换为导出的CamelCase
+func goName(name string) string {
+	parts := strings.Split(name, "_")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		runes := []rune(part)
+		runes[0] = unicode.ToUpper(runes[0])
+		parts[i] = string(runes)
+	}
+	return strings.Join(parts, "")
+}
+
+// jsonName 与protobuf的json名称规则一致,去掉下划线并将其后的字母大写
+func jsonName(name string) string {
+	b := new(strings.Builder)
+	upper := false
+	for _, c := range name {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			c = unicode.ToUpper(c)
+			upper = false
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
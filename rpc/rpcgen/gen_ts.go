@@ -0,0 +1,102 @@
+package rpcgen
+
+import (
+	"bytes"
+	"fmt"
+	"unicode"
+)
+
+var tsScalarTypes = map[string]string{
+	"double":   "number",
+	"float":    "number",
+	"int32":    "number",
+	"sint32":   "number",
+	"sfixed32": "number",
+	"int64":    "number",
+	"sint64":   "number",
+	"sfixed64": "number",
+	"uint32":   "number",
+	"fixed32":  "number",
+	"uint64":   "number",
+	"fixed64":  "number",
+	"bool":     "boolean",
+	"string":   "string",
+	//[]byte在json中以base64字符串传输
+	"bytes": "string",
+}
+
+// GenerateTs 生成message接口定义和客户端类,客户端依赖页面端实现的RpcTransport
+func GenerateTs(file *File, source string) []byte {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "// Code generated by rpcgen from %s. DO NOT EDIT.\n\n", source)
+	b.WriteString("export interface RpcTransport {\n")
+	b.WriteString("  call(method: string, data: any, timeout: number): Promise<any>\n")
+	b.WriteString("}\n\n")
+
+	for _, enum := range file.Enums {
+		fmt.Fprintf(b, "export enum %s {\n", enum.Name)
+		for _, value := range enum.Values {
+			fmt.Fprintf(b, "  %s = %d,\n", value.Name, value.Number)
+		}
+		b.WriteString("}\n\n")
+	}
+
+	for _, msg := range file.Messages {
+		fmt.Fprintf(b, "export interface %s {\n", msg.Name)
+		for _, field := range msg.Fields {
+			fmt.Fprintf(b, "  %s?: %s\n", jsonName(field.Name), tsFieldType(field))
+		}
+		b.WriteString("}\n\n")
+	}
+
+	for _, service := range file.Services {
+		fmt.Fprintf(b, "export const %sMethods = {\n", service.Name)
+		for _, method := range service.Methods {
+			fmt.Fprintf(b, "  %s: %q,\n", method.Name, method.Name)
+		}
+		b.WriteString("} as const\n\n")
+
+		fmt.Fprintf(b, "export class %sClient {\n", service.Name)
+		b.WriteString("  constructor(private transport: RpcTransport, private timeout: number = 10) {}\n")
+		for _, method := range service.Methods {
+			b.WriteString("\n")
+			fmt.Fprintf(b, "  %s(req: %s): Promise<%s> {\n", lowerFirst(method.Name), method.Request, method.Response)
+			fmt.Fprintf(b, "    return this.transport.call(%sMethods.%s, req, this.timeout)\n", service.Name, method.Name)
+			b.WriteString("  }\n")
+		}
+		b.WriteString("}\n\n")
+	}
+	return append(bytes.TrimRight(b.Bytes(), "\n"), '\n')
+}
+
+func tsFieldType(field *Field) string {
+	valueType := tsType(field.Type)
+	if field.IsMap {
+		return fmt.Sprintf("{ [key: %s]: %s }", tsMapKeyType(field.KeyType), valueType)
+	}
+	if field.Repeated {
+		return valueType + "[]"
+	}
+	return valueType
+}
+
+func tsType(protoType string) string {
+	if v, ok := tsScalarTypes[protoType]; ok {
+		return v
+	}
+	return protoType
+}
+
+// tsMapKeyType json对象的key只能是字符串,数字key在json中同样为字符串形式
+func tsMapKeyType(protoType string) string {
+	if tsType(protoType) == "number" {
+		return "number"
+	}
+	return "string"
+}
+
+func lowerFirst(name string) string {
+	runes := []rune(name)
+	runes[0] = unicode.ToLower(runes[0])
+	return string(runes)
+}
@@ -0,0 +1,560 @@
+package rpcgen
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// File 解析后的服务定义文件,只支持proto3中message、enum、service的子集
+type File struct {
+	Package  string
+	Messages []*Message
+	Enums    []*Enum
+	Services []*Service
+}
+
+type Message struct {
+	Name   string
+	Fields []*Field
+}
+
+type Field struct {
+	Name     string
+	Type     string
+	KeyType  string
+	Repeated bool
+	IsMap    bool
+	Number   int
+}
+
+type Enum struct {
+	Name   string
+	Values []*EnumValue
+}
+
+type EnumValue struct {
+	Name   string
+	Number int
+}
+
+type Service struct {
+	Name    string
+	Methods []*Method
+}
+
+type Method struct {
+	Name     string
+	Request  string
+	Response string
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	file   *File
+}
+
+type token struct {
+	text string
+	line int
+}
+
+func Parse(src string) (*File, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, file: new(File)}
+	err = p.parseFile()
+	if err != nil {
+		return nil, err
+	}
+	err = p.file.check()
+	if err != nil {
+		return nil, err
+	}
+	return p.file, nil
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	line := 1
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case unicode.IsSpace(c):
+			i++
+		case c == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			i += 2
+			for i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/') {
+				if runes[i] == '\n' {
+					line++
+				}
+				i++
+			}
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			i += 2
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != c {
+				if runes[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			i++
+			tokens = append(tokens, token{string(runes[start:i]), line})
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.' || c == '-':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.' || runes[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, token{string(runes[start:i]), line})
+		default:
+			tokens = append(tokens, token{string(c), line})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func (t *parser) peek() string {
+	if t.pos >= len(t.tokens) {
+		return ""
+	}
+	return t.tokens[t.pos].text
+}
+
+func (t *parser) next() string {
+	v := t.peek()
+	t.pos++
+	return v
+}
+
+func (t *parser) errorf(format string, args ...any) error {
+	line := 0
+	if t.pos < len(t.tokens) {
+		line = t.tokens[t.pos].line
+	} else if len(t.tokens) > 0 {
+		line = t.tokens[len(t.tokens)-1].line
+	}
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (t *parser) expect(text string) error {
+	if t.peek() != text {
+		return t.errorf("expected %q, got %q", text, t.peek())
+	}
+	t.pos++
+	return nil
+}
+
+func (t *parser) ident() (string, error) {
+	v := t.peek()
+	if v == "" || !(unicode.IsLetter([]rune(v)[0]) || v[0] == '_' || v[0] == '.') {
+		return "", t.errorf("expected identifier, got %q", v)
+	}
+	t.pos++
+	return strings.TrimPrefix(v, "."), nil
+}
+
+func (t *parser) number() (int, error) {
+	v := t.next()
+	var n int
+	_, err := fmt.Sscanf(v, "%d", &n)
+	if err != nil {
+		return 0, t.errorf("expected number, got %q", v)
+	}
+	return n, nil
+}
+
+// skipStatement 跳过不关心的语句(syntax、import、option等)直到分号
+func (t *parser) skipStatement() {
+	for t.peek() != "" && t.next() != ";" {
+	}
+}
+
+// skipBlock 跳过花括号块,包含嵌套
+func (t *parser) skipBlock() error {
+	for t.peek() != "{" {
+		if t.peek() == "" {
+			return t.errorf("expected \"{\"")
+		}
+		t.pos++
+	}
+	depth := 0
+	for {
+		switch t.next() {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		case "":
+			return t.errorf("unexpected end of file")
+		}
+	}
+}
+
+func (t *parser) parseFile() error {
+	for t.peek() != "" {
+		switch t.peek() {
+		case "package":
+			t.pos++
+			name, err := t.ident()
+			if err != nil {
+				return err
+			}
+			t.file.Package = name
+			err = t.expect(";")
+			if err != nil {
+				return err
+			}
+		case "message":
+			t.pos++
+			err := t.parseMessage("")
+			if err != nil {
+				return err
+			}
+		case "enum":
+			t.pos++
+			err := t.parseEnum("")
+			if err != nil {
+				return err
+			}
+		case "service":
+			t.pos++
+			err := t.parseService()
+			if err != nil {
+				return err
+			}
+		case ";":
+			t.pos++
+		default:
+			t.skipStatement()
+		}
+	}
+	return nil
+}
+
+func (t *parser) parseMessage(prefix string) error {
+	name, err := t.ident()
+	if err != nil {
+		return err
+	}
+	msg := &Message{Name: prefix + name}
+	t.file.Messages = append(t.file.Messages, msg)
+	err = t.expect("{")
+	if err != nil {
+		return err
+	}
+	for t.peek() != "}" {
+		switch t.peek() {
+		case "":
+			return t.errorf("unexpected end of file in message %s", msg.Name)
+		case "message":
+			t.pos++
+			err = t.parseMessage(msg.Name + "_")
+		case "enum":
+			t.pos++
+			err = t.parseEnum(msg.Name + "_")
+		case "option", "reserved", "extensions":
+			t.skipStatement()
+		case "oneof":
+			t.pos++
+			_, err = t.ident()
+			if err == nil {
+				err = t.expect("{")
+			}
+			for err == nil && t.peek() != "}" {
+				var field *Field
+				field, err = t.parseField()
+				if err == nil {
+					msg.Fields = append(msg.Fields, field)
+				}
+			}
+			if err == nil {
+				t.pos++
+			}
+		case ";":
+			t.pos++
+		default:
+			var field *Field
+			field, err = t.parseField()
+			if err == nil {
+				msg.Fields = append(msg.Fields, field)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	t.pos++
+	return nil
+}
+
+func (t *parser) parseField() (*Field, error) {
+	field := new(Field)
+	switch t.peek() {
+	case "repeated":
+		field.Repeated = true
+		t.pos++
+	case "optional", "required":
+		t.pos++
+	}
+	if t.peek() == "map" {
+		t.pos++
+		field.IsMap = true
+		err := t.expect("<")
+		if err != nil {
+			return nil, err
+		}
+		field.KeyType, err = t.ident()
+		if err != nil {
+			return nil, err
+		}
+		err = t.expect(",")
+		if err != nil {
+			return nil, err
+		}
+		field.Type, err = t.ident()
+		if err != nil {
+			return nil, err
+		}
+		err = t.expect(">")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		field.Type, err = t.ident()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	field.Name, err = t.ident()
+	if err != nil {
+		return nil, err
+	}
+	err = t.expect("=")
+	if err != nil {
+		return nil, err
+	}
+	field.Number, err = t.number()
+	if err != nil {
+		return nil, err
+	}
+	if t.peek() == "[" {
+		for t.peek() != "]" && t.peek() != "" {
+			t.pos++
+		}
+		t.pos++
+	}
+	return field, t.expect(";")
+}
+
+func (t *parser) parseEnum(prefix string) error {
+	name, err := t.ident()
+	if err != nil {
+		return err
+	}
+	enum := &Enum{Name: prefix + name}
+	t.file.Enums = append(t.file.Enums, enum)
+	err = t.expect("{")
+	if err != nil {
+		return err
+	}
+	for t.peek() != "}" {
+		switch t.peek() {
+		case "":
+			return t.errorf("unexpected end of file in enum %s", enum.Name)
+		case "option", "reserved":
+			t.skipStatement()
+		case ";":
+			t.pos++
+		default:
+			value := new(EnumValue)
+			value.Name, err = t.ident()
+			if err != nil {
+				return err
+			}
+			err = t.expect("=")
+			if err != nil {
+				return err
+			}
+			value.Number, err = t.number()
+			if err != nil {
+				return err
+			}
+			if t.peek() == "[" {
+				for t.peek() != "]" && t.peek() != "" {
+					t.pos++
+				}
+				t.pos++
+			}
+			err = t.expect(";")
+			if err != nil {
+				return err
+			}
+			enum.Values = append(enum.Values, value)
+		}
+	}
+	t.pos++
+	return nil
+}
+
+func (t *parser) parseService() error {
+	name, err := t.ident()
+	if err != nil {
+		return err
+	}
+	service := &Service{Name: name}
+	t.file.Services = append(t.file.Services, service)
+	err = t.expect("{")
+	if err != nil {
+		return err
+	}
+	for t.peek() != "}" {
+		switch t.peek() {
+		case "":
+			return t.errorf("unexpected end of file in service %s", service.Name)
+		case "option":
+			t.skipStatement()
+		case ";":
+			t.pos++
+		case "rpc":
+			t.pos++
+			method := new(Method)
+			method.Name, err = t.ident()
+			if err != nil {
+				return err
+			}
+			method.Request, err = t.methodType()
+			if err != nil {
+				return err
+			}
+			err = t.expect("returns")
+			if err != nil {
+				return err
+			}
+			method.Response, err = t.methodType()
+			if err != nil {
+				return err
+			}
+			if t.peek() == "{" {
+				err = t.skipBlock()
+			} else {
+				err = t.expect(";")
+			}
+			if err != nil {
+				return err
+			}
+			service.Methods = append(service.Methods, method)
+		default:
+			return t.errorf("unexpected %q in service %s", t.peek(), service.Name)
+		}
+	}
+	t.pos++
+	return nil
+}
+
+func (t *parser) methodType() (string, error) {
+	err := t.expect("(")
+	if err != nil {
+		return "", err
+	}
+	if t.peek() == "stream" {
+		//流式调用请使用Channel实现
+		return "", t.errorf("streaming rpc is not supported, use rpc channels instead")
+	}
+	name, err := t.ident()
+	if err != nil {
+		return "", err
+	}
+	return name, t.expect(")")
+}
+
+// resolve 将引用的类型名转换为扁平化后的名称,嵌套类型使用下划线连接
+func (t *File) resolve(name string) (string, bool) {
+	name = strings.TrimPrefix(name, t.Package+".")
+	flat := strings.ReplaceAll(name, ".", "_")
+	for _, msg := range t.Messages {
+		if msg.Name == flat || strings.HasSuffix(msg.Name, "_"+flat) {
+			return msg.Name, true
+		}
+	}
+	for _, enum := range t.Enums {
+		if enum.Name == flat || strings.HasSuffix(enum.Name, "_"+flat) {
+			return enum.Name, true
+		}
+	}
+	return "", false
+}
+
+func (t *File) isEnum(name string) bool {
+	for _, enum := range t.Enums {
+		if enum.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// check 校验引用的类型都已定义以及method名称不重复
+func (t *File) check() error {
+	for _, msg := range t.Messages {
+		for _, field := range msg.Fields {
+			if _, ok := scalarTypes[field.Type]; ok {
+				continue
+			}
+			resolved, ok := t.resolve(field.Type)
+			if !ok {
+				return fmt.Errorf("message %s field %s: unknown type %s", msg.Name, field.Name, field.Type)
+			}
+			field.Type = resolved
+		}
+	}
+	methods := make(map[string]string)
+	for _, service := range t.Services {
+		for _, method := range service.Methods {
+			if other, ok := methods[method.Name]; ok {
+				//rpc的method名称是全局的,不同服务中也不能重复
+				return fmt.Errorf("method %s is declared in both %s and %s", method.Name, other, service.Name)
+			}
+			methods[method.Name] = service.Name
+			for _, typeName := range []*string{&method.Request, &method.Response} {
+				resolved, ok := t.resolve(*typeName)
+				if !ok || t.isEnum(resolved) {
+					return fmt.Errorf("method %s.%s: unknown message %s", service.Name, method.Name, *typeName)
+				}
+				*typeName = resolved
+			}
+		}
+	}
+	return nil
+}
+
+var scalarTypes = map[string]struct{}{
+	"double": {}, "float": {},
+	"int32": {}, "int64": {}, "uint32": {}, "uint64": {},
+	"sint32": {}, "sint64": {}, "fixed32": {}, "fixed64": {}, "sfixed32": {}, "sfixed64": {},
+	"bool": {}, "string": {}, "bytes": {},
+}
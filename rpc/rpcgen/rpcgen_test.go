@@ -0,0 +1,97 @@
+package rpcgen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	src, err := os.ReadFile("testdata/terminal.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := Parse(string(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Services) != 1 || len(file.Services[0].Methods) != 2 {
+		t.Fatalf("unexpected services: %+v", file.Services)
+	}
+	goCode, err := GenerateGo(file, "", "terminal.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//gofmt会对齐结构体字段,比较前统一空白字符
+	normalized := strings.Join(strings.Fields(string(goCode)), " ")
+	for _, expected := range []string{
+		"package terminal",
+		"TerminalServiceMethodOpenSession = \"OpenSession\"",
+		"func (t *TerminalServiceClient) Resize(req *ResizeRequest) (*Empty, error)",
+		"func RegisterTerminalServiceServer(conn rpc.Conn, server TerminalServiceServer)",
+		"conn.Describe(TerminalServiceMethodResize, rpc.Schema{Codec: rpc.CodecJson, Request: \"ResizeRequest\", Response: \"Empty\"})",
+		"SessionId int64",
+		"`json:\"sessionId,omitempty\"`",
+		"Size *OpenRequest_Size",
+		"Mode Mode",
+		"Env map[string]string",
+	} {
+		if !strings.Contains(normalized, expected) {
+			t.Errorf("generated go code does not contain %q:\n%s", expected, goCode)
+		}
+	}
+	checkCompile(t, goCode)
+
+	tsCode := string(GenerateTs(file, "terminal.proto"))
+	for _, expected := range []string{
+		"export interface OpenResponse {\n  sessionId?: number\n  banner?: string\n}",
+		"resize(req: ResizeRequest): Promise<Empty>",
+		"env?: { [key: string]: string }",
+	} {
+		if !strings.Contains(tsCode, expected) {
+			t.Errorf("generated ts code does not contain %q:\n%s", expected, tsCode)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, src := range []string{
+		"service A { rpc Foo(Missing) returns (Missing); }",
+		"message A {} service S { rpc Foo(stream A) returns (A); }",
+		"message A {} service S { rpc Foo(A) returns (A); } service T { rpc Foo(A) returns (A); }",
+		"message A { Unknown x = 1; }",
+	} {
+		_, err := Parse(src)
+		if err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
+
+// checkCompile 将生成的代码写入模块内的临时包,用go build和go vet检查
+func checkCompile(t *testing.T, goCode []byte) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	//以_开头的目录不会被./...匹配,避免影响其它包的构建
+	dir, err := os.MkdirTemp(".", "_gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	err = os.WriteFile(filepath.Join(dir, "terminal.go"), goCode, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"build", "./" + dir}, {"vet", "./" + dir}} {
+		output, err := exec.Command(goBin, args...).CombinedOutput()
+		if err != nil {
+			t.Errorf("go %s failed: %v\n%s\n%s", args[0], err, output, goCode)
+		}
+	}
+}
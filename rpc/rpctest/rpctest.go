@@ -0,0 +1,65 @@
+package rpctest
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// NewConn 通过httptest建立一对websocket连接,register在服务端启动处理循环前注册服务,
+// 返回已启动处理循环的客户端Conn,测试结束时关闭
+func NewConn(t testing.TB, register func(conn rpc.Conn)) rpc.Conn {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := rpc.Accept(w, req, context.Background(), 1<<20)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		register(conn)
+		_ = conn.StartHandler()
+	}))
+	t.Cleanup(httpServer.Close)
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := rpc.NewConn(wsConn, context.Background())
+	go func() {
+		_ = conn.StartHandler()
+	}()
+	t.Cleanup(func() {
+		_ = conn.Close(errors.New("test finished"))
+	})
+	return conn
+}
+
+// NewEchoServer 启动一个回显收到数据的tcp服务,测试结束时关闭
+func NewEchoServer(t testing.TB) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer netConn.Close()
+				_, _ = io.Copy(netConn, netConn)
+			}()
+		}
+	}()
+	return listener
+}
@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	cmap "github.com/orcaman/concurrent-map/v2"
+	"github.com/wonderivan/logger"
+	"net/http"
+	"time"
+)
+
+const TransportWebsocket = "websocket"
+
+// TransportPolling http长轮询,用于代理不支持websocket的环境
+const TransportPolling = "polling"
+
+// TransportSSE 上行使用http请求,下行使用Server-Sent Events
+const TransportSSE = "sse"
+
+type openResult struct {
+	SessionId string `json:"sessionId"`
+	PollWait  int64  `json:"pollWait"`
+}
+
+// Server 在同一个http入口上接受websocket以及轮询/SSE降级连接,新连接在OnConn中注册handler后开始处理
+type Server struct {
+	Ctx       context.Context
+	ReadLimit int64
+	// Transports 允许的传输方式,为空时只允许websocket
+	Transports []string
+	// PollWait 长轮询最长等待时间,同时也是SSE的保活间隔
+	PollWait time.Duration
+	// SessionTimeout 轮询会话超过该时间没有任何请求则关闭
+	SessionTimeout time.Duration
+	OnConn         func(conn Conn)
+	sessions       cmap.ConcurrentMap[*pollSession]
+}
+
+func NewServer(ctx context.Context, onConn func(conn Conn), transports ...string) *Server {
+	return &Server{
+		Ctx:            ctx,
+		ReadLimit:      64 << 20,
+		Transports:     transports,
+		PollWait:       25 * time.Second,
+		SessionTimeout: time.Minute,
+		OnConn:         onConn,
+		sessions:       cmap.New[*pollSession](),
+	}
+}
+
+func (t *Server) allow(transport string) bool {
+	if len(t.Transports) == 0 {
+		return transport == TransportWebsocket
+	}
+	for _, v := range t.Transports {
+		if v == transport {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if websocket.IsWebSocketUpgrade(req) {
+		if !t.allow(TransportWebsocket) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, err := Accept(w, req, t.Ctx, t.ReadLimit)
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+		t.OnConn(conn)
+		_ = conn.StartHandler()
+		return
+	}
+	transport := req.URL.Query().Get("transport")
+	if (transport != TransportPolling && transport != TransportSSE) || !t.allow(transport) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t.servePoll(w, req, req.URL.Query().Get("action"), transport == TransportSSE)
+}
+
+func (t *Server) openSession(w http.ResponseWriter) {
+	session := newPollSession(uuid.NewString(), t.SessionTimeout)
+	t.sessions.Set(session.id, session)
+	conn := NewTransportConn(session, t.Ctx, IdSpaceLower)
+	t.OnConn(conn)
+	go func() {
+		_ = conn.StartHandler()
+		//保留一个轮询周期,让客户端能够取到关闭原因
+		time.AfterFunc(t.PollWait, func() {
+			t.sessions.Remove(session.id)
+		})
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(openResult{SessionId: session.id, PollWait: t.PollWait.Milliseconds()})
+}
@@ -0,0 +1,74 @@
+package rpc
+
+import "sort"
+
+type MethodStats struct {
+	Method   string `json:"method"`
+	Received uint64 `json:"received"`
+	Rejected uint64 `json:"rejected"`
+	InFlight int64  `json:"inFlight"`
+	Queued   int    `json:"queued"`
+	Limit    *Limit `json:"limit,omitempty"`
+}
+
+// Stats 连接的运行统计,用于诊断
+type Stats struct {
+	Received     uint64              `json:"received"`
+	Rejected     uint64              `json:"rejected"`
+	InFlight     int64               `json:"inFlight"`
+	Channels     int                 `json:"channels"`
+	Limit        *Limit              `json:"limit,omitempty"`
+	Methods      []MethodStats       `json:"methods"`
+	OpenChannels []ChannelStats      `json:"openChannels"`
+	Groups       []ChannelGroupStats `json:"groups"`
+}
+
+func (t *conn) Stats() Stats {
+	stats := Stats{
+		Channels:     t.channelMap.Count(),
+		Methods:      make([]MethodStats, 0, t.counterMap.Count()),
+		OpenChannels: make([]ChannelStats, 0, t.channelMap.Count()),
+	}
+	t.channelMap.IterCb(func(key string, v *Channel) {
+		stats.OpenChannels = append(stats.OpenChannels, v.Stats())
+	})
+	sort.Slice(stats.OpenChannels, func(i, j int) bool {
+		return stats.OpenChannels[i].CreatedAt.Before(stats.OpenChannels[j].CreatedAt)
+	})
+	stats.Groups = make([]ChannelGroupStats, 0, t.groupMap.Count())
+	t.groupMap.IterCb(func(key string, v *ChannelGroup) {
+		stats.Groups = append(stats.Groups, v.Stats())
+	})
+	sort.Slice(stats.Groups, func(i, j int) bool {
+		return stats.Groups[i].Id < stats.Groups[j].Id
+	})
+	connLimiter := t.connLimiter.Load()
+	if connLimiter != nil {
+		stats.Limit = &connLimiter.limit
+	}
+	t.counterMap.IterCb(func(method string, counter *methodCounter) {
+		methodStats := MethodStats{
+			Method:   method,
+			Received: counter.received.Load(),
+			Rejected: counter.rejected.Load(),
+			InFlight: counter.inFlight.Load(),
+		}
+		handle, ok := t.handleMap.Get(method)
+		if ok && handle.queues != nil {
+			methodStats.Queued = int(handle.queues.pending.Load())
+		}
+		methodLimiter, ok := t.limiterMap.Get(method)
+		if ok {
+			methodStats.Limit = &methodLimiter.limit
+			methodStats.Queued += len(methodLimiter.queue)
+		}
+		stats.Received += methodStats.Received
+		stats.Rejected += methodStats.Rejected
+		stats.InFlight += methodStats.InFlight
+		stats.Methods = append(stats.Methods, methodStats)
+	})
+	sort.Slice(stats.Methods, func(i, j int) bool {
+		return stats.Methods[i].Method < stats.Methods[j].Method
+	})
+	return stats
+}
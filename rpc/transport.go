@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Transport 承载packet帧的底层传输,一次ReadFrame/WriteFrame对应一个完整的帧,WriteFrame需要支持并发调用
+type Transport interface {
+	ReadFrame() (io.Reader, error)
+	WriteFrame(frame []byte) error
+	// Ping 由连接每秒调用一次,用于保活和检测断线
+	Ping() error
+	Close(code int, reason string) error
+}
+
+type wsTransport struct {
+	wsConn    *websocket.Conn
+	writeLock *sync.Mutex
+}
+
+func NewWebsocketTransport(wsConn *websocket.Conn) Transport {
+	return &wsTransport{wsConn: wsConn, writeLock: new(sync.Mutex)}
+}
+
+func (t *wsTransport) ReadFrame() (io.Reader, error) {
+	msgType, r, err := t.wsConn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	if msgType != websocket.BinaryMessage {
+		return nil, errors.New("read failure")
+	}
+	return r, nil
+}
+
+func (t *wsTransport) WriteFrame(frame []byte) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	return t.wsConn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+func (t *wsTransport) Ping() error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	return t.wsConn.WriteMessage(websocket.PingMessage, []byte("ping"))
+}
+
+func (t *wsTransport) Close(code int, reason string) error {
+	msgBytes := []byte(reason)
+	//ws关闭原因最大125字节，超过120字节截取并省略
+	if len(msgBytes) > 120 {
+		msgBytes = msgBytes[0:120]
+		//utf-8为非定长编码，按固定长度截取字节最后一个字编码可能被破坏需要删除，并且在最后添加省略号
+		reason = strings.ToValidUTF8(string(msgBytes), "") + ".."
+	}
+	//1005、1006、1015只用于本地表示状态,不能出现在关闭帧中
+	if code == websocket.CloseNoStatusReceived || code == websocket.CloseAbnormalClosure || code == websocket.CloseTLSHandshake {
+		code = websocket.CloseNoStatusReceived
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	return t.wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
+
+// aborter 支持不发送关闭帧直接断开的传输
+type aborter interface {
+	abort() error
+}
+
+// writeCompressor 支持关闭传输层压缩的传输,开启按包压缩后不再重复压缩
+type writeCompressor interface {
+	setWriteCompression(enable bool)
+}
+
+func (t *wsTransport) setWriteCompression(enable bool) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	t.wsConn.EnableWriteCompression(enable)
+}
+
+// abort 直接关闭底层连接,不发送关闭帧
+func (t *wsTransport) abort() error {
+	return t.wsConn.Close()
+}
@@ -0,0 +1,59 @@
+package forward
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Allowlist 允许转发的目标,每项为host:port;host可以是主机名、IP、CIDR或*,
+// port可以是端口、端口范围(如8000-9000)或*。例如"127.0.0.1:5432"、"localhost:*"、"10.0.0.0/8:22"
+type Allowlist []string
+
+// Allow 判断目标是否允许转发,host为请求中的主机名或IP,ip为其解析得到的地址之一
+func (t Allowlist) Allow(host string, ip net.IP, port int) bool {
+	for _, entry := range t {
+		ruleHost, rulePort, err := net.SplitHostPort(entry)
+		if err != nil {
+			continue
+		}
+		if matchPort(rulePort, port) && matchHost(ruleHost, host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(rule string, host string, ip net.IP) bool {
+	if rule == "*" {
+		return true
+	}
+	_, cidr, err := net.ParseCIDR(rule)
+	if err == nil {
+		return ip != nil && cidr.Contains(ip)
+	}
+	ruleIp := net.ParseIP(rule)
+	if ruleIp != nil {
+		return ip != nil && ruleIp.Equal(ip)
+	}
+	return strings.EqualFold(rule, host)
+}
+
+func matchPort(rule string, port int) bool {
+	if rule == "*" {
+		return true
+	}
+	from, to, isRange := strings.Cut(rule, "-")
+	min, err := strconv.Atoi(from)
+	if err != nil {
+		return false
+	}
+	max := min
+	if isRange {
+		max, err = strconv.Atoi(to)
+		if err != nil {
+			return false
+		}
+	}
+	return port >= min && port <= max
+}
@@ -0,0 +1,70 @@
+package forward
+
+import (
+	"errors"
+	"github.com/wonderivan/logger"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"net"
+)
+
+// Listener 监听本地端口,每个接受的连接打开一个转发channel到远程的目标
+type Listener struct {
+	listener net.Listener
+	conn     rpc.Conn
+	target   Target
+}
+
+// Listen 在localAddr上监听并转发到远程的target,rpc连接关闭时停止监听
+func Listen(conn rpc.Conn, localAddr string, target string) (*Listener, error) {
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	t := &Listener{
+		listener: listener,
+		conn:     conn,
+		target:   Target{Address: target},
+	}
+	go t.acceptLoop()
+	return t, nil
+}
+
+func (t *Listener) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Close 停止监听,已经建立的转发连接不受影响
+func (t *Listener) Close() error {
+	return t.listener.Close()
+}
+
+func (t *Listener) acceptLoop() {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-t.conn.Ctx().Done():
+			_ = t.listener.Close()
+		case <-done:
+		}
+	}()
+	for {
+		netConn, err := t.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error(err)
+			}
+			return
+		}
+		go t.forward(netConn)
+	}
+}
+
+func (t *Listener) forward(netConn net.Conn) {
+	channel, err := t.conn.OpenChannel(Method, t.target)
+	if err != nil {
+		_ = netConn.Close()
+		return
+	}
+	Pipe(channel, netConn, nil)
+}
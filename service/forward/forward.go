@@ -0,0 +1,171 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Method 打开转发channel的method,打开数据为Target;channel中的每条消息都是原始字节
+const Method = "Forward"
+
+// DefaultDialTimeout Service未设置DialTimeout时连接目标的超时时间
+const DefaultDialTimeout = 10 * time.Second
+
+type Target struct {
+	// Address 目标地址,格式为host:port
+	Address string `json:"address"`
+	// Ack 为true时连接目标成功后先发送一条空消息,客户端据此确认连接结果,例如回复socks请求
+	Ack bool `json:"ack,omitempty"`
+}
+
+// Traffic 一个转发连接的流量统计,Sent为从目标读取并发送到channel的字节数,Received为从channel写入目标的字节数
+type Traffic struct {
+	Sent     atomic.Int64
+	Received atomic.Int64
+}
+
+// Service 将channel转发到本机可以访问的tcp地址
+type Service struct {
+	// Allowlist 允许转发的目标,为空时拒绝所有目标
+	Allowlist Allowlist
+	// Allow 在Allowlist之后额外校验目标,返回错误时拒绝转发
+	Allow       func(conn rpc.Conn, target *Target) error
+	DialTimeout time.Duration
+}
+
+// Register 在连接上注册转发服务
+func Register(conn rpc.Conn, service *Service) {
+	conn.HandleChannel(Method, service.Serve)
+	conn.Describe(Method, rpc.Schema{Codec: rpc.CodecJson, Request: "Target"})
+}
+
+// Serve 连接目标并在channel和目标之间双向复制数据,任意一方关闭后关闭另一方
+func (t *Service) Serve(conn rpc.Conn, p packet.Packet, channel *rpc.Channel) {
+	var target Target
+	err := p.Data(&target)
+	if err != nil {
+		_ = channel.Close(rpc.CloseFailure, err.Error())
+		return
+	}
+	if t.Allow != nil {
+		err = t.Allow(conn, &target)
+		if err != nil {
+			_ = channel.Close(rpc.CloseFailure, err.Error())
+			return
+		}
+	}
+	netConn, err := t.Dial(channel.GetContext(), target.Address)
+	if err != nil {
+		_ = channel.Close(rpc.CloseFailure, err.Error())
+		return
+	}
+	if target.Ack {
+		err = channel.Send([]byte{})
+		if err != nil {
+			_ = netConn.Close()
+			return
+		}
+	}
+	Pipe(channel, netConn, nil)
+}
+
+// Dial 按Allowlist校验并连接目标;主机名解析后只连接被允许的地址,避免解析结果变化绕过限制
+func (t *Service) Dial(ctx context.Context, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %s", portStr)
+	}
+	var ips []net.IP
+	ip := net.ParseIP(host)
+	if ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	timeout := t.DialTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	err = fmt.Errorf("target %s is not allowed", address)
+	for _, ip := range ips {
+		if !t.Allowlist.Allow(host, ip, port) {
+			continue
+		}
+		var netConn net.Conn
+		netConn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), portStr))
+		if err == nil {
+			return netConn, nil
+		}
+	}
+	return nil, err
+}
+
+var bufferPool = sync.Pool{New: func() any {
+	b := make([]byte, 32*1024)
+	return &b
+}}
+
+// Pipe 在channel和网络连接之间双向复制数据直到任意一方关闭,返回时两者都已关闭;traffic可以为nil
+func Pipe(channel *rpc.Channel, netConn net.Conn, traffic *Traffic) {
+	if traffic == nil {
+		traffic = new(Traffic)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(buf)
+		for {
+			n, err := netConn.Read(*buf)
+			if n > 0 {
+				sendErr := channel.Send((*buf)[:n])
+				if sendErr != nil {
+					break
+				}
+				traffic.Sent.Add(int64(n))
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+					_ = channel.Close(rpc.CloseNormal, "connection closed")
+				} else {
+					_ = channel.Close(rpc.CloseFailure, err.Error())
+				}
+				break
+			}
+		}
+	}()
+	for {
+		p, err := channel.Read()
+		if err != nil {
+			break
+		}
+		n, err := netConn.Write(p.Bytes())
+		traffic.Received.Add(int64(n))
+		if err != nil {
+			_ = channel.Close(rpc.CloseFailure, err.Error())
+			break
+		}
+	}
+	_ = netConn.Close()
+	<-done
+}
@@ -0,0 +1,110 @@
+package forward
+
+import (
+	"errors"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/rpctest"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newForwardConn(t *testing.T, service *Service) rpc.Conn {
+	return rpctest.NewConn(t, func(conn rpc.Conn) {
+		Register(conn, service)
+	})
+}
+
+func TestAllowlist(t *testing.T) {
+	allowlist := Allowlist{"127.0.0.1:5432", "localhost:*", "10.0.0.0/8:8000-9000", "*:443", "[::1]:22"}
+	cases := []struct {
+		host    string
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"127.0.0.1", "127.0.0.1", 5432, true},
+		{"127.0.0.1", "127.0.0.1", 5433, false},
+		{"LOCALHOST", "127.0.0.1", 3306, true},
+		{"db.internal", "10.1.2.3", 8080, true},
+		{"db.internal", "10.1.2.3", 9001, false},
+		{"192.168.1.1", "192.168.1.1", 8080, false},
+		{"example.com", "93.184.216.34", 443, true},
+		{"::1", "::1", 22, true},
+	}
+	for _, c := range cases {
+		if allowlist.Allow(c.host, net.ParseIP(c.ip), c.port) != c.allowed {
+			t.Errorf("%s(%s):%d expected allowed=%v", c.host, c.ip, c.port, c.allowed)
+		}
+	}
+	if (Allowlist{}).Allow("127.0.0.1", net.ParseIP("127.0.0.1"), 80) {
+		t.Error("empty allowlist should deny all targets")
+	}
+}
+
+func TestForward(t *testing.T) {
+	echo := rpctest.NewEchoServer(t)
+	conn := newForwardConn(t, &Service{Allowlist: Allowlist{echo.Addr().String()}})
+	listener, err := Listen(conn, "127.0.0.1:0", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	//每个连接使用独立的channel
+	for i := 0; i < 3; i++ {
+		local, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = local.SetDeadline(time.Now().Add(5 * time.Second))
+		data := []byte(strings.Repeat("hello forward ", 10000))
+		go func() {
+			_, _ = local.Write(data)
+		}()
+		actual := make([]byte, len(data))
+		_, err = io.ReadFull(local, actual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != string(data) {
+			t.Fatal("unexpected echo data")
+		}
+		_ = local.Close()
+	}
+}
+
+func TestForwardNotAllowed(t *testing.T) {
+	echo := rpctest.NewEchoServer(t)
+	conn := newForwardConn(t, &Service{Allowlist: Allowlist{"127.0.0.1:1"}})
+	channel, err := conn.OpenChannel(Method, Target{Address: echo.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = channel.ReadTimeout(5 * time.Second)
+	if !errors.Is(err, rpc.ChannelClosedError) {
+		t.Fatalf("expected ChannelClosedError, got %v", err)
+	}
+	closeInfo := channel.CloseInfo()
+	if closeInfo == nil || closeInfo.Code != rpc.CloseFailure || !strings.Contains(closeInfo.Reason, "not allowed") {
+		t.Errorf("unexpected close info: %+v", closeInfo)
+	}
+
+	//本地连接随channel关闭
+	listener, err := Listen(conn, "127.0.0.1:0", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	local, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = local.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = local.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
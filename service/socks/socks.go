@@ -0,0 +1,384 @@
+package socks
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/wonderivan/logger"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/service/forward"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	version5    = 0x05
+	authVersion = 0x01
+
+	methodNoAuth       = 0x00
+	methodPassword     = 0x02
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	atypIpv4   = 0x01
+	atypDomain = 0x03
+	atypIpv6   = 0x04
+)
+
+// 回复码,见RFC 1928
+const (
+	replySucceeded           = 0x00
+	replyGeneralFailure      = 0x01
+	replyNotAllowed          = 0x02
+	replyConnectionRefused   = 0x05
+	replyCommandNotSupported = 0x07
+	replyAddressNotSupported = 0x08
+)
+
+// handshakeTimeout 完成认证和请求的超时时间,之后由隧道两端决定连接的生命周期
+const handshakeTimeout = 10 * time.Second
+
+// TunnelStats 一个socks隧道的流量统计,Sent为客户端发往目标的字节数,Received为目标返回的字节数
+type TunnelStats struct {
+	Id        uint32    `json:"id"`
+	User      string    `json:"user,omitempty"`
+	Client    string    `json:"client"`
+	Target    string    `json:"target"`
+	CreatedAt time.Time `json:"createdAt"`
+	Sent      int64     `json:"sent"`
+	Received  int64     `json:"received"`
+}
+
+type tunnel struct {
+	stats   TunnelStats
+	traffic forward.Traffic
+}
+
+func (t *tunnel) snapshot() TunnelStats {
+	stats := t.stats
+	stats.Sent = t.traffic.Sent.Load()
+	stats.Received = t.traffic.Received.Load()
+	return stats
+}
+
+// Server socks5代理,每个CONNECT请求在rpc连接上打开一个forward channel,由对端连接目标并转发数据
+type Server struct {
+	conn rpc.Conn
+	// Credentials 用户名到密码的映射,为空时不需要认证
+	Credentials map[string]string
+	// Allow 允许的目标,为空时允许所有目标;目标为域名时按域名匹配,对端的Allowlist仍然生效
+	Allow forward.Allowlist
+	// Deny 拒绝的目标,优先于Allow;目标为域名时还会在本地解析,任一解析结果匹配或解析失败都会拒绝
+	Deny forward.Allowlist
+	// OnTunnelClose 隧道关闭时回调最终的流量统计
+	OnTunnelClose func(stats TunnelStats)
+
+	tunnelSerial atomic.Uint32
+	lock         sync.Mutex
+	tunnels      map[uint32]*tunnel
+}
+
+func NewServer(conn rpc.Conn) *Server {
+	return &Server{
+		conn:    conn,
+		tunnels: make(map[uint32]*tunnel),
+	}
+}
+
+// ListenAndServe 在addr上监听socks5连接
+func (t *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return t.Serve(listener)
+}
+
+// Serve 接受socks5连接直到listener或rpc连接关闭
+func (t *Server) Serve(listener net.Listener) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-t.conn.Ctx().Done():
+			_ = listener.Close()
+		case <-done:
+		}
+	}()
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go t.handle(netConn)
+	}
+}
+
+// Tunnels 返回当前所有隧道的流量统计
+func (t *Server) Tunnels() []TunnelStats {
+	t.lock.Lock()
+	stats := make([]TunnelStats, 0, len(t.tunnels))
+	for _, item := range t.tunnels {
+		stats = append(stats, item.snapshot())
+	}
+	t.lock.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Id < stats[j].Id
+	})
+	return stats
+}
+
+func (t *Server) handle(netConn net.Conn) {
+	_ = netConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	user, err := t.authenticate(netConn)
+	if err != nil {
+		_ = netConn.Close()
+		return
+	}
+	address, err := readRequest(netConn)
+	if err != nil {
+		var replyErr *replyError
+		if errors.As(err, &replyErr) {
+			_ = writeReply(netConn, replyErr.code)
+		}
+		_ = netConn.Close()
+		return
+	}
+	if !t.allowed(address) {
+		_ = writeReply(netConn, replyNotAllowed)
+		_ = netConn.Close()
+		return
+	}
+	channel, err := t.conn.OpenChannel(forward.Method, forward.Target{Address: address, Ack: true})
+	if err != nil {
+		_ = writeReply(netConn, replyGeneralFailure)
+		_ = netConn.Close()
+		return
+	}
+	//等待对端确认连接目标的结果
+	_, err = channel.ReadTimeout(handshakeTimeout)
+	if err != nil {
+		_ = channel.Close(rpc.CloseInterrupt, "socks handshake failed")
+		_ = writeReply(netConn, failureReply(channel))
+		_ = netConn.Close()
+		return
+	}
+	err = writeReply(netConn, replySucceeded)
+	if err != nil {
+		_ = channel.Close(rpc.CloseInterrupt, err.Error())
+		_ = netConn.Close()
+		return
+	}
+	_ = netConn.SetDeadline(time.Time{})
+
+	item := &tunnel{stats: TunnelStats{
+		Id:        t.tunnelSerial.Add(1),
+		User:      user,
+		Client:    netConn.RemoteAddr().String(),
+		Target:    address,
+		CreatedAt: time.Now(),
+	}}
+	t.lock.Lock()
+	t.tunnels[item.stats.Id] = item
+	t.lock.Unlock()
+	forward.Pipe(channel, netConn, &item.traffic)
+	t.lock.Lock()
+	delete(t.tunnels, item.stats.Id)
+	t.lock.Unlock()
+	if t.OnTunnelClose != nil {
+		t.OnTunnelClose(item.snapshot())
+	}
+}
+
+func (t *Server) allowed(address string) bool {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(portStr)
+	ip := net.ParseIP(host)
+	if t.Deny.Allow(host, ip, port) {
+		return false
+	}
+	if ip == nil && len(t.Deny) > 0 && t.denyResolved(host, port) {
+		return false
+	}
+	return len(t.Allow) == 0 || t.Allow.Allow(host, ip, port)
+}
+
+// denyResolved 检查域名解析得到的地址是否被Deny拒绝,避免用域名绕过ip和网段规则
+func (t *Server) denyResolved(host string, port int) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		logger.Warn("socks failed to resolve %s: %s", host, err)
+		return true
+	}
+	for _, addr := range addrs {
+		if t.Deny.Allow(host, addr.IP, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func failureReply(channel *rpc.Channel) byte {
+	closeInfo := channel.CloseInfo()
+	if closeInfo != nil && strings.Contains(closeInfo.Reason, "not allowed") {
+		return replyNotAllowed
+	}
+	if closeInfo != nil {
+		return replyConnectionRefused
+	}
+	return replyGeneralFailure
+}
+
+// authenticate 协商认证方式,配置了Credentials时使用用户名密码认证(RFC 1929),返回用户名
+func (t *Server) authenticate(netConn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(netConn, header)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != version5 {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(netConn, methods)
+	if err != nil {
+		return "", err
+	}
+	method := byte(methodNoAuth)
+	if len(t.Credentials) > 0 {
+		method = methodPassword
+	}
+	found := false
+	for _, m := range methods {
+		if m == method {
+			found = true
+		}
+	}
+	if !found {
+		_, _ = netConn.Write([]byte{version5, methodNoAcceptable})
+		return "", errors.New("no acceptable authentication method")
+	}
+	_, err = netConn.Write([]byte{version5, method})
+	if err != nil || method == methodNoAuth {
+		return "", err
+	}
+
+	user, password, err := readCredentials(netConn)
+	if err != nil {
+		return "", err
+	}
+	expected, ok := t.Credentials[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		_, _ = netConn.Write([]byte{authVersion, 0x01})
+		logger.Warn("socks authentication failed for user %s from %s", user, netConn.RemoteAddr())
+		return "", errors.New("authentication failed")
+	}
+	_, err = netConn.Write([]byte{authVersion, 0x00})
+	return user, err
+}
+
+func readCredentials(r io.Reader) (string, string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", "", err
+	}
+	if header[0] != authVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", header[0])
+	}
+	user := make([]byte, header[1])
+	_, err = io.ReadFull(r, user)
+	if err != nil {
+		return "", "", err
+	}
+	_, err = io.ReadFull(r, header[:1])
+	if err != nil {
+		return "", "", err
+	}
+	password := make([]byte, header[0])
+	_, err = io.ReadFull(r, password)
+	if err != nil {
+		return "", "", err
+	}
+	return string(user), string(password), nil
+}
+
+type replyError struct {
+	code byte
+	msg  string
+}
+
+func (t *replyError) Error() string {
+	return t.msg
+}
+
+// readRequest 读取CONNECT请求,返回host:port形式的目标地址
+func readRequest(r io.Reader) (string, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != version5 {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	if header[1] != cmdConnect {
+		return "", &replyError{replyCommandNotSupported, fmt.Sprintf("unsupported command %d", header[1])}
+	}
+	var host string
+	switch header[3] {
+	case atypIpv4, atypIpv6:
+		size := net.IPv4len
+		if header[3] == atypIpv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		_, err = io.ReadFull(r, ip)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		_, err = io.ReadFull(r, header[:1])
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, header[0])
+		_, err = io.ReadFull(r, domain)
+		if err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", &replyError{replyAddressNotSupported, fmt.Sprintf("unsupported address type %d", header[3])}
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeReply 回复请求结果,隧道的本地地址对客户端没有意义,统一回复0.0.0.0:0
+func writeReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{version5, code, 0x00, atypIpv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
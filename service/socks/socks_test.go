@@ -0,0 +1,188 @@
+package socks
+
+import (
+	"encoding/binary"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/rpctest"
+	"github.com/xiwh/hexhub-agent-plugin/service/forward"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSocksServer(t *testing.T, service *forward.Service, setup func(server *Server)) string {
+	conn := rpctest.NewConn(t, func(conn rpc.Conn) {
+		forward.Register(conn, service)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(conn)
+	setup(server)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return listener.Addr().String()
+}
+
+// dialSocks 完成socks5握手并发送CONNECT请求,返回回复码
+func dialSocks(t *testing.T, proxy string, user string, password string, target string) (net.Conn, byte) {
+	netConn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = netConn.Close()
+	})
+	_ = netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	method := byte(methodNoAuth)
+	if user != "" {
+		method = methodPassword
+	}
+	_, _ = netConn.Write([]byte{version5, 1, method})
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(netConn, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] == methodNoAcceptable {
+		return netConn, methodNoAcceptable
+	}
+	if method == methodPassword {
+		auth := []byte{authVersion, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		_, _ = netConn.Write(auth)
+		_, err = io.ReadFull(netConn, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply[1] != 0 {
+			return netConn, methodNoAcceptable
+		}
+	}
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	request := []byte{version5, cmdConnect, 0, atypDomain, byte(len(host))}
+	request = append(request, host...)
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	_, _ = netConn.Write(request)
+	response := make([]byte, 10)
+	_, err = io.ReadFull(netConn, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return netConn, response[1]
+}
+
+func TestSocksConnect(t *testing.T) {
+	echo := rpctest.NewEchoServer(t).Addr().String()
+	closed := make(chan TunnelStats, 1)
+	var server *Server
+	proxy := newSocksServer(t, &forward.Service{Allowlist: forward.Allowlist{echo}}, func(s *Server) {
+		server = s
+		s.Credentials = map[string]string{"admin": "secret"}
+		s.OnTunnelClose = func(stats TunnelStats) {
+			closed <- stats
+		}
+	})
+
+	_, code := dialSocks(t, proxy, "admin", "wrong", echo)
+	if code != methodNoAcceptable {
+		t.Errorf("expected authentication to fail, got %d", code)
+	}
+	_, code = dialSocks(t, proxy, "", "", echo)
+	if code != methodNoAcceptable {
+		t.Errorf("expected no auth to be rejected, got %d", code)
+	}
+
+	netConn, code := dialSocks(t, proxy, "admin", "secret", echo)
+	if code != replySucceeded {
+		t.Fatalf("unexpected reply %d", code)
+	}
+	data := []byte(strings.Repeat("socks ", 1000))
+	_, err := netConn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make([]byte, len(data))
+	_, err = io.ReadFull(netConn, actual)
+	if err != nil || string(actual) != string(data) {
+		t.Fatalf("unexpected echo: %v", err)
+	}
+	tunnels := server.Tunnels()
+	if len(tunnels) != 1 || tunnels[0].User != "admin" || tunnels[0].Target != echo || tunnels[0].Sent != int64(len(data)) {
+		t.Errorf("unexpected tunnels: %+v", tunnels)
+	}
+
+	_ = netConn.Close()
+	select {
+	case stats := <-closed:
+		if stats.Sent != int64(len(data)) || stats.Received != int64(len(data)) {
+			t.Errorf("unexpected traffic: %+v", stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel is not closed")
+	}
+	if len(server.Tunnels()) != 0 {
+		t.Error("closed tunnel is still listed")
+	}
+}
+
+func TestSocksRules(t *testing.T) {
+	echo := rpctest.NewEchoServer(t).Addr().String()
+	_, echoPort, _ := net.SplitHostPort(echo)
+	proxy := newSocksServer(t, &forward.Service{Allowlist: forward.Allowlist{"127.0.0.1:*"}}, func(s *Server) {
+		s.Allow = forward.Allowlist{"127.0.0.1:*", "[::1]:*"}
+		s.Deny = forward.Allowlist{"*:22"}
+	})
+
+	_, code := dialSocks(t, proxy, "", "", "127.0.0.1:22")
+	if code != replyNotAllowed {
+		t.Errorf("expected denied target, got %d", code)
+	}
+	_, code = dialSocks(t, proxy, "", "", "10.0.0.1:80")
+	if code != replyNotAllowed {
+		t.Errorf("expected target outside allow rules to be rejected, got %d", code)
+	}
+	//对端的Allowlist拒绝解析得到的地址
+	_, code = dialSocks(t, proxy, "", "", "[::1]:"+echoPort)
+	if code != replyNotAllowed {
+		t.Errorf("expected peer to reject target, got %d", code)
+	}
+	_, code = dialSocks(t, proxy, "", "", "127.0.0.1:1")
+	if code != replyConnectionRefused {
+		t.Errorf("expected connection refused, got %d", code)
+	}
+	_, code = dialSocks(t, proxy, "", "", echo)
+	if code != replySucceeded {
+		t.Errorf("unexpected reply %d", code)
+	}
+}
+
+func TestSocksDenyResolvedDomain(t *testing.T) {
+	echo := rpctest.NewEchoServer(t).Addr().String()
+	_, echoPort, _ := net.SplitHostPort(echo)
+	proxy := newSocksServer(t, &forward.Service{Allowlist: forward.Allowlist{"localhost:*", "127.0.0.1:*"}}, func(s *Server) {
+		s.Deny = forward.Allowlist{"127.0.0.0/8:*", "[::1]:*"}
+	})
+
+	//localhost解析到被拒绝的网段
+	_, code := dialSocks(t, proxy, "", "", "localhost:"+echoPort)
+	if code != replyNotAllowed {
+		t.Errorf("expected domain resolving into denied range to be rejected, got %d", code)
+	}
+	_, code = dialSocks(t, proxy, "", "", "invalid.invalid:"+echoPort)
+	if code != replyNotAllowed {
+		t.Errorf("expected unresolvable domain to be rejected, got %d", code)
+	}
+}
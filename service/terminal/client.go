@@ -0,0 +1,86 @@
+package terminal
+
+import (
+	"bytes"
+	"errors"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Client 终端服务的客户端,Read读取终端输出,进程退出后返回io.EOF
+type Client struct {
+	channel *rpc.Channel
+	pending bytes.Buffer
+	lock    sync.Mutex
+	exit    atomic.Pointer[ExitStatus]
+}
+
+// Open 打开远程终端
+func Open(conn rpc.Conn, options Options) (*Client, error) {
+	channel, err := conn.OpenChannel(Method, options)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{channel: channel}, nil
+}
+
+func (t *Client) Channel() *rpc.Channel {
+	return t.channel
+}
+
+func (t *Client) Write(b []byte) (int, error) {
+	err := t.channel.Send(subPacket(MethodStdin, b))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t *Client) Resize(rows uint16, cols uint16) error {
+	return t.channel.Send(subPacket(MethodResize, Size{Rows: rows, Cols: cols}))
+}
+
+func (t *Client) Read(b []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for t.pending.Len() == 0 {
+		if t.exit.Load() != nil {
+			return 0, io.EOF
+		}
+		p, err := t.channel.Read()
+		if err != nil {
+			if errors.Is(err, rpc.ChannelClosedError) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		msg, err := p.SubPacket()
+		if err != nil {
+			return 0, err
+		}
+		switch msg.Method() {
+		case MethodStdout:
+			t.pending.Write(msg.Bytes())
+		case MethodExit:
+			status := new(ExitStatus)
+			err = msg.Data(status)
+			if err != nil {
+				return 0, err
+			}
+			t.exit.Store(status)
+		}
+	}
+	return t.pending.Read(b)
+}
+
+// ExitStatus 进程的退出状态,在Read返回io.EOF之前为nil;channel被关闭而没有收到退出状态时也为nil
+func (t *Client) ExitStatus() *ExitStatus {
+	return t.exit.Load()
+}
+
+// Close 关闭终端,服务端挂断终端并结束其中的所有进程
+func (t *Client) Close() error {
+	return t.channel.Close(rpc.CloseNormal, "terminal closed")
+}
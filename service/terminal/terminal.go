@@ -0,0 +1,222 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wonderivan/logger"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"github.com/xiwh/hexhub-agent-plugin/util/executil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Method 打开终端channel的method,打开数据为Options
+const Method = "Terminal"
+
+// channel中的每条消息都是一个子packet,method表示消息类型
+const (
+	// MethodStdin 客户端发送的输入数据,原始字节
+	MethodStdin = "Stdin"
+	// MethodResize 客户端调整窗口大小,数据为Size
+	MethodResize = "Resize"
+	// MethodStdout 服务端发送的终端输出,原始字节
+	MethodStdout = "Stdout"
+	// MethodExit 进程退出时服务端发送的退出状态,数据为ExitStatus,之后channel被关闭
+	MethodExit = "Exit"
+)
+
+// hangupTimeout channel关闭后等待进程响应SIGHUP退出的时间,超时后强制结束会话中的所有进程
+const hangupTimeout = 2 * time.Second
+
+type Options struct {
+	Shell string            `json:"shell"`
+	Args  []string          `json:"args"`
+	Env   map[string]string `json:"env"`
+	Cwd   string            `json:"cwd"`
+	Rows  uint16            `json:"rows"`
+	Cols  uint16            `json:"cols"`
+}
+
+type Size struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+type ExitStatus struct {
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+}
+
+// Service 基于伪终端的交互式终端服务,仅支持linux
+type Service struct {
+	// DefaultShell Options未指定shell时使用,为空时使用$SHELL或/bin/sh
+	DefaultShell string
+	// Allow 在启动进程前校验打开请求,可以修改Options,返回错误时拒绝打开
+	Allow func(conn rpc.Conn, options *Options) error
+}
+
+// Register 在连接上注册终端服务
+func Register(conn rpc.Conn, service *Service) {
+	conn.HandleChannel(Method, service.Serve)
+	conn.Describe(Method, rpc.Schema{Codec: rpc.CodecJson, Request: "Options"})
+}
+
+func (t *Service) shell(options *Options) string {
+	if options.Shell != "" {
+		return options.Shell
+	}
+	if t.DefaultShell != "" {
+		return t.DefaultShell
+	}
+	shell := os.Getenv("SHELL")
+	if shell != "" {
+		return shell
+	}
+	return "/bin/sh"
+}
+
+func (t *Service) command(options *Options) *exec.Cmd {
+	cmd := exec.Command(t.shell(options), options.Args...)
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	for k, v := range options.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Dir = options.Cwd
+	if cmd.Dir == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			cmd.Dir = home
+		}
+	}
+	return cmd
+}
+
+// Serve 处理一个终端channel,进程退出后发送退出状态并关闭channel,channel关闭后结束会话中的所有进程
+func (t *Service) Serve(conn rpc.Conn, p packet.Packet, channel *rpc.Channel) {
+	options := Options{Rows: 24, Cols: 80}
+	err := p.Data(&options)
+	if err != nil {
+		_ = channel.Close(rpc.CloseFailure, err.Error())
+		return
+	}
+	if t.Allow != nil {
+		err = t.Allow(conn, &options)
+		if err != nil {
+			_ = channel.Close(rpc.CloseFailure, err.Error())
+			return
+		}
+	}
+	cmd := t.command(&options)
+	pty, err := executil.StartPty(cmd, options.Rows, options.Cols)
+	if err != nil {
+		_ = channel.Close(rpc.CloseFailure, err.Error())
+		return
+	}
+	defer pty.Close()
+
+	exited := make(chan struct{})
+	go t.readInput(channel, pty)
+	go func() {
+		//channel关闭后挂断终端,进程没有及时退出时强制结束
+		select {
+		case <-channel.GetContext().Done():
+			_ = pty.Close()
+			_ = executil.KillSession(cmd, syscall.SIGHUP)
+		case <-exited:
+			return
+		}
+		select {
+		case <-exited:
+		case <-time.After(hangupTimeout):
+			_ = executil.KillSession(cmd, syscall.SIGKILL)
+		}
+	}()
+
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		writeOutput(channel, pty)
+	}()
+
+	_ = cmd.Wait()
+	close(exited)
+	//shell退出后结束其留下的后台作业,从设备全部关闭后输出读取结束
+	_ = executil.KillSession(cmd, syscall.SIGKILL)
+	<-outputDone
+	status := exitStatus(cmd)
+	err = channel.Send(subPacket(MethodExit, status))
+	if err != nil && !errors.Is(err, rpc.ChannelClosedError) {
+		logger.Error(err)
+	}
+	_ = channel.Close(rpc.CloseNormal, fmt.Sprintf("exit status %d", status.Code))
+}
+
+func (t *Service) readInput(channel *rpc.Channel, pty *os.File) {
+	for {
+		p, err := channel.Read()
+		if err != nil {
+			return
+		}
+		msg, err := p.SubPacket()
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		switch msg.Method() {
+		case MethodStdin:
+			_, err = pty.Write(msg.Bytes())
+		case MethodResize:
+			var size Size
+			err = msg.Data(&size)
+			if err == nil {
+				err = executil.SetPtySize(pty, size.Rows, size.Cols)
+			}
+		}
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+var bufferPool = sync.Pool{New: func() any {
+	b := make([]byte, 32*1024)
+	return &b
+}}
+
+func writeOutput(channel *rpc.Channel, pty *os.File) {
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	for {
+		n, err := pty.Read(*buf)
+		if n > 0 {
+			sendErr := channel.Send(subPacket(MethodStdout, (*buf)[:n]))
+			if sendErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			//所有从设备关闭后linux返回EIO
+			return
+		}
+	}
+}
+
+func exitStatus(cmd *exec.Cmd) ExitStatus {
+	if cmd.ProcessState == nil {
+		return ExitStatus{Code: -1}
+	}
+	return ExitStatus{
+		Code:   cmd.ProcessState.ExitCode(),
+		Signal: executil.ExitSignal(cmd.ProcessState),
+	}
+}
+
+func subPacket(method string, v any) packet.Packet {
+	//数据只有字节和简单结构体,不会编码失败
+	p, _ := packet.CreatePacket(method, 0, v)
+	return p
+}
@@ -0,0 +1,112 @@
+package terminal
+
+import (
+	"bufio"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/rpctest"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTerminalConn(t *testing.T) rpc.Conn {
+	return rpctest.NewConn(t, func(conn rpc.Conn) {
+		Register(conn, &Service{DefaultShell: "/bin/sh"})
+	})
+}
+
+// readUntil 读取终端输出直到出现marker,返回marker所在的行
+func readUntil(t *testing.T, r *bufio.Reader, marker string) string {
+	done := make(chan string, 1)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if strings.Contains(line, marker) {
+				done <- line
+				return
+			}
+			if err != nil {
+				done <- ""
+				return
+			}
+		}
+	}()
+	select {
+	case line := <-done:
+		if line == "" {
+			t.Fatalf("output ended before %q", marker)
+		}
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %q", marker)
+		return ""
+	}
+}
+
+// alive 进程存在且不是僵尸进程,容器中的init不一定会回收孤儿进程
+func alive(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestTerminal(t *testing.T) {
+	conn := newTerminalConn(t)
+	client, err := Open(conn, Options{Env: map[string]string{"GREETING": "hello"}, Cwd: "/", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := bufio.NewReader(client)
+
+	_, _ = io.WriteString(client, "echo \"$GREETING from $(pwd)\"\n")
+	readUntil(t, output, "hello from /")
+
+	err = client.Resize(40, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(client, "echo size=$(stty size)\n")
+	readUntil(t, output, "size=40 100")
+
+	_, _ = io.WriteString(client, "exit 3\n")
+	_, err = io.Copy(io.Discard, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := client.ExitStatus()
+	if status == nil || status.Code != 3 {
+		t.Fatalf("unexpected exit status: %+v", status)
+	}
+}
+
+func TestTerminalCloseKillsSession(t *testing.T) {
+	conn := newTerminalConn(t)
+	client, err := Open(conn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := bufio.NewReader(client)
+
+	//后台作业在单独的进程组中并且忽略SIGHUP,只能通过结束会话清理
+	_, _ = io.WriteString(client, "trap '' HUP; sleep 100 & echo pi''d=$!\n")
+	line := readUntil(t, output, "pid=")
+	pid, err := strconv.Atoi(strings.TrimSpace(line[strings.Index(line, "pid=")+4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for alive(pid) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if alive(pid) {
+		t.Errorf("background process %d is still alive", pid)
+	}
+}
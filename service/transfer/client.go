@@ -0,0 +1,291 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Options 客户端传输选项
+type Options struct {
+	// Overwrite 上传时是否覆盖已存在的目标文件
+	Overwrite bool
+	// OnProgress 对方确认写入后回调,Size为-1表示大小未知
+	OnProgress func(progress Progress)
+}
+
+func (t *Options) progress(offset int64, size int64) {
+	if t.OnProgress != nil {
+		t.OnProgress(Progress{Offset: offset, Size: size})
+	}
+}
+
+// readMessage 读取一条子packet,ctx结束时通知对方取消并关闭channel
+func readMessage(ctx context.Context, channel *rpc.Channel) (packet.Packet, error) {
+	p, err := channel.ReadContext(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			cancel(channel)
+		}
+		return packet.Packet{}, closedError(channel, err)
+	}
+	return p.SubPacket()
+}
+
+// cancelTimeout 发送取消后等待对方关闭channel的时间
+const cancelTimeout = 5 * time.Second
+
+func cancel(channel *rpc.Channel) {
+	err := channel.Send(subPacket(MethodCancel, ""))
+	if err == nil {
+		//等待对方处理取消后关闭channel,期间丢弃收到的数据以免阻塞连接
+		deadline := time.Now().Add(cancelTimeout)
+		for err == nil {
+			_, err = channel.ReadTimeout(time.Until(deadline))
+		}
+	}
+	_ = channel.Close(rpc.CloseInterrupt, "transfer cancelled")
+}
+
+// Upload 上传本地文件到远程路径;中断后以相同参数再次调用时从服务端已接收的位置续传,ctx结束时取消上传
+func Upload(ctx context.Context, conn rpc.Conn, local string, remote string, options Options) (*Complete, error) {
+	sum, size, err := hashFile(local)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(local)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.OpenChannel(MethodUpload, UploadRequest{
+		Path:      remote,
+		Size:      size,
+		Sha256:    sum,
+		Mode:      uint32(stat.Mode().Perm()),
+		Overwrite: options.Overwrite,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close(rpc.CloseNormal, "upload finished")
+
+	msg, err := readMessage(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+	var ready Progress
+	if msg.Method() != MethodReady {
+		return nil, fmt.Errorf("unexpected message %s", msg.Method())
+	}
+	err = msg.Data(&ready)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(ready.Offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	options.progress(ready.Offset, size)
+
+	offset, acked := ready.Offset, ready.Offset
+	buf := make([]byte, ChunkSize)
+	done := false
+	for {
+		//窗口未满时继续发送,否则等待服务端确认
+		if !done && offset-acked < window {
+			if ctx.Err() != nil {
+				cancel(channel)
+				return nil, ctx.Err()
+			}
+			n, err := io.ReadFull(file, buf)
+			if n > 0 {
+				sendErr := channel.Send(subPacket(MethodChunk, buf[:n]))
+				if sendErr != nil {
+					return nil, closedError(channel, sendErr)
+				}
+				offset += int64(n)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				done = true
+				err = channel.Send(subPacket(MethodDone, ""))
+				if err != nil {
+					return nil, closedError(channel, err)
+				}
+			} else if err != nil {
+				cancel(channel)
+				return nil, err
+			}
+			continue
+		}
+		msg, err = readMessage(ctx, channel)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Method() {
+		case MethodProgress:
+			var progress Progress
+			err = msg.Data(&progress)
+			if err != nil {
+				return nil, err
+			}
+			acked = progress.Offset
+			options.progress(acked, size)
+		case MethodComplete:
+			complete := new(Complete)
+			err = msg.Data(complete)
+			if err != nil {
+				return nil, err
+			}
+			options.progress(complete.Size, size)
+			return complete, nil
+		}
+	}
+}
+
+// Download 下载远程文件到本地路径,数据先写入local+".part",校验通过后重命名;
+// 中断后再次调用时从.part文件的大小处续传,远程文件发生变化时重新下载。远程路径为目录时下载为zip文件
+func Download(ctx context.Context, conn rpc.Conn, remote string, local string, options Options) (*Complete, error) {
+	partPath := local + ".part"
+	sumPath := partSumPath(partPath)
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+		//取消时与上传一致,丢弃已下载的数据
+		if ctx.Err() != nil {
+			_ = os.Remove(partPath)
+			_ = os.Remove(sumPath)
+		}
+	}()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	//.part文件旁记录其对应的远程文件sha256,没有记录时无法判断远程文件是否变化,从头下载
+	req := DownloadRequest{Path: remote}
+	if sum, err := os.ReadFile(sumPath); err == nil && stat.Size() > 0 {
+		req.Offset = stat.Size()
+		req.Sha256 = strings.TrimSpace(string(sum))
+	}
+	channel, err := conn.OpenChannel(MethodDownload, req)
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close(rpc.CloseNormal, "download finished")
+
+	msg, err := readMessage(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Method() != MethodInfo {
+		return nil, fmt.Errorf("unexpected message %s", msg.Method())
+	}
+	var info FileInfo
+	err = msg.Data(&info)
+	if err != nil {
+		return nil, err
+	}
+	//服务端可能不接受续传的位置,以服务端返回的为准
+	err = file.Truncate(info.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if info.Sha256 != "" {
+		err = os.WriteFile(sumPath, []byte(info.Sha256), 0600)
+	} else {
+		err = os.Remove(sumPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(info.Offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	options.progress(info.Offset, info.Size)
+
+	offset, acked := info.Offset, info.Offset
+	for {
+		msg, err = readMessage(ctx, channel)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Method() {
+		case MethodChunk:
+			n, err := file.Write(msg.Bytes())
+			if err != nil {
+				cancel(channel)
+				return nil, err
+			}
+			offset += int64(n)
+			if offset-acked >= window/2 {
+				acked = offset
+				//服务端发送完成后可能已经关闭channel,确认失败时由后续的读取返回结果
+				_ = channel.Send(subPacket(MethodProgress, Progress{Offset: offset, Size: info.Size}))
+				options.progress(offset, info.Size)
+			}
+		case MethodComplete:
+			complete := new(Complete)
+			err = msg.Data(complete)
+			if err != nil {
+				return nil, err
+			}
+			err = commitDownload(file, partPath, local, complete, offset, info.Mode)
+			if err != nil {
+				return nil, err
+			}
+			options.progress(offset, info.Size)
+			return complete, nil
+		}
+	}
+}
+
+func commitDownload(file *os.File, partPath string, local string, complete *Complete, offset int64, mode uint32) error {
+	err := file.Sync()
+	if err != nil {
+		return err
+	}
+	sum, _, err := hashFile(partPath)
+	if err != nil {
+		return err
+	}
+	if offset != complete.Size || !strings.EqualFold(sum, complete.Sha256) {
+		//.part文件已经损坏,删除后重新下载
+		_ = os.Remove(partPath)
+		_ = os.Remove(partSumPath(partPath))
+		return fmt.Errorf("sha256 mismatch: expected %s, got %s", complete.Sha256, sum)
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	err = file.Chmod(os.FileMode(mode).Perm())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(partPath, local)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(partSumPath(partPath))
+	return nil
+}
+
+// partSumPath 记录.part文件对应的远程文件sha256的文件
+func partSumPath(partPath string) string {
+	return partPath + ".sha256"
+}
@@ -0,0 +1,158 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/wonderivan/logger"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"github.com/xiwh/hexhub-agent-plugin/util"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ServeDownload 处理下载channel,文件从请求的位置开始发送;目录边打包边以zip发送,不支持续传
+func (t *Service) ServeDownload(conn rpc.Conn, p packet.Packet, channel *rpc.Channel) {
+	var req DownloadRequest
+	err := p.Data(&req)
+	if err != nil {
+		_ = channel.Close(rpc.CloseFailure, err.Error())
+		return
+	}
+	path, err := t.resolve(conn, OpDownload, req.Path)
+	if err != nil {
+		_ = channel.Close(rpc.CloseFailure, err.Error())
+		return
+	}
+	var complete *Complete
+	if util.IsDir(path) {
+		complete, err = t.downloadDir(channel, path)
+	} else {
+		complete, err = t.downloadFile(channel, path, req.Offset, req.Sha256)
+	}
+	if err != nil {
+		if !errors.Is(err, rpc.ChannelClosedError) {
+			_ = channel.Close(rpc.CloseFailure, err.Error())
+		}
+		return
+	}
+	if complete == nil {
+		_ = channel.Close(rpc.CloseNormal, "download cancelled")
+		return
+	}
+	err = channel.Send(subPacket(MethodComplete, complete))
+	if err != nil && !errors.Is(err, rpc.ChannelClosedError) {
+		logger.Error(err)
+	}
+	_ = channel.Close(rpc.CloseNormal, "download complete")
+}
+
+func (t *Service) downloadFile(channel *rpc.Channel, path string, offset int64, partSha256 string) (*Complete, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sum, size, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	//文件在续传前发生了变化时从头发送
+	if offset < 0 || offset > size || (partSha256 != "" && !strings.EqualFold(partSha256, sum)) {
+		offset = 0
+	}
+	_, err = file.Seek(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	info := FileInfo{
+		Name:   stat.Name(),
+		Size:   size,
+		Sha256: sum,
+		Mode:   uint32(stat.Mode().Perm()),
+		Offset: offset,
+	}
+	err = channel.Send(subPacket(MethodInfo, info))
+	if err != nil {
+		return nil, err
+	}
+	sent, err := sendData(channel, io.LimitReader(file, size-offset), offset)
+	if err != nil || sent < 0 {
+		return nil, err
+	}
+	return &Complete{Size: sent, Sha256: sum}, nil
+}
+
+func (t *Service) downloadDir(channel *rpc.Channel, path string) (*Complete, error) {
+	info := FileInfo{
+		Name:  filepath.Base(path) + ".zip",
+		Size:  -1,
+		Mode:  0644,
+		IsDir: true,
+	}
+	err := channel.Send(subPacket(MethodInfo, info))
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	go func() {
+		writer.CloseWithError(util.ZipDir(writer, path))
+	}()
+	hash := sha256.New()
+	sent, err := sendData(channel, io.TeeReader(reader, hash), 0)
+	if err != nil || sent < 0 {
+		return nil, err
+	}
+	return &Complete{Size: sent, Sha256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// sendData 从offset开始发送r中的数据直到EOF,返回结束位置;未确认的数据超过窗口时等待接收方确认,取消时返回-1
+func sendData(channel *rpc.Channel, r io.Reader, offset int64) (int64, error) {
+	buf := make([]byte, ChunkSize)
+	acked := offset
+	for {
+		for offset-acked >= window {
+			p, err := channel.Read()
+			if err != nil {
+				return 0, err
+			}
+			msg, err := p.SubPacket()
+			if err != nil {
+				return 0, err
+			}
+			switch msg.Method() {
+			case MethodProgress:
+				var progress Progress
+				err = msg.Data(&progress)
+				if err != nil {
+					return 0, err
+				}
+				acked = progress.Offset
+			case MethodCancel:
+				return -1, nil
+			}
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sendErr := channel.Send(subPacket(MethodChunk, buf[:n]))
+			if sendErr != nil {
+				return 0, sendErr
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 打开上传、下载channel的method,打开数据分别为UploadRequest和DownloadRequest
+const (
+	MethodUpload   = "TransferUpload"
+	MethodDownload = "TransferDownload"
+)
+
+// channel中的每条消息都是一个子packet,method表示消息类型
+const (
+	// MethodReady 上传时服务端回复的续传位置,数据为Progress,客户端从Offset开始发送
+	MethodReady = "Ready"
+	// MethodInfo 下载时服务端发送的文件信息,数据为FileInfo,之后从FileInfo.Offset开始发送数据
+	MethodInfo = "Info"
+	// MethodChunk 文件数据,原始字节
+	MethodChunk = "Chunk"
+	// MethodProgress 接收方确认已写入的位置,数据为Progress,发送方据此控制未确认的数据量
+	MethodProgress = "Progress"
+	// MethodDone 上传时客户端发送完所有数据
+	MethodDone = "Done"
+	// MethodComplete 传输完成并校验通过,数据为Complete,之后channel被关闭
+	MethodComplete = "Complete"
+	// MethodCancel 取消传输,接收方删除暂存的数据;直接关闭channel时保留暂存数据用于续传
+	MethodCancel = "Cancel"
+)
+
+// 操作类型,传给Service.Allow
+const (
+	OpUpload   = "upload"
+	OpDownload = "download"
+)
+
+// ChunkSize 每个Chunk消息的最大字节数
+const ChunkSize = 256 * 1024
+
+// window 发送方最多允许未确认的字节数,接收方每收到一半窗口的数据确认一次
+const window = 8 * ChunkSize
+
+type UploadRequest struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Sha256 文件的sha256,为空时不支持续传,只校验大小
+	Sha256    string `json:"sha256"`
+	Mode      uint32 `json:"mode"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+type DownloadRequest struct {
+	Path string `json:"path"`
+	// Offset 客户端已经下载的字节数,目录不支持续传
+	Offset int64 `json:"offset"`
+	// Sha256 已下载部分对应的远程文件sha256,与当前文件不一致时从头发送
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+type FileInfo struct {
+	Name string `json:"name"`
+	// Size 目录以zip传输,大小未知时为-1
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256,omitempty"`
+	Mode   uint32 `json:"mode"`
+	IsDir  bool   `json:"isDir"`
+	// Offset 服务端实际开始发送的位置,文件变化或者不支持续传时为0
+	Offset int64 `json:"offset"`
+}
+
+type Progress struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+type Complete struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// Service 文件传输服务
+type Service struct {
+	// Root 限制可以访问的目录,为空时不限制
+	Root string
+	// Allow 校验传输请求,path为解析后的路径,返回错误时拒绝传输
+	Allow func(conn rpc.Conn, op string, path string) error
+}
+
+// Register 在连接上注册文件传输服务
+func Register(conn rpc.Conn, service *Service) {
+	conn.HandleChannel(MethodUpload, service.ServeUpload)
+	conn.HandleChannel(MethodDownload, service.ServeDownload)
+	conn.Describe(MethodUpload, rpc.Schema{Codec: rpc.CodecJson, Request: "UploadRequest"})
+	conn.Describe(MethodDownload, rpc.Schema{Codec: rpc.CodecJson, Request: "DownloadRequest"})
+}
+
+func (t *Service) resolve(conn rpc.Conn, op string, path string) (string, error) {
+	if path == "" {
+		return "", errors.New("path is empty")
+	}
+	if t.Root != "" {
+		//先按根目录清理,避免通过..访问Root之外的文件
+		path = filepath.Join(t.Root, filepath.Clean("/"+path))
+	} else {
+		path = filepath.Clean(path)
+	}
+	if t.Allow != nil {
+		err := t.Allow(conn, op, path)
+		if err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// validSha256 sum为64位十六进制字符串,用于暂存文件名之前必须校验,避免通过路径分隔符写到Root之外
+func validSha256(sum string) bool {
+	if len(sum) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+// stagingPath 上传时暂存文件的路径,与目标文件在同一目录下以便原子替换;相同内容的上传使用相同的路径用于续传
+func stagingPath(dest string, sum string) string {
+	dir, name := filepath.Split(dest)
+	if len(sum) > 16 {
+		sum = sum[:16]
+	}
+	return filepath.Join(dir, "."+name+"."+strings.ToLower(sum)+".part")
+}
+
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+// closedError channel被关闭时返回对端给出的关闭原因
+func closedError(channel *rpc.Channel, err error) error {
+	if !errors.Is(err, rpc.ChannelClosedError) {
+		return err
+	}
+	closeInfo := channel.CloseInfo()
+	if closeInfo == nil || closeInfo.Code == rpc.CloseNormal {
+		return err
+	}
+	return fmt.Errorf("transfer failed: %s", closeInfo.Reason)
+}
+
+func subPacket(method string, v any) packet.Packet {
+	//数据只有字节和简单结构体,不会编码失败
+	p, _ := packet.CreatePacket(method, 0, v)
+	return p
+}
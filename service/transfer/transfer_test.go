@@ -0,0 +1,302 @@
+package transfer
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/rpctest"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTransferConn(t *testing.T, root string) rpc.Conn {
+	return rpctest.NewConn(t, func(conn rpc.Conn) {
+		Register(conn, &Service{Root: root})
+	})
+}
+
+func writeRandomFile(t *testing.T, path string, size int) []byte {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func assertFile(t *testing.T, path string, data []byte) {
+	actual, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, data) {
+		t.Fatalf("%s has unexpected content", path)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	root, local := t.TempDir(), t.TempDir()
+	conn := newTransferConn(t, root)
+	src := filepath.Join(local, "data.bin")
+	data := writeRandomFile(t, src, 3*window+1234)
+
+	//模拟之前中断的上传留下的暂存文件
+	sum, _, err := hashFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const resumeAt = ChunkSize + 100
+	err = os.WriteFile(stagingPath(filepath.Join(root, "data.bin"), sum), data[:resumeAt], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var progress []Progress
+	complete, err := Upload(context.Background(), conn, src, "/data.bin", Options{OnProgress: func(p Progress) {
+		progress = append(progress, p)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete.Sha256 != sum || complete.Size != int64(len(data)) {
+		t.Errorf("unexpected complete: %+v", complete)
+	}
+	if len(progress) < 3 || progress[0].Offset != resumeAt || progress[len(progress)-1].Offset != int64(len(data)) {
+		t.Errorf("unexpected progress: %+v", progress)
+	}
+	assertFile(t, filepath.Join(root, "data.bin"), data)
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		t.Errorf("staging file is not removed: %v", entries)
+	}
+
+	_, err = Upload(context.Background(), conn, src, "/data.bin", Options{})
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("expected already exists error, got %v", err)
+	}
+}
+
+func TestUploadCorruptStaging(t *testing.T) {
+	root, local := t.TempDir(), t.TempDir()
+	conn := newTransferConn(t, root)
+	src := filepath.Join(local, "data.bin")
+	writeRandomFile(t, src, 2*ChunkSize)
+	sum, _, err := hashFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := stagingPath(filepath.Join(root, "data.bin"), sum)
+	err = os.WriteFile(staging, make([]byte, 1000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Upload(context.Background(), conn, src, "data.bin", Options{})
+	if err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+		t.Fatalf("expected sha256 mismatch, got %v", err)
+	}
+	_, err = os.Stat(filepath.Join(root, "data.bin"))
+	if !os.IsNotExist(err) {
+		t.Error("destination is replaced by a corrupt file")
+	}
+	//损坏的暂存文件被删除,再次上传成功
+	_, err = Upload(context.Background(), conn, src, "data.bin", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadInvalidSha256(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	err := os.Mkdir(root, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newTransferConn(t, root)
+	//sha256用于暂存文件名,包含路径分隔符时可能写到Root之外
+	channel, err := conn.OpenChannel(MethodUpload, UploadRequest{Path: "data.bin", Size: 1, Sha256: "/../../../../../evil"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	_, err = readMessage(ctx, channel)
+	if err == nil || !strings.Contains(err.Error(), "invalid sha256") {
+		t.Fatalf("expected invalid sha256 error, got %v", err)
+	}
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files are created outside root: %v", entries)
+	}
+	entries, _ = os.ReadDir(root)
+	if len(entries) != 0 {
+		t.Errorf("unexpected files in root: %v", entries)
+	}
+}
+
+func TestUploadCancel(t *testing.T) {
+	root, local := t.TempDir(), t.TempDir()
+	conn := newTransferConn(t, root)
+	src := filepath.Join(local, "data.bin")
+	writeRandomFile(t, src, 4*window)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := Upload(ctx, conn, src, "data.bin", Options{OnProgress: func(p Progress) {
+		if p.Offset > 0 {
+			cancel()
+		}
+	}})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	//取消后服务端删除暂存文件
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, _ := os.ReadDir(root)
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("staging file is not removed: %v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	root, local := t.TempDir(), t.TempDir()
+	conn := newTransferConn(t, root)
+	data := writeRandomFile(t, filepath.Join(root, "data.bin"), 2*window+77)
+	dest := filepath.Join(local, "data.bin")
+
+	sum, _, err := hashFile(filepath.Join(root, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const resumeAt = 3*ChunkSize + 5
+	writePart(t, dest, data[:resumeAt], sum)
+	first := firstDownloadProgress(t, conn, dest)
+	if first == nil || first.Offset != resumeAt || first.Size != int64(len(data)) {
+		t.Errorf("unexpected first progress: %+v", first)
+	}
+	assertFile(t, dest, data)
+	for _, path := range []string{dest + ".part", dest + ".part.sha256"} {
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is not removed", path)
+		}
+	}
+
+	//远程文件发生变化或者没有记录sha256时从头下载
+	writePart(t, dest, data[:resumeAt], strings.Repeat("0", 64))
+	if first = firstDownloadProgress(t, conn, dest); first == nil || first.Offset != 0 {
+		t.Errorf("expected download to restart after remote file changed, got %+v", first)
+	}
+	assertFile(t, dest, data)
+	writePart(t, dest, data[:resumeAt], "")
+	if first = firstDownloadProgress(t, conn, dest); first == nil || first.Offset != 0 {
+		t.Errorf("expected download to restart without recorded sha256, got %+v", first)
+	}
+	assertFile(t, dest, data)
+
+	//.part文件损坏时校验失败
+	writePart(t, dest, make([]byte, 10), sum)
+	_, err = Download(context.Background(), conn, "data.bin", dest, Options{})
+	if err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+		t.Fatalf("expected sha256 mismatch, got %v", err)
+	}
+	_, err = Download(context.Background(), conn, "data.bin", dest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, dest, data)
+
+	_, err = Download(context.Background(), conn, "missing.bin", filepath.Join(local, "missing.bin"), Options{})
+	if err == nil || !strings.Contains(err.Error(), "transfer failed") {
+		t.Errorf("expected transfer failed, got %v", err)
+	}
+}
+
+// writePart 写入未完成的下载文件,sum不为空时同时记录其对应的远程文件sha256
+func writePart(t *testing.T, dest string, data []byte, sum string) {
+	err := os.WriteFile(dest+".part", data, 0600)
+	if err == nil && sum != "" {
+		err = os.WriteFile(dest+".part.sha256", []byte(sum), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func firstDownloadProgress(t *testing.T, conn rpc.Conn, dest string) *Progress {
+	var first *Progress
+	_, err := Download(context.Background(), conn, "data.bin", dest, Options{OnProgress: func(p Progress) {
+		if first == nil {
+			first = &p
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first
+}
+
+func TestDownloadDir(t *testing.T) {
+	root, local := t.TempDir(), t.TempDir()
+	conn := newTransferConn(t, root)
+	err := os.MkdirAll(filepath.Join(root, "site", "assets"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"index.html":     []byte("<html></html>"),
+		"assets/app.bin": writeRandomFile(t, filepath.Join(root, "site", "assets", "app.bin"), window+3),
+	}
+	err = os.WriteFile(filepath.Join(root, "site", "index.html"), files["index.html"], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(local, "site.zip")
+	_, err = Download(context.Background(), conn, "site", dest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := zip.OpenReader(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	found := 0
+	for _, file := range reader.File {
+		expected, ok := files[file.Name]
+		if !ok {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil || !bytes.Equal(actual, expected) {
+			t.Errorf("unexpected content of %s: %v", file.Name, err)
+		}
+		found++
+	}
+	if found != len(files) {
+		t.Errorf("expected %d files in zip, found %d", len(files), found)
+	}
+}
@@ -0,0 +1,164 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/wonderivan/logger"
+	"github.com/xiwh/hexhub-agent-plugin/rpc"
+	"github.com/xiwh/hexhub-agent-plugin/rpc/packet"
+	"os"
+	"strings"
+)
+
+// ServeUpload 处理上传channel,数据先写入目标目录下的暂存文件,校验通过后重命名为目标文件;
+// channel中断时保留暂存文件,以相同的sha256再次上传时从暂存文件的大小处续传
+func (t *Service) ServeUpload(conn rpc.Conn, p packet.Packet, channel *rpc.Channel) {
+	var req UploadRequest
+	err := p.Data(&req)
+	if err != nil {
+		_ = channel.Close(rpc.CloseFailure, err.Error())
+		return
+	}
+	dest, err := t.resolve(conn, OpUpload, req.Path)
+	if err != nil {
+		_ = channel.Close(rpc.CloseFailure, err.Error())
+		return
+	}
+	complete, err := t.upload(channel, &req, dest)
+	if err != nil {
+		if !errors.Is(err, rpc.ChannelClosedError) {
+			_ = channel.Close(rpc.CloseFailure, err.Error())
+		}
+		return
+	}
+	if complete == nil {
+		_ = channel.Close(rpc.CloseNormal, "upload cancelled")
+		return
+	}
+	err = channel.Send(subPacket(MethodComplete, complete))
+	if err != nil && !errors.Is(err, rpc.ChannelClosedError) {
+		logger.Error(err)
+	}
+	_ = channel.Close(rpc.CloseNormal, "upload complete")
+}
+
+// upload 接收数据并替换目标文件,取消时返回nil
+func (t *Service) upload(channel *rpc.Channel, req *UploadRequest, dest string) (*Complete, error) {
+	if !req.Overwrite {
+		_, err := os.Lstat(dest)
+		if err == nil {
+			return nil, fmt.Errorf("%s already exists", req.Path)
+		}
+	}
+	resumable := req.Sha256 != ""
+	if resumable && !validSha256(req.Sha256) {
+		return nil, fmt.Errorf("invalid sha256 %q", req.Sha256)
+	}
+	staging := stagingPath(dest, req.Sha256)
+	if !resumable {
+		staging = stagingPath(dest, uuid.NewString())
+	}
+	file, err := os.OpenFile(staging, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	keep := resumable
+	defer func() {
+		_ = file.Close()
+		if !keep {
+			_ = os.Remove(staging)
+		}
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size()
+	if offset > req.Size {
+		//暂存文件比上传的文件大,不可能是同一个文件,重新上传
+		offset = 0
+		err = file.Truncate(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = file.Seek(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = channel.Send(subPacket(MethodReady, Progress{Offset: offset, Size: req.Size}))
+	if err != nil {
+		return nil, err
+	}
+
+	acked := offset
+	for {
+		p, err := channel.Read()
+		if err != nil {
+			return nil, err
+		}
+		msg, err := p.SubPacket()
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Method() {
+		case MethodChunk:
+			data := msg.Bytes()
+			if offset+int64(len(data)) > req.Size {
+				keep = false
+				return nil, fmt.Errorf("received more than %d bytes", req.Size)
+			}
+			_, err = file.Write(data)
+			if err != nil {
+				return nil, err
+			}
+			offset += int64(len(data))
+			if offset-acked >= window/2 {
+				acked = offset
+				err = channel.Send(subPacket(MethodProgress, Progress{Offset: offset, Size: req.Size}))
+				if err != nil {
+					return nil, err
+				}
+			}
+		case MethodCancel:
+			keep = false
+			return nil, nil
+		case MethodDone:
+			keep = false
+			return t.commit(file, staging, dest, req, offset)
+		}
+	}
+}
+
+// commit 校验暂存文件并原子替换目标文件
+func (t *Service) commit(file *os.File, staging string, dest string, req *UploadRequest, offset int64) (*Complete, error) {
+	if offset != req.Size {
+		return nil, fmt.Errorf("size mismatch: expected %d, received %d", req.Size, offset)
+	}
+	err := file.Sync()
+	if err != nil {
+		return nil, err
+	}
+	//续传时暂存文件的前半部分来自之前的连接,需要对整个文件重新计算
+	sum, _, err := hashFile(staging)
+	if err != nil {
+		return nil, err
+	}
+	if req.Sha256 != "" && !strings.EqualFold(sum, req.Sha256) {
+		return nil, fmt.Errorf("sha256 mismatch: expected %s, got %s", req.Sha256, sum)
+	}
+	mode := os.FileMode(req.Mode).Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	err = file.Chmod(mode)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(staging, dest)
+	if err != nil {
+		return nil, err
+	}
+	return &Complete{Size: offset, Sha256: sum}, nil
+}
@@ -1,26 +1,102 @@
 package executil
 
 import (
+	"errors"
+	"os"
 	"os/exec"
+	"strings"
 )
 
+var PtyUnsupportedError = errors.New("pty is only supported on linux")
+
+// ExecOptions 子进程的工作目录和额外的环境变量,Dir为空时使用当前进程的工作目录
+type ExecOptions struct {
+	Dir string
+	// Env 为KEY=VALUE形式,追加在当前进程的环境变量之后,同名时覆盖
+	Env []string
+}
+
+func (t ExecOptions) apply(cmd *exec.Cmd) {
+	cmd.Dir = t.Dir
+	if len(t.Env) > 0 {
+		cmd.Env = append(os.Environ(), t.Env...)
+	}
+}
+
 func ExecChildProcess(path string, args ...string) (*exec.Cmd, error) {
+	return ExecChildProcessWithOptions(ExecOptions{}, path, args...)
+}
+
+// ExecChildProcessWithOptions 与ExecChildProcess相同,按options设置工作目录和环境变量
+func ExecChildProcessWithOptions(options ExecOptions, path string, args ...string) (*exec.Cmd, error) {
 	cmd := exec.Command(
 		path,
 		args...,
 	)
-	err := initCmd(cmd)
+	options.apply(cmd)
+	err := StartCmd(cmd)
 	if err != nil {
 		return nil, err
 	}
+	return cmd, nil
+}
+
+// ExecChildProcessWithOutput 与ExecChildProcessWithOptions相同,并返回子进程标准输出和标准错误管道的读取端,调用方需要读取到EOF后关闭;
+// 使用os.Pipe而不是cmd.StdoutPipe,子进程留下的后台进程继承管道时不会阻塞cmd.Wait
+func ExecChildProcessWithOutput(options ExecOptions, path string, args ...string) (*exec.Cmd, *os.File, *os.File, error) {
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		_ = stdoutReader.Close()
+		_ = stdoutWriter.Close()
+		return nil, nil, nil, err
+	}
+	cmd := exec.Command(path, args...)
+	options.apply(cmd)
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	err = StartCmd(cmd)
+	//写入端已经由子进程继承,父进程关闭后子进程全部退出时读取端返回EOF
+	_ = stdoutWriter.Close()
+	_ = stderrWriter.Close()
+	if err != nil {
+		_ = stdoutReader.Close()
+		_ = stderrReader.Close()
+		return nil, nil, nil, err
+	}
+	return cmd, stdoutReader, stderrReader, nil
+}
+
+// ExitSignal 返回结束进程的信号名称,进程不是被信号结束时返回空字符串
+func ExitSignal(state *os.ProcessState) string {
+	if state == nil || state.ExitCode() != -1 {
+		return ""
+	}
+	//被信号结束时ProcessState.String()为"signal: killed"的形式,plan9等平台没有syscall.WaitStatus
+	if !strings.HasPrefix(state.String(), "signal: ") {
+		return ""
+	}
+	return strings.TrimPrefix(state.String(), "signal: ")
+}
+
+// StartCmd 按当前平台的子进程设置启动已配置好的cmd,用于需要自定义环境变量、工作目录或标准输入输出的场景;
+// 调用方需要调用cmd.Wait回收进程
+func StartCmd(cmd *exec.Cmd) error {
+	err := initCmd(cmd)
+	if err != nil {
+		return err
+	}
 	err = cmd.Start()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	err = initPostCmd(cmd)
 	if err != nil {
 		_ = cmd.Process.Kill()
-		return nil, err
+		return err
 	}
-	return cmd, nil
+	return nil
 }
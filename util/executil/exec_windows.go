@@ -33,9 +33,19 @@ func initPostCmd(cmd *exec.Cmd) error {
 		return err
 	}
 
+	//只等待复制的进程句柄而不调用cmd.Wait,每个进程只能Wait一次,由调用方Wait获取退出状态
+	currentProcess := windows.CurrentProcess()
+	var handle windows.Handle
+	err = windows.DuplicateHandle(currentProcess, windows.Handle((*process)(unsafe.Pointer(cmd.Process)).Handle),
+		currentProcess, &handle, windows.SYNCHRONIZE, false, 0)
+	if err != nil {
+		_ = g.dispose()
+		return err
+	}
 	go func() {
-		_ = cmd.Wait()
-		g.dispose()
+		_, _ = windows.WaitForSingleObject(handle, windows.INFINITE)
+		_ = windows.CloseHandle(handle)
+		_ = g.dispose()
 	}()
 
 	return nil
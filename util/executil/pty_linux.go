@@ -0,0 +1,125 @@
+package executil
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// openPty 打开伪终端,返回主设备和从设备;通过SyscallConn执行ioctl,主设备保持非阻塞模式,Close能够中断正在进行的Read
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n uint32
+	err = control(master, func(fd int) error {
+		err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+		if err != nil {
+			return err
+		}
+		n, err = unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.FormatUint(uint64(n), 10), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+func control(f *os.File, fn func(fd int) error) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	err = conn.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// StartPty 在新的会话中启动cmd,以伪终端作为其标准输入输出和控制终端,返回伪终端主设备;
+// 子进程成为新会话的首进程,可通过KillSession结束其创建的所有进程
+func StartPty(cmd *exec.Cmd, rows uint16, cols uint16) (*os.File, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	//父进程不再需要从设备,子进程全部退出后主设备的Read返回错误
+	defer slave.Close()
+	err = SetPtySize(master, rows, cols)
+	if err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+	err = StartCmd(cmd)
+	if err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	return master, nil
+}
+
+// SetPtySize 调整伪终端的窗口大小,前台进程会收到SIGWINCH
+func SetPtySize(pty *os.File, rows uint16, cols uint16) error {
+	return control(pty, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols})
+	})
+}
+
+// KillSession 向以cmd为首进程的会话中的所有进程发送信号;
+// 交互式shell会为每个作业创建单独的进程组,按会话结束才能清理所有后台作业
+func KillSession(cmd *exec.Cmd, sig os.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	signal, ok := sig.(syscall.Signal)
+	if !ok {
+		return cmd.Process.Signal(sig)
+	}
+	sid := cmd.Process.Pid
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		//进程名中可能包含空格和括号,从最后一个右括号之后按state ppid pgrp session的顺序解析
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 4 || fields[3] != strconv.Itoa(sid) {
+			continue
+		}
+		_ = syscall.Kill(pid, signal)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package executil
+
+import (
+	"os"
+	"os/exec"
+)
+
+func StartPty(cmd *exec.Cmd, rows uint16, cols uint16) (*os.File, error) {
+	return nil, PtyUnsupportedError
+}
+
+func SetPtySize(pty *os.File, rows uint16, cols uint16) error {
+	return PtyUnsupportedError
+}
+
+// KillSession 不支持会话的平台只结束cmd本身
+func KillSession(cmd *exec.Cmd, sig os.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
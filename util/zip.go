@@ -62,3 +62,45 @@ func Unzip(src string, dest string, fileMode os.FileMode) error {
 	}
 	return nil
 }
+
+// ZipDir 将目录打包为zip写入w,用于边打包边传输;只包含目录和普通文件,文件名使用相对dir的路径
+func ZipDir(w io.Writer, dir string) error {
+	writer := zip.NewWriter(w)
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		if name == "." || !(info.IsDir() || info.Mode().IsRegular()) {
+			return nil
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		entry, err := writer.CreateHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(entry, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}